@@ -0,0 +1,46 @@
+/*! \file admin.go
+	\brief Who counts as an admin, admins are listed by user id in the config
+*/
+
+package cmd
+
+import (
+	"github.com/NathanRThomas/boiler_api/pkg/models"
+
+	"github.com/pkg/errors"
+
+	"net/http"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- FUNCTIONS ---------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief True if the user is on the admin list in the config
+*/
+func IsAdmin (user *models.User_t) bool {
+	if user == nil || !user.ID.Valid() { return false }
+	for _, id := range CFG.Admin.Users {
+		if id == user.ID.String() { return true }
+	}
+	return false
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- MIDDLEWARE --------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Only lets admins through, this needs to come after the user is logged in, ie after bearerCheck
+*/
+func (this *App_c) AdminCheck (next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := r.Context().Value("user").(*models.User_t)
+		if !ok { this.ServerError (errors.WithStack (models.ErrType_userMissing), ApiErrorCode_missingFromContext, w); return }
+
+		if !IsAdmin (user) {
+			this.Forbidden (w, "You don't have access to this")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
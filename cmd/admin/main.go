@@ -0,0 +1,121 @@
+/*! \file main.go
+	\brief Command line tools for running the cluster, uses the same config as the api
+	ie: admin maintenance read-only -msg "Upgrading the database" -retry 600
+*/
+
+package main
+
+ import (
+	"github.com/NathanRThomas/boiler_api/cmd"
+	"github.com/NathanRThomas/boiler_api/pkg/models/redis"
+
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+ )
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- DEFINES -----------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+const usage = `Usage: admin [-v] <command> [args]
+
+Commands:
+  maintenance status                                  shows the current maintenance mode
+  maintenance <read-only|full> [-msg ""] [-retry 300] puts every instance into maintenance mode
+  maintenance off                                     takes every instance out of maintenance mode
+`
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- COMMANDS ----------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Shows or changes the cluster-wide maintenance mode
+*/
+func maintenance (ctx context.Context, db *redis.DB_c, args []string) error {
+	if len(args) == 0 { return fmt.Errorf ("maintenance needs a mode\n\n%s", usage) }
+
+	switch args[0] {
+	case "status":
+		// nothing to change, we print it below
+
+	case "off":
+		if err := db.ClearMaintenance (ctx); err != nil { return err }
+
+	case redis.Maintenance_readOnly, redis.Maintenance_full:
+		fs := flag.NewFlagSet ("maintenance", flag.ExitOnError)
+		msg := fs.String ("msg", "", "Message to show the users, we have a default")
+		retry := fs.Int ("retry", 0, "Seconds for the Retry-After header")
+		fs.Parse (args[1:])
+
+		if err := db.SetMaintenance (ctx, &redis.Maintenance_t { Mode: args[0], Message: *msg, RetryAfter: *retry }); err != nil { return err }
+
+	default:
+		return fmt.Errorf ("unknown maintenance mode '%s'\n\n%s", args[0], usage)
+	}
+
+	m, err := db.GetMaintenance (ctx)
+	if err != nil { return err }
+	if m.Mode == redis.Maintenance_off {
+		fmt.Println ("maintenance mode is off")
+		return nil
+	}
+
+	jOut, _ := json.MarshalIndent (m, "", "  ")
+	fmt.Println (string(jOut))
+	return nil
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- MAIN --------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+func main() {
+	// parse from file first
+	err := cmd.ParseConfig ()
+	if err != nil { log.Fatalf ("Invalid Config: %s", err.Error()) }
+
+	flag.BoolVar (&cmd.CFG.Version, "v", false, "Returns the version of the admin tools")
+	flag.Usage = func() { fmt.Fprint (os.Stderr, usage) }
+	flag.Parse()
+
+	if cmd.CFG.Version {
+		fmt.Printf("\nAdmin Version: %s\n\n", cmd.API_ver)
+		os.Exit(0)
+	}
+
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// redis
+	if len(cmd.CFG.Redis.IPs) == 0 { log.Fatal ("no redis ip address") }
+	ip := cmd.CFG.Redis.IPs[len(cmd.CFG.Redis.IPs) -1] // always get the last one
+
+	redisDB, err := cmd.ConnectRedis (ip, cmd.CFG.Redis.Port)
+	if err != nil { log.Fatalf ("redis connect: %s", err.Error()) }
+	defer redisDB.Close()
+
+	db := &redis.DB_c { DB: redisDB, Addr: fmt.Sprintf("%s:%d", ip, cmd.CFG.Redis.Port) }
+
+	ctx, cancel := context.WithTimeout (context.Background(), time.Second * 10)
+	defer cancel()
+
+	switch args[0] {
+	case "maintenance":
+		err = maintenance (ctx, db, args[1:])
+	default:
+		err = fmt.Errorf ("unknown command '%s'\n\n%s", args[0], usage)
+	}
+
+	if err != nil {
+		fmt.Fprintf (os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,142 @@
+/*! \file grpc.go
+	\brief The grpc version of our user endpoints, for internal services
+	The service is described by hand since the messages are our json objects, clients need to call with the "json" content-subtype
+*/
+
+package main
+
+import (
+	"github.com/NathanRThomas/boiler_api/cmd"
+	"github.com/NathanRThomas/boiler_api/pkg/models"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+
+	"context"
+	"database/sql"
+	"time"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- STRUCTS -----------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+const grpcUserService = "boiler.api.v1.Users"
+
+type getUserRequest_t struct {
+	ID models.UUID
+}
+
+type empty_t struct {}
+
+//! What other services get back about a user, never their password or token
+type userInfo_t struct {
+	ID models.UUID
+	Email models.ApiString
+	Mask models.UserMask `json:",omitempty"`
+	Created, Updated time.Time
+	First, Last models.ApiString `json:",omitempty"`
+}
+
+//! What the service needs to look like, this is what grpc checks our handler against
+type userServer_i interface {
+	grpcLogin (context.Context, *models.User_t) (*loginResponse_t, error)
+	grpcGetUser (context.Context, *getUserRequest_t) (*userInfo_t, error)
+	grpcMe (context.Context, *empty_t) (*models.User_t, error)
+}
+
+/*! \brief Builds the grpc handler for a single method, decoding the request into a new T
+*/
+func unaryHandler[T any, R any] (method string, call func (userServer_i, context.Context, *T) (R, error)) grpc.MethodDesc {
+	return grpc.MethodDesc {
+		MethodName: method,
+		Handler: func (srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			in := new(T)
+			if err := dec (in); err != nil { return nil, err }
+
+			handler := func (ctx context.Context, req interface{}) (interface{}, error) { return call (srv.(userServer_i), ctx, req.(*T)) }
+			if interceptor == nil { return handler (ctx, in) }
+			return interceptor (ctx, in, &grpc.UnaryServerInfo { Server: srv, FullMethod: "/" + grpcUserService + "/" + method }, handler)
+		},
+	}
+}
+
+var userServiceDesc = grpc.ServiceDesc {
+	ServiceName: grpcUserService,
+	HandlerType: (*userServer_i)(nil),
+	Methods: []grpc.MethodDesc {
+		unaryHandler ("Login", userServer_i.grpcLogin),
+		unaryHandler ("GetUser", userServer_i.grpcGetUser),
+		unaryHandler ("Me", userServer_i.grpcMe),
+	},
+	Metadata: "boiler/api/v1/users",
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- FUNCTIONS ---------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief What we share about a user with other services, and in their webhooks. Never their password or token
+*/
+func newUserInfo (user *models.User_t) *userInfo_t {
+	return &userInfo_t { ID: user.ID, Email: user.Email, Mask: user.Mask, Created: user.Created, Updated: user.Updated,
+		First: user.Attr.First, Last: user.Attr.Last }
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- HANDLERS ----------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Same as PUT /login, limited by GrpcDdos
+*/
+func (this *app_c) grpcLogin (ctx context.Context, user *models.User_t) (*loginResponse_t, error) {
+	if err := models.Validate (user); err != nil { return nil, this.GrpcError (ctx, err) }
+
+	err := this.Users.Login (ctx, user)
+	if errors.Cause (err) == sql.ErrNoRows { err = errors.Wrap (models.ErrType_returnToUser, "Info not found in our system") }
+	if err != nil { return nil, this.GrpcError (ctx, err) }
+
+	this.publishLogin (ctx, user)
+	return &loginResponse_t { user }, nil
+}
+
+/*! \brief Looks up any user by id, this goes through our local cache
+	Only for admins and internal services calling with a client cert, and it never includes their password or token
+*/
+func (this *app_c) grpcGetUser (ctx context.Context, req *getUserRequest_t) (*userInfo_t, error) {
+	caller, _ := ctx.Value("user").(*models.User_t)
+	if !cmd.IsAdmin (caller) && !cmd.GrpcClientCert (ctx) { return nil, this.GrpcError (ctx, errors.WithStack (models.ErrType_permission)) }
+
+	if !req.ID.Valid() { return nil, this.GrpcError (ctx, errors.Wrap (models.ErrType_returnToUser, "ID is required")) }
+
+	user, err := this.GetUser (ctx, req.ID)
+	if err != nil { return nil, this.GrpcError (ctx, err) }
+
+	return newUserInfo (user), nil
+}
+
+/*! \brief Same as GET /user
+*/
+func (this *app_c) grpcMe (ctx context.Context, _ *empty_t) (*models.User_t, error) {
+	user, ok := ctx.Value("user").(*models.User_t)
+	if !ok { return nil, this.GrpcError (ctx, errors.WithStack (models.ErrType_userMissing)) }
+	return user, nil
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- ENTRY POINTS ------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Creates our grpc server with the user service registered, nil if it's not turned on in the config
+*/
+func (this *app_c) grpcServer () *grpc.Server {
+	if len(cmd.CFG.Grpc.Port) == 0 { return nil }
+
+	login := "/" + grpcUserService + "/Login"
+	srv := this.NewGrpcServer (
+		this.GrpcDdos (login),	// same as the ddos check on PUT /login
+		this.GrpcAuth (this.authenticate, login),
+		this.GrpcMaintenance ("/" + grpcUserService + "/GetUser", "/" + grpcUserService + "/Me"))
+	srv.RegisterService (&userServiceDesc, this)
+	return srv
+}
@@ -17,6 +17,33 @@ import (
 	"context"
 )
 
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- AUTH --------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Logs in the user from the Authorization value, "Bearer user_id:token"
+	This is shared by the http and grpc servers, ErrType_noIdentifiers or sql.ErrNoRows mean they need to log in
+*/
+func (this *app_c) authenticate (ctx context.Context, authToken string) (*models.User_t, error) {
+	if len(authToken) == 0 { return nil, errors.WithStack (models.ErrType_noIdentifiers) } // no authorization
+
+	bearerSplit := strings.Split (authToken, "Bearer")
+	if len(bearerSplit) == 2 {
+		authToken = strings.TrimSpace (bearerSplit[1]) // update this
+	} // else let's assume it's missing the word "bearer" and it's just the user_id:token
+	
+	userSplit := strings.Split (authToken, ":") // split out our user_id:token
+	if len(userSplit) != 2 { return nil, errors.WithStack (models.ErrType_noIdentifiers) } // invalid format
+
+	user := &models.User_t{}	// setup our user object
+	user.ID.Set (userSplit[0])
+	user.Token.Set (userSplit[1])
+	
+	//see if this user is "good"
+	if err := this.Users.TokenLogin (ctx, user); err != nil { return nil, err }
+	return user, nil
+}
+
   //-------------------------------------------------------------------------------------------------------------------------//
  //----- MIDDLEWARE --------------------------------------------------------------------------------------------------------//
 //-------------------------------------------------------------------------------------------------------------------------//
@@ -25,38 +52,16 @@ import (
 */
 func (this *app_c) bearerCheck (next http.Handler) http.Handler {
 	return http.HandlerFunc (func(w http.ResponseWriter, r *http.Request) {
-		// parse out an user from what's passed in by the body
 		ctx := r.Context()
 		
 		// see if we're logged in
-		authToken := r.Header.Get ("Authorization")
-		if len(authToken) == 0 { // no authorization
-			this.ErrorWithMsg (nil, w, http.StatusUnauthorized, cmd.ApiErrorCode_noIdentifiersForUser, "Please login")
-			return
-		}
-
-		bearerSplit := strings.Split (authToken, "Bearer")
-		if len(bearerSplit) == 2 {
-			authToken = strings.TrimSpace (bearerSplit[1]) // update this
-		} // else let's assume it's missing the word "bearer" and it's just the user_id:token
-		
-		userSplit := strings.Split (authToken, ":") // split out our user_id:token
-		if len(userSplit) != 2 { // invalid format
-			this.ErrorWithMsg (nil, w, http.StatusUnauthorized, cmd.ApiErrorCode_noIdentifiersForUser, "Please login")
-			return
-		}
-
-		user := &models.User_t{}	// setup our user object
-		user.ID.Set (userSplit[0])
-		user.Token.Set (userSplit[1])
-		
-		//see if this user is "good"
-		err := this.Users.TokenLogin (user)
+		user, err := this.authenticate (ctx, r.Header.Get ("Authorization"))
 
 		switch errors.Cause (err) {
 		case nil:
 			// we have an user, so add them to the context and get our bot and org as well
 			ctx = context.WithValue(ctx, "user", user)	// save our user in our context
+			this.LogWith (ctx, "user_id", user.ID)	// everything we log from here on is tied to this user
 
 			// now fire the next call with our user info now set
 			next.ServeHTTP(w, r.WithContext (ctx))	// send it along
@@ -14,6 +14,9 @@ package main
 	"os"
 	"net/http"
 	"flag"
+	"context"
+	"log"
+	"log/slog"
 	"time"
 	"sync"
  )
@@ -33,12 +36,13 @@ type app_c struct { // re-init this locally so we can add scope to functions we
 /*! \brief You got to start somewhere
 */
 func main() {
-	// create our logs
-	errorLog, infoLog := cmd.CreateLoggers ()
-	
 	// parse from file first
 	err := cmd.ParseConfig ()
-	if err != nil { errorLog.Fatalf ("Invalid Config: %s", err.Error()) }
+	if err != nil { log.Fatalf ("Invalid Config: %s", err.Error()) }
+
+	// create our logs, the format and level come from the config
+	logger, logLevel, err := cmd.CreateLogger ()
+	if err != nil { log.Fatalf ("Invalid Log Config: %s", err.Error()) }
 
 	// now handle command line flags, these override the config file
 	flag.BoolVar (&cmd.CFG.Version, "v", false, "Returns the version of the api")
@@ -51,57 +55,86 @@ func main() {
 		os.Exit(0)
 	}
 
+	// tracing, this needs to be up before we start making any calls
+	stopTracing, err := cmd.StartTracing ("api")
+	if err != nil { cmd.LogFatal (logger, "tracing", err) }
+
 	// connect to our database(s)
 	// redis
-	if len(cmd.CFG.Redis.IPs) == 0 { errorLog.Fatal ("no redis ip address") }
+	if len(cmd.CFG.Redis.IPs) == 0 { cmd.LogFatal (logger, "no redis ip address", nil) }
 	ip := cmd.CFG.Redis.IPs[len(cmd.CFG.Redis.IPs) -1] // always get the last one
 
 	redisDB, err := cmd.ConnectRedis (ip, cmd.CFG.Redis.Port)
-	if err != nil { errorLog.Fatal (err) }	// we can't start without the cache service running
+	if err != nil { cmd.LogFatal (logger, "redis connect", err) }	// we can't start without the cache service running
 	
 	// cockroach
 	cockDB, err := cmd.ConnectCockroach (cmd.CFG.Cockroach.IP, cmd.CFG.Cockroach.Port, cmd.CFG.Cockroach.Database, cmd.CFG.Cockroach.User)
-	if err != nil { errorLog.Fatal (err) }
+	if err != nil { cmd.LogFatal (logger, "cockroach connect", err) }
 
 	app := &app_c { App_c: cmd.App_c {
-			Running: true,
+			Life: cmd.NewLifecycle (logger),
 			WG: new(sync.WaitGroup),
-			ErrorLog: errorLog, 
-			InfoLog: infoLog,
-			Redis: &redis.DB_c { DB: redisDB }, 
+			Log: logger,
+			LogLevel: logLevel,
+			Redis: &redis.DB_c { DB: redisDB, Addr: fmt.Sprintf("%s:%d", ip, cmd.CFG.Redis.Port) }, 
 			Cache: cache.New(60*time.Second, 10*time.Minute),	// local cache
 		},
 	}
+	app.Authenticate = app.authenticate	// lets admins through maintenance mode
 	
 
-	// task handlers
-	app.StartTaskQue()
+	// tracing first, so it's the last thing we stop and we keep every span
+	app.Life.OnStop ("tracing", cmd.Phase_telemetry, stopTracing)
+	app.Life.OnStop ("cockroach", cmd.Phase_connections, func (context.Context) error { return cockDB.Close() })
+	app.Life.OnStop ("redis", cmd.Phase_connections, func (context.Context) error { return redisDB.Close() })
+
+	// health checks, metrics and flags are all used by the workers, so they have to be set up before any start
+	app.StartHealth()
+	app.StartMetrics()	// this also needs to happen before we create our routes
+	app.StartFlags()
+
+	// task handlers, when the que is shared the task service works it and we only add to it
+	if err := app.OpenTaskQue(); err != nil { cmd.LogFatal (logger, "task que", err) }
+	if app.TaskQue.Local() {
+		if err := app.StartTaskQue(); err != nil { cmd.LogFatal (logger, "task que", err) }
+	}
+	app.Life.OnStop ("task que", cmd.Phase_workers, app.StopTaskQue)	// the servers are done by now, so nothing else is being queued
+	app.Life.OnStop ("flags", cmd.Phase_workers, app.StopFlags)
+
+	// real-time events for users, we can still run without these
+	if err := app.StartEvents(); err != nil { logger.Error ("events unavailable", "error", err) }
+
+	if metricsSrv := app.ServeMetrics(); metricsSrv != nil { app.Life.OnStop ("metrics", cmd.Phase_telemetry, metricsSrv.Shutdown) }
+	if debugSrv := app.ServeDebug(); debugSrv != nil { app.Life.OnStop ("debug", cmd.Phase_telemetry, debugSrv.Shutdown) }
 	
 	// server
 	srv := &http.Server {
         Addr:     ":" + cmd.CFG.Port,
-        ErrorLog: errorLog,
+        ErrorLog: slog.NewLogLogger (logger.Handler(), slog.LevelError),
         Handler:  app.routes(),
 	}
 
-	// signal handling
-	cmd.MonitorSignals(&app.Running, srv)
-	
-	infoLog.Printf("Starting API server on port %s\n", cmd.CFG.Port)
-	if err := srv.ListenAndServe(); err != http.ErrServerClosed {	// Error starting or closing listener:
-		errorLog.Printf("API server ListenAndServe: %v", err)
-	}
+	// https, if there's a certificate in the config
+	srv.TLSConfig, err = app.StartTLS()
+	if err != nil { cmd.LogFatal (logger, "tls config", err) }
+	if redirectSrv := app.ServeRedirect(); redirectSrv != nil { app.Life.OnStop ("redirect", cmd.Phase_servers, redirectSrv.Shutdown) }
 
-	// we're out of the LB at this point, but we still need to make sure we aren't still adding to the queues before we close them
-	time.Sleep(time.Second * 3)
-	close(app.TaskQue) // close this que, this will wait for all the queued items to get processed
-	
-	app.WG.Wait() //wait for the workers and queen to finish
-	time.Sleep(time.Second * 3) //just to make sure we're really done
+	srv.RegisterOnShutdown (app.StopEvents)	// open event streams would keep the shutdown waiting forever
+	app.Life.Serve ("api", cmd.Phase_servers, srv)
 
-	// close down the database connections now that we're done handling requests
-	cockDB.Close ()
-	redisDB.Close ()
+	// grpc for internal services, only if there's a port for it
+	grpcSrv := app.grpcServer()
+	app.Life.Register ("grpc", cmd.Phase_servers, 
+		func (context.Context) error { return app.ServeGrpc (grpcSrv) }, 
+		func (ctx context.Context) error { return app.StopGrpc (ctx, grpcSrv) })
+
+	app.MonitorLogLevel()
+	
+	logger.Info("Starting API server", "port", cmd.CFG.Port, "version", cmd.API_ver)
+	if err := app.Life.Run(); err != nil {
+		logger.Error("API server stopped", "error", err)
+		os.Exit(1)
+	}
 	
 	os.Exit(0)	//final exit
 }
\ No newline at end of file
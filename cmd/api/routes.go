@@ -5,6 +5,12 @@
 package main
 
 import (
+	"github.com/NathanRThomas/boiler_api/cmd"
+	"github.com/NathanRThomas/boiler_api/pkg/models"
+	"github.com/NathanRThomas/boiler_api/pkg/models/redis"
+
+	"github.com/gorilla/mux"
+	"github.com/justinas/alice"
 	
 	//"fmt"
 	"net/http"
@@ -14,6 +20,126 @@ import (
  //----- ROUTES ------------------------------------------------------------------------------------------------------------//
 //-------------------------------------------------------------------------------------------------------------------------//
 
+/*! \brief Our user routes, these are registered on the root and on each version
+*/
+func (this *app_c) userRoutes (mux *mux.Router, ddos, loggedIn alice.Chain) {
+// user - not logged in
+	this.Describe (mux.Handle("/login", ddos.ThenFunc (this.userLogin)).Methods(http.MethodPut, http.MethodOptions), cmd.RouteOpts_t {
+		Summary: "Logs in a user with their email and password", Tags: []string{"user"},
+		Request: models.User_t{}, Response: loginResponse_t{},
+		MaxBody: 4 << 10, ContentTypes: []string{ cmd.ContentType_json, cmd.ContentType_form },
+	})
+
+// user - logged in
+	this.Describe (mux.Handle("/user", loggedIn.ThenFunc (this.userGet)).Methods(http.MethodGet, http.MethodOptions), cmd.RouteOpts_t {
+		Summary: "Returns the logged in user", Tags: []string{"user"}, Auth: true,
+		Response: models.User_t{},
+	})
+
+	this.Describe (mux.Handle("/user/flags", loggedIn.ThenFunc (this.UserFlags)).Methods(http.MethodGet, http.MethodOptions), cmd.RouteOpts_t {
+		Summary: "Returns every feature flag for the logged in user, on/off flags are a bool and variant flags are the variant they get", Tags: []string{"user"}, Auth: true,
+		Response: map[string]interface{}{},
+	})
+
+	// webhooks
+	this.Describe (mux.Handle("/user/webhooks", loggedIn.ThenFunc (this.WebhookList)).Methods(http.MethodGet, http.MethodOptions), cmd.RouteOpts_t {
+		Summary: "Returns every webhook the logged in user has", Tags: []string{"webhooks"}, Auth: true,
+		Response: []models.Webhook_t{},
+	})
+
+	this.Describe (mux.Handle("/user/webhooks", loggedIn.ThenFunc (this.WebhookCreate)).Methods(http.MethodPost, http.MethodOptions), cmd.RouteOpts_t {
+		Summary: "Creates a webhook, the response has the secret for checking our signatures", Tags: []string{"webhooks"}, Auth: true,
+		Request: models.Webhook_t{}, Response: models.Webhook_t{},
+	})
+
+	this.Describe (mux.Handle("/user/webhooks/{id}", loggedIn.ThenFunc (this.WebhookGet)).Methods(http.MethodGet, http.MethodOptions), cmd.RouteOpts_t {
+		Summary: "Returns a single webhook", Tags: []string{"webhooks"}, Auth: true,
+		Response: models.Webhook_t{},
+	})
+
+	this.Describe (mux.Handle("/user/webhooks/{id}", loggedIn.ThenFunc (this.WebhookSave)).Methods(http.MethodPut, http.MethodOptions), cmd.RouteOpts_t {
+		Summary: "Updates a webhook, or turns it back on after it was disabled", Tags: []string{"webhooks"}, Auth: true,
+		Request: models.Webhook_t{}, Response: models.Webhook_t{},
+	})
+
+	this.Describe (mux.Handle("/user/webhooks/{id}", loggedIn.ThenFunc (this.WebhookDelete)).Methods(http.MethodDelete, http.MethodOptions), cmd.RouteOpts_t {
+		Summary: "Deletes a webhook and its delivery log", Tags: []string{"webhooks"}, Auth: true,
+	})
+
+	this.Describe (mux.Handle("/user/webhooks/{id}/deliveries", loggedIn.ThenFunc (this.WebhookDeliveries)).Methods(http.MethodGet, http.MethodOptions), cmd.RouteOpts_t {
+		Summary: "Returns the delivery log for a webhook, newest first", Tags: []string{"webhooks"}, Auth: true,
+		Response: []models.WebhookDelivery_t{},
+	})
+
+	this.Describe (mux.Handle("/user/webhooks/{id}/ping", loggedIn.ThenFunc (this.WebhookPing)).Methods(http.MethodPost, http.MethodOptions), cmd.RouteOpts_t {
+		Summary: "Sends a test event to the webhook", Tags: []string{"webhooks"}, Auth: true,
+		Response: models.WebhookDelivery_t{},
+	})
+
+	this.Describe (mux.Handle("/events", loggedIn.ThenFunc (this.EventStream)).Methods(http.MethodGet, http.MethodOptions), cmd.RouteOpts_t {
+		Summary: "Streams events for the logged in user as server-sent events", Tags: []string{"user"}, Auth: true,
+		Timeout: -1, NoCompress: true,
+	})
+}
+
+/*! \brief Admin only routes, these aren't versioned
+*/
+func (this *app_c) adminRoutes (mux *mux.Router, admin alice.Chain) {
+	this.Describe (mux.Handle("/admin/maintenance", admin.ThenFunc (this.MaintenanceGet)).Methods(http.MethodGet, http.MethodOptions), cmd.RouteOpts_t {
+		Summary: "Returns the current maintenance mode", Tags: []string{"admin"}, Auth: true,
+		Response: redis.Maintenance_t{},
+	})
+
+	this.Describe (mux.Handle("/admin/maintenance", admin.ThenFunc (this.MaintenanceSet)).Methods(http.MethodPut, http.MethodOptions), cmd.RouteOpts_t {
+		Summary: "Puts every instance into read-only or full maintenance mode", Tags: []string{"admin"}, Auth: true,
+		Request: redis.Maintenance_t{}, Response: redis.Maintenance_t{},
+	})
+
+	this.Describe (mux.Handle("/admin/maintenance", admin.ThenFunc (this.MaintenanceClear)).Methods(http.MethodDelete, http.MethodOptions), cmd.RouteOpts_t {
+		Summary: "Takes every instance out of maintenance mode", Tags: []string{"admin"}, Auth: true,
+	})
+
+	// feature flags
+	this.Describe (mux.Handle("/admin/flags", admin.ThenFunc (this.FlagList)).Methods(http.MethodGet, http.MethodOptions), cmd.RouteOpts_t {
+		Summary: "Returns every feature flag", Tags: []string{"admin"}, Auth: true,
+		Response: []models.Flag_t{},
+	})
+
+	this.Describe (mux.Handle("/admin/flags/{key}", admin.ThenFunc (this.FlagGet)).Methods(http.MethodGet, http.MethodOptions), cmd.RouteOpts_t {
+		Summary: "Returns a single feature flag", Tags: []string{"admin"}, Auth: true,
+		Response: models.Flag_t{},
+	})
+
+	this.Describe (mux.Handle("/admin/flags/{key}", admin.ThenFunc (this.FlagSave)).Methods(http.MethodPut, http.MethodOptions), cmd.RouteOpts_t {
+		Summary: "Creates or replaces a feature flag, every instance picks up the change right away", Tags: []string{"admin"}, Auth: true,
+		Request: models.Flag_t{}, Response: models.Flag_t{},
+	})
+
+	this.Describe (mux.Handle("/admin/flags/{key}", admin.ThenFunc (this.FlagDelete)).Methods(http.MethodDelete, http.MethodOptions), cmd.RouteOpts_t {
+		Summary: "Deletes a feature flag, it's off for everyone after this", Tags: []string{"admin"}, Auth: true,
+	})
+
+	// tasks we gave up on
+	this.Describe (mux.Handle("/admin/tasks/dead", admin.ThenFunc (this.DeadLetterList)).Methods(http.MethodGet, http.MethodOptions), cmd.RouteOpts_t {
+		Summary: "Returns a page of dead lettered tasks, newest first", Tags: []string{"admin"}, Auth: true,
+		Response: cmd.DeadLetters_t{},
+	})
+
+	this.Describe (mux.Handle("/admin/tasks/dead", admin.ThenFunc (this.DeadLetterPurge)).Methods(http.MethodDelete, http.MethodOptions), cmd.RouteOpts_t {
+		Summary: "Drops every dead lettered task", Tags: []string{"admin"}, Auth: true,
+		Response: cmd.DeadLettersPurged_t{},
+	})
+
+	this.Describe (mux.Handle("/admin/tasks/dead/{id}/replay", admin.ThenFunc (this.DeadLetterReplay)).Methods(http.MethodPost, http.MethodOptions), cmd.RouteOpts_t {
+		Summary: "Queues a dead lettered task again with a fresh set of attempts", Tags: []string{"admin"}, Auth: true,
+		Response: models.Que_t{},
+	})
+
+	this.Describe (mux.Handle("/admin/tasks/dead/{id}", admin.ThenFunc (this.DeadLetterDelete)).Methods(http.MethodDelete, http.MethodOptions), cmd.RouteOpts_t {
+		Summary: "Drops a single dead lettered task", Tags: []string{"admin"}, Auth: true,
+	})
+}
+
 func (this *app_c) routes () http.Handler {
 	mux := this.Routes () // get our base mux for handling things
 
@@ -22,14 +148,16 @@ func (this *app_c) routes () http.Handler {
 	ddos := std.Append (this.Ddos)
 
 	loggedIn := std.Append (this.bearerCheck)	// validates the bearer token
+	admin := loggedIn.Append (this.AdminCheck)	// only the admins in the config
 
+	// the original un-versioned routes, these stay the same as v1 so existing clients keep working
+	this.userRoutes (mux, ddos, loggedIn)
 
-// user - not logged in
-	mux.Handle("/login", ddos.ThenFunc (this.userLogin)).Methods(http.MethodPut, http.MethodOptions)
+	this.adminRoutes (mux, admin)
 
-// user - logged in
-	mux.Handle("/user", loggedIn.ThenFunc (this.userGet)).Methods(http.MethodGet, http.MethodOptions)
+	// v1
+	v1 := this.Version ("v1")
+	this.userRoutes (v1.Router, ddos, loggedIn)
 
-	return mux
+	return this.AcceptVersion (mux)
 }
-
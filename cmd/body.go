@@ -0,0 +1,270 @@
+/*! \file body.go
+	\brief Reading request bodies, with a size limit and based on the content type
+	Json, form and multipart bodies are all supported by ParseFromBody
+*/
+
+package cmd
+
+import (
+	"github.com/NathanRThomas/boiler_api/pkg/models"
+
+	"github.com/pkg/errors"
+
+	"fmt"
+	"io"
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/url"
+	"net/http"
+	"context"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- DEFINES -----------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+const defaultMaxBody int64	= 1 << 20	// 1MB, unless the config or the route says otherwise
+
+const (
+	ContentType_json		= "application/json"
+	ContentType_form		= "application/x-www-form-urlencoded"
+	ContentType_multipart	= "multipart/form-data"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- LOCAL FUNCTIONS ---------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Sets a single field from a string form value
+*/
+func setFormValue (v reflect.Value, vals []string) error {
+	if len(vals) == 0 { return nil }
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString (vals[0])
+	case reflect.Bool:
+		b, err := strconv.ParseBool (vals[0])
+		if err != nil { return errors.New ("expected a boolean") }
+		v.SetBool (b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt (vals[0], 10, 64)
+		if err != nil { return errors.New ("expected an integer") }
+		v.SetInt (i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		i, err := strconv.ParseUint (vals[0], 10, 64)
+		if err != nil { return errors.New ("expected a positive integer") }
+		v.SetUint (i)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat (vals[0], 64)
+		if err != nil { return errors.New ("expected a number") }
+		v.SetFloat (f)
+	case reflect.Slice:
+		out := reflect.MakeSlice (v.Type(), len(vals), len(vals))
+		for i := range vals {
+			if err := setFormValue (out.Index(i), vals[i:i+1]); err != nil { return err }
+		}
+		v.Set (out)
+	case reflect.Ptr:
+		if v.IsNil() { v.Set (reflect.New (v.Type().Elem())) }
+		return setFormValue (v.Elem(), vals)
+	default:
+		return errors.New ("can't be set from a form value")
+	}
+	return nil
+}
+
+/*! \brief Finds the form values for this key, matching the case like json does
+*/
+func formValues (form url.Values, key string) ([]string, bool) {
+	if vals, ok := form[key]; ok { return vals, true }
+	for k, vals := range form {
+		if strings.EqualFold (k, key) { return vals, true }
+	}
+	return nil, false
+}
+
+/*! \brief Reads form values into the struct, using the same field names json would
+	Nested structs use dotted names, ie Attr.First
+*/
+func decodeForm (form url.Values, v reflect.Value, prefix string, errs *models.FieldErrors_t) {
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() { v.Set (reflect.New (v.Type().Elem())) }
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct { return }
+
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, ok := models.JsonFieldName (f)
+		if !ok { continue }
+
+		fv := v.Field(i)
+		if f.Anonymous && f.Type.Kind() == reflect.Struct && len(f.Tag.Get ("json")) == 0 {
+			decodeForm (form, fv, prefix, errs) // embedded, so these are at our level
+			continue
+		}
+
+		key := prefix + name
+		if fv.Kind() == reflect.Struct && f.Type != timeType {
+			decodeForm (form, fv, key + ".", errs)
+			continue
+		}
+
+		if vals, ok := formValues (form, key); ok {
+			if err := setFormValue (fv, vals); err != nil { errs.Add (key, err.Error()) }
+		}
+	}
+}
+
+/*! \brief Checks if the media type is one the route accepts
+*/
+func contentTypeAllowed (mediaType string, allowed []string) bool {
+	if len(allowed) == 0 { allowed = []string { ContentType_json, ContentType_form, ContentType_multipart } }
+	for _, a := range allowed {
+		if strings.EqualFold (a, mediaType) { return true }
+	}
+	return false
+}
+
+/*! \brief Converts a MaxBytesReader error into our own so the handlers know to send a 413
+*/
+func bodyErr (err error) error {
+	if err == nil { return nil }
+	var maxErr *http.MaxBytesError
+	if errors.As (err, &maxErr) { return errors.Wrapf (models.ErrType_bodyTooLarge, "limit %d", maxErr.Limit) }
+	return errors.WithStack (err)
+}
+
+/*! \brief Reads the body into the object based on what we stored for its content type
+*/
+func decodeBody (ctx context.Context, out interface{}) error {
+	if body, ok := ctx.Value("body").([]byte); ok && len(body) > 0 {
+		if CFG.OpenApi.Validate {
+			if err := validateBody (body, out); err != nil { return err }	// check it against the schema first so we can report every bad field
+		}
+		return errors.WithStack (json.Unmarshal (body, out))
+	}
+
+	if form, ok := ctx.Value("form").(url.Values); ok {
+		errs := &models.FieldErrors_t{}
+		decodeForm (form, reflect.ValueOf (out), "", errs)
+		return errors.WithStack (errs.Err())
+	}
+
+	if reader, ok := ctx.Value("bodyReader").(io.Reader); ok { // streaming route, but they still want it as json
+		if err := json.NewDecoder (reader).Decode (out); err != nil && err != io.EOF { return bodyErr (err) }
+	}
+	return nil
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- LOCAL MIDDLEWARE --------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Reads the body into our context based on its content type, never reading more than the limit for the route
+*/
+func (this *App_c) readBody (next http.Handler) http.Handler {
+    return http.HandlerFunc (func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength == 0 || r.Body == nil || r.Body == http.NoBody { // nothing to read, this is most of our GETs
+			next.ServeHTTP (w, r)
+			return
+		}
+
+		opts := this.routeOptions (r)
+		limit := opts.MaxBody
+		if limit <= 0 { limit = CFG.Body.MaxBytes }
+		if limit <= 0 { limit = defaultMaxBody }
+
+		if r.ContentLength > limit { // they told us up front it's too big
+			this.ErrorWithMsg (nil, w, http.StatusRequestEntityTooLarge, ApiErrorCode_bodyTooLarge, "Request body can't be larger than %d bytes", limit)
+			return
+		}
+
+		mediaType := ContentType_json // we've always assumed json, so keep doing that when it's not set
+		if ct := r.Header.Get ("Content-Type"); len(ct) > 0 {
+			mt, _, err := mime.ParseMediaType (ct)
+			if err != nil { mt = ct }
+			mediaType = strings.ToLower (mt)
+		}
+
+		if !contentTypeAllowed (mediaType, opts.ContentTypes) {
+			this.ErrorWithMsg (nil, w, http.StatusUnsupportedMediaType, ApiErrorCode_unsupportedMediaType, "Content-Type %s is not supported here", mediaType)
+			return
+		}
+
+		r.Body = http.MaxBytesReader (w, r.Body, limit)
+		ctx := context.WithValue (r.Context(), "contentType", mediaType)
+
+		if opts.Stream { // the handler is going to read this itself
+			next.ServeHTTP (w, r.WithContext (context.WithValue (ctx, "bodyReader", io.Reader(r.Body))))
+			return
+		}
+
+		var err error
+		switch mediaType {
+		case ContentType_form:
+			if err = r.ParseForm(); err == nil { ctx = context.WithValue (ctx, "form", r.PostForm) }
+
+		case ContentType_multipart:
+			if err = r.ParseMultipartForm (limit); err == nil {
+				defer r.MultipartForm.RemoveAll()	// clean up any temp files once we're done
+				ctx = context.WithValue (ctx, "form", url.Values (r.MultipartForm.Value))
+				ctx = context.WithValue (ctx, "multipart", r.MultipartForm)
+			}
+
+		default:
+			var body []byte
+			if body, err = ioutil.ReadAll (r.Body); err == nil { ctx = context.WithValue (ctx, "body", body) }
+		}
+
+		if err = bodyErr (err); err != nil {
+			if errors.Cause (err) == models.ErrType_bodyTooLarge {
+				this.ErrorWithMsg (nil, w, http.StatusRequestEntityTooLarge, ApiErrorCode_bodyTooLarge, "Request body can't be larger than %d bytes", limit)
+			} else {
+				this.ErrorWithMsg (err, w, http.StatusBadRequest, ApiErrorCode_parsingRequestBody, "")
+			}
+			return
+		}
+
+		next.ServeHTTP (w, r.WithContext (ctx))
+    })
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PUBLIC FUNCTIONS --------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Handles pulling in data from our body into whatever object we need to read it into
+	Json bodies can be validated against the schema first, form bodies use the same field names as json
+	Once it's read, any validate tags on the object are checked and every bad field is returned at once
+*/
+func (this *App_c) ParseFromBody (ctx context.Context, out interface{}) error {
+	if err := decodeBody (ctx, out); err != nil { return err }
+	return models.Validate (out)
+}
+
+/*! \brief For streaming routes, this is the body to read from. It's still limited to the max size for the route
+*/
+func (this *App_c) BodyReader (ctx context.Context) io.Reader {
+	if reader, ok := ctx.Value("bodyReader").(io.Reader); ok { return reader }
+	return strings.NewReader ("")
+}
+
+/*! \brief Returns an uploaded file from a multipart body
+*/
+func (this *App_c) FormFile (ctx context.Context, name string) (multipart.File, *multipart.FileHeader, error) {
+	form, ok := ctx.Value("multipart").(*multipart.Form)
+	if !ok || len(form.File[name]) == 0 { return nil, nil, errors.WithStack (http.ErrMissingFile) }
+
+	fh := form.File[name][0]
+	f, err := fh.Open()
+	if err != nil { return nil, nil, errors.Wrap (err, fmt.Sprintf("opening %s", name)) }
+	return f, fh, nil
+}
@@ -0,0 +1,265 @@
+/*! \file compress.go
+	\brief Response compression and conditional GETs
+	Most of our responses are small json objects polled by mobile clients, so not sending them at all beats compressing them
+*/
+
+package cmd
+
+import (
+	"github.com/andybalholm/brotli"
+
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- DEFINES -----------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+const defaultCompressMin	= 1024	// bytes, below this compressing isn't worth the cpu
+
+const (
+	Encoding_gzip		= "gzip"
+	Encoding_brotli		= "br"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- TYPES -------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+//! Holds the response until we know if it's big enough to compress, then compresses everything after that as it comes in
+type compressWriter_t struct {
+	http.ResponseWriter
+	encoding	string	// what the client said they'd take
+	min			int
+	status		int
+	buf			bytes.Buffer
+	enc			io.WriteCloser	// set once we've decided to compress
+	decided		bool
+}
+
+func (this *compressWriter_t) WriteHeader (status int) {
+	if this.status == 0 { this.status = status }
+}
+
+func (this *compressWriter_t) Write (b []byte) (int, error) {
+	if this.status == 0 { this.status = http.StatusOK }
+	if this.decided {
+		if this.enc != nil { return this.enc.Write (b) }
+		return this.ResponseWriter.Write (b)
+	}
+
+	this.buf.Write (b)
+	if this.buf.Len() >= this.min { this.decide (true) }
+	return len(b), nil
+}
+
+/*! \brief Streaming responses need what we have so far, so this forces a decision based on what we have
+*/
+func (this *compressWriter_t) Flush () {
+	if !this.decided { this.decide (true) }
+	if f, ok := this.enc.(interface { Flush() error }); ok { f.Flush() }
+	if f, ok := this.ResponseWriter.(http.Flusher); ok { f.Flush() }
+}
+
+func (this *compressWriter_t) Unwrap () http.ResponseWriter {
+	return this.ResponseWriter
+}
+
+/*! \brief Writes the headers and whatever we've buffered, compressing it if we're allowed and it's worth it
+*/
+func (this *compressWriter_t) decide (bigEnough bool) {
+	this.decided = true
+	if this.status == 0 { this.status = http.StatusOK }
+
+	h := this.ResponseWriter.Header()
+	if bigEnough && compressible (this.status, h) {
+		h.Set ("Content-Encoding", this.encoding)
+		h.Del ("Content-Length")
+
+		switch this.encoding {
+		case Encoding_brotli:
+			this.enc = brotli.NewWriterLevel (this.ResponseWriter, brotli.DefaultCompression)
+		default:
+			this.enc, _ = gzip.NewWriterLevel (this.ResponseWriter, gzip.DefaultCompression)
+		}
+	}
+
+	this.ResponseWriter.WriteHeader (this.status)
+	if this.buf.Len() == 0 { return }
+
+	if this.enc != nil {
+		this.enc.Write (this.buf.Bytes())
+	} else {
+		this.ResponseWriter.Write (this.buf.Bytes())
+	}
+	this.buf.Reset()
+}
+
+/*! \brief Finishes the response, anything still buffered was too small to compress
+*/
+func (this *compressWriter_t) close () {
+	if !this.decided {
+		if this.status == 0 && this.buf.Len() == 0 { return } // nothing was written, let the server send its default
+		this.decide (false)
+	}
+	if this.enc != nil { this.enc.Close() }
+}
+
+//! Buffers a GET response so we can hash it for the etag
+type etagWriter_t struct {
+	http.ResponseWriter
+	status	int
+	buf		bytes.Buffer
+}
+
+func (this *etagWriter_t) WriteHeader (status int) {
+	if this.status == 0 { this.status = status }
+}
+
+func (this *etagWriter_t) Write (b []byte) (int, error) {
+	if this.status == 0 { this.status = http.StatusOK }
+	return this.buf.Write (b)
+}
+
+func (this *etagWriter_t) Unwrap () http.ResponseWriter {
+	return this.ResponseWriter
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- LOCAL FUNCTIONS ---------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Picks the best encoding the client accepts, empty if we shouldn't compress
+*/
+func acceptedEncoding (r *http.Request) string {
+	gz := false
+	for _, part := range strings.Split (r.Header.Get ("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut (strings.TrimSpace (part), ";")
+		if q, ok := strings.CutPrefix (strings.ReplaceAll (params, " ", ""), "q="); ok {
+			if v, err := strconv.ParseFloat (q, 64); err == nil && v == 0 { continue } // they explicitly don't want this one
+		}
+
+		switch strings.ToLower (name) {
+		case Encoding_brotli:
+			return Encoding_brotli // our favorite, so we're done
+		case Encoding_gzip, "*":
+			gz = true
+		}
+	}
+	if gz { return Encoding_gzip }
+	return ""
+}
+
+/*! \brief Checks if the response is something worth compressing
+*/
+func compressible (status int, h http.Header) bool {
+	if status < http.StatusOK || status == http.StatusNoContent || status == http.StatusNotModified { return false }
+	if len(h.Get ("Content-Encoding")) > 0 { return false } // already done
+
+	ct := strings.ToLower (h.Get ("Content-Type"))
+	return len(ct) == 0 || strings.HasPrefix (ct, "text/") || strings.Contains (ct, "json") || strings.Contains (ct, "xml") || strings.Contains (ct, "javascript")
+}
+
+/*! \brief Checks our etag against the If-None-Match header
+*/
+func etagMatch (header, etag string) bool {
+	for _, tag := range strings.Split (header, ",") {
+		tag = strings.TrimPrefix (strings.TrimSpace (tag), "W/")
+		if tag == "*" || tag == etag { return true }
+	}
+	return false
+}
+
+/*! \brief Writes out a 304, keeping only the headers the spec says we should
+*/
+func notModified (w http.ResponseWriter) {
+	h := w.Header()
+	for _, k := range []string { "Content-Type", "Content-Length", "Content-Encoding" } { h.Del (k) }
+	w.WriteHeader (http.StatusNotModified)
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- LOCAL MIDDLEWARE --------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Compresses the response with brotli or gzip, if the client takes it and it's bigger than Compress.MinBytes
+*/
+func (this *App_c) compress (next http.Handler) http.Handler {
+	return http.HandlerFunc (func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add ("Vary", "Accept-Encoding")
+
+		encoding := acceptedEncoding (r)
+		if len(encoding) == 0 || r.Method == http.MethodHead || this.routeOptions (r).NoCompress {
+			next.ServeHTTP (w, r)
+			return
+		}
+
+		min := CFG.Compress.MinBytes
+		if min <= 0 { min = defaultCompressMin }
+
+		cw := &compressWriter_t { ResponseWriter: w, encoding: encoding, min: min }
+		defer cw.close()
+
+		next.ServeHTTP (cw, r)
+	})
+}
+
+/*! \brief Adds a strong etag to successful GETs, and returns a 304 when it matches what they already have
+	This sits outside of compress, so the etag is for the bytes we actually send and gzip and brotli get different ones
+*/
+func (this *App_c) conditionalGet (next http.Handler) http.Handler {
+	return http.HandlerFunc (func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || this.routeOptions (r).NoCompress { // streaming responses can't be buffered
+			next.ServeHTTP (w, r)
+			return
+		}
+
+		ew := &etagWriter_t { ResponseWriter: w }
+		next.ServeHTTP (ew, r)
+
+		if ew.status == 0 { return } // nothing written, probably LastModified already sent a 304
+
+		if ew.status == http.StatusOK && len(w.Header().Get ("ETag")) == 0 {
+			sum := sha256.Sum256 (ew.buf.Bytes())
+			etag := `"` + hex.EncodeToString (sum[:16]) + `"`
+			w.Header().Set ("ETag", etag)
+
+			if inm := r.Header.Get ("If-None-Match"); len(inm) > 0 && etagMatch (inm, etag) {
+				notModified (w)
+				return
+			}
+		}
+
+		w.WriteHeader (ew.status)
+		w.Write (ew.buf.Bytes())
+	})
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PUBLIC FUNCTIONS --------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Sets the Last-Modified header for the resource
+	Returns true if they already have this version, in which case we've sent a 304 and the handler is done
+*/
+func (this *App_c) LastModified (w http.ResponseWriter, r *http.Request, modified time.Time) bool {
+	if modified.IsZero() { return false }
+	modified = modified.UTC().Truncate (time.Second) // the header only has second precision
+
+	w.Header().Set ("Last-Modified", modified.Format (http.TimeFormat))
+
+	if len(r.Header.Get ("If-None-Match")) > 0 { return false } // the etag takes priority when they sent both
+	if since, err := http.ParseTime (r.Header.Get ("If-Modified-Since")); err == nil && !modified.After (since) {
+		notModified (w)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,126 @@
+/*! \file deadletters.go
+	\brief Admin routes for the tasks we gave up on, so they can be looked at and replayed once whatever was wrong is fixed
+*/
+
+package cmd
+
+import (
+	"github.com/NathanRThomas/boiler_api/pkg/models"
+	"github.com/NathanRThomas/boiler_api/pkg/models/redis"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- DEFINES -----------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+const (
+	defaultDeadLetterLimit	= 50
+	maxDeadLetterLimit		= 500
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- TYPES -------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+type DeadLetters_t struct {
+	Total int
+	DeadLetters []*redis.DeadLetter_t
+}
+
+type DeadLettersPurged_t struct {
+	Purged int
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- LOCAL FUNCTIONS ---------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Reads an optional int query param, false if it's there and isn't between min and max
+*/
+func queryInt (r *http.Request, name string, def, min, max int) (int, bool) {
+	v := r.URL.Query().Get (name)
+	if len(v) == 0 { return def, true }
+
+	out, err := strconv.Atoi (v)
+	return out, err == nil && out >= min && out <= max
+}
+
+/*! \brief A dead letter that isn't there is a 404, same as a missing row
+*/
+func deadLetterErr (err error) error {
+	if errors.Cause (err) == redis.ErrKeyNotFound { return sql.ErrNoRows }
+	return err
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- ROUTES ------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief GET /admin/tasks/dead?offset=0&limit=50, newest first
+*/
+func (this *App_c) DeadLetterList (w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	offset, ok := queryInt (r, "offset", 0, 0, redis.DeadLetterMax)
+	if !ok { this.MissingParam (w, "offset must be between 0 and %d", redis.DeadLetterMax); return }
+
+	limit, ok := queryInt (r, "limit", defaultDeadLetterLimit, 1, maxDeadLetterLimit)
+	if !ok { this.MissingParam (w, "limit must be between 1 and %d", maxDeadLetterLimit); return }
+
+	dead, err := this.Redis.DeadLetters (ctx, offset, limit)
+	this.Respond (err, w, DeadLetters_t { Total: this.Redis.DeadLetterCount (ctx), DeadLetters: dead })
+}
+
+/*! \brief POST /admin/tasks/dead/{id}/replay, queues the task again with a fresh set of attempts
+*/
+func (this *App_c) DeadLetterReplay (w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	dl, err := this.Redis.TakeDeadLetter (ctx, mux.Vars(r)["id"])
+	if err != nil { this.Respond (deadLetterErr (err), w, nil); return }
+
+	que := &models.Que_t{}
+	if err = json.Unmarshal (dl.Task, que); err != nil {
+		this.StackTraceCtx (ctx, this.Redis.PushDeadLetter (ctx, dl))	// put it back, it's no good to anyone gone
+		this.ServerError (errors.Wrap (err, string(dl.Task)), ApiErrorCode_jsonMarshal, w)
+		return
+	}
+
+	que.ID = ""	// it's a new task as far as the que is concerned
+	que.Attempts = 0
+	que.Expires = 0	// whoever's replaying it wants it run
+
+	if err = this.QueTask (ctx, que); err != nil {
+		this.StackTraceCtx (ctx, this.Redis.PushDeadLetter (ctx, dl))
+		this.Respond (err, w, nil)
+		return
+	}
+
+	this.Logger(ctx).Info ("dead letter replayed", "dead_letter", dl.ID, "que_id", que.ID, "task_type", que.Type)
+	this.SuccessWithMsg (w, que)
+}
+
+/*! \brief DELETE /admin/tasks/dead/{id}, drops a single dead letter
+*/
+func (this *App_c) DeadLetterDelete (w http.ResponseWriter, r *http.Request) {
+	_, err := this.Redis.TakeDeadLetter (r.Context(), mux.Vars(r)["id"])
+	this.Respond (deadLetterErr (err), w, nil)
+}
+
+/*! \brief DELETE /admin/tasks/dead, drops every dead letter
+*/
+func (this *App_c) DeadLetterPurge (w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	cnt, err := this.Redis.PurgeDeadLetters (ctx)
+	if err == nil { this.Logger(ctx).Warn ("dead letters purged", "count", cnt) }
+	this.Respond (err, w, DeadLettersPurged_t { Purged: cnt })
+}
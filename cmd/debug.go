@@ -0,0 +1,248 @@
+/*! \file debug.go
+	\brief Runtime debugging endpoints under /debug, pprof, build info, the config we're running with and our pool stats
+	These are only served when there's a Debug.Token in the config, or on their own port if Debug.Port is set
+	Without a token the debug port only listens on localhost
+*/
+
+package cmd
+
+import (
+	"github.com/NathanRThomas/boiler_api/pkg/models/cockroach"
+
+	"github.com/gorilla/mux"
+	"github.com/justinas/alice"
+	"github.com/pkg/errors"
+
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	rdebug "runtime/debug"
+	rpprof "runtime/pprof"
+	"strings"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- DEFINES -----------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+//! Set at build time, ie -ldflags "-X github.com/NathanRThomas/boiler_api/cmd.GitCommit=$(git rev-parse --short HEAD)"
+var GitCommit string
+
+const redacted = "[redacted]"
+
+//! Any config value with one of these in its name gets hidden
+var secretNames = []string { "token", "key", "pass", "secret" }
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- TYPES -------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+type buildInfo_t struct {
+	Version, Commit, Go, Built string
+	Modified bool	// built with uncommitted changes
+}
+
+type queStats_t struct {
+	Backend string
+	Length, Capacity int
+	Leased, Delayed int		// being worked on, and waiting to be retried. only for a shared que
+	Dead int		// given up on, these are in redis either way
+}
+
+type logLevel_t struct {
+	Level string
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- LOCAL FUNCTIONS ---------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Only lets in requests with our debug token, either as a bearer token or in X-Debug-Token
+	With no token in the config this only passes for requests from localhost
+*/
+func (this *App_c) debugAuth (next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(CFG.Debug.Token) > 0 {
+			token := r.Header.Get ("X-Debug-Token")
+			if len(token) == 0 { token = strings.TrimPrefix (r.Header.Get ("Authorization"), "Bearer ") }
+
+			if subtle.ConstantTimeCompare ([]byte(token), []byte(CFG.Debug.Token)) != 1 {
+				this.Forbidden (w, "")
+				return
+			}
+		} else if !loopback (r.RemoteAddr) {
+			this.Forbidden (w, "")	// the debug port should only be listening on localhost anyway
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+/*! \brief True when the remote address is on this machine
+*/
+func loopback (remote string) bool {
+	host, _, err := net.SplitHostPort (remote)
+	if err != nil { host = remote }
+
+	ip := net.ParseIP (host)
+	return ip != nil && ip.IsLoopback()
+}
+
+/*! \brief Walks the decoded config, replacing anything that looks like a secret
+*/
+func redactConfig (in interface{}) interface{} {
+	switch val := in.(type) {
+	case map[string]interface{}:
+		for k, v := range val {
+			name := strings.ToLower (k)
+			secret := false
+			for _, s := range secretNames {
+				if strings.Contains (name, s) { secret = true; break }
+			}
+
+			if secret {
+				if str, ok := v.(string); ok && len(str) == 0 { continue } // nothing set, so nothing to hide
+				val[k] = redacted
+			} else {
+				val[k] = redactConfig (v)
+			}
+		}
+	case []interface{}:
+		for i := range val { val[i] = redactConfig (val[i]) }
+	}
+	return in
+}
+
+/*! \brief Registers every debug endpoint on the router, they all sit under /debug
+*/
+func (this *App_c) debugRoutes (mux *mux.Router) {
+	chain := alice.New (this.requestLog, this.recoverPanic, this.debugAuth)	// no timeout, profiles can take a while
+	debug := mux.PathPrefix ("/debug").Subrouter()
+
+	debug.Handle ("/version", chain.ThenFunc(this.debugVersion)).Methods(http.MethodGet)
+	debug.Handle ("/config", chain.ThenFunc(this.debugConfig)).Methods(http.MethodGet)
+	debug.Handle ("/goroutines", chain.ThenFunc(this.debugGoroutines)).Methods(http.MethodGet)
+	debug.Handle ("/que", chain.ThenFunc(this.debugQue)).Methods(http.MethodGet)
+	debug.Handle ("/redis", chain.ThenFunc(this.debugRedis)).Methods(http.MethodGet)
+	debug.Handle ("/db", chain.ThenFunc(this.debugDB)).Methods(http.MethodGet)
+	debug.Handle ("/loglevel", chain.ThenFunc(this.debugLogLevel)).Methods(http.MethodGet, http.MethodPut)
+
+	debug.Handle ("/pprof/cmdline", chain.ThenFunc(pprof.Cmdline))
+	debug.Handle ("/pprof/profile", chain.ThenFunc(pprof.Profile))
+	debug.Handle ("/pprof/symbol", chain.ThenFunc(pprof.Symbol))
+	debug.Handle ("/pprof/trace", chain.ThenFunc(pprof.Trace))
+	debug.PathPrefix ("/pprof/").Handler(chain.ThenFunc(pprof.Index))	// index, and the named profiles, ie heap
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- ROUTES ------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief GET /debug/version, what we're running and where it came from
+*/
+func (this *App_c) debugVersion (w http.ResponseWriter, r *http.Request) {
+	info := buildInfo_t { Version: API_ver, Commit: GitCommit, Go: runtime.Version() }
+
+	if build, ok := rdebug.ReadBuildInfo(); ok {
+		for _, s := range build.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				if len(info.Commit) == 0 { info.Commit = s.Value } // go fills this in when it's built from the repo
+			case "vcs.time":
+				info.Built = s.Value
+			case "vcs.modified":
+				info.Modified = s.Value == "true"
+			}
+		}
+	}
+
+	this.SuccessWithMsg (w, info)
+}
+
+/*! \brief GET /debug/config, the config we loaded with the secrets taken out
+*/
+func (this *App_c) debugConfig (w http.ResponseWriter, r *http.Request) {
+	jCfg, err := json.Marshal (CFG)
+	if err != nil { this.ServerError (errors.WithStack (err), ApiErrorCode_jsonMarshal, w); return }
+
+	out := make(map[string]interface{})
+	if err = json.Unmarshal (jCfg, &out); err != nil { this.ServerError (errors.WithStack (err), ApiErrorCode_jsonMarshal, w); return }
+
+	this.SuccessWithMsg (w, redactConfig (out))
+}
+
+/*! \brief GET /debug/goroutines, full stack dump of every goroutine
+*/
+func (this *App_c) debugGoroutines (w http.ResponseWriter, r *http.Request) {
+	w.Header().Set ("Content-Type", "text/plain; charset=utf-8")
+	this.StackTrace (errors.WithStack (rpprof.Lookup ("goroutine").WriteTo (w, 2)))
+}
+
+/*! \brief GET /debug/que, how backed up the task que is
+*/
+func (this *App_c) debugQue (w http.ResponseWriter, r *http.Request) {
+	this.SuccessWithMsg (w, this.queStats (r.Context()))
+}
+
+/*! \brief GET /debug/redis, the state of our redis pool
+*/
+func (this *App_c) debugRedis (w http.ResponseWriter, r *http.Request) {
+	this.SuccessWithMsg (w, this.Redis.Stats())
+}
+
+/*! \brief GET /debug/db, the state of our database pool
+*/
+func (this *App_c) debugDB (w http.ResponseWriter, r *http.Request) {
+	this.SuccessWithMsg (w, cockroach.Stats())
+}
+
+/*! \brief GET /debug/loglevel returns the level we're logging at, PUT changes it, ie { "Level": "debug" }
+	This lasts until the next restart, or a SIGUSR2
+*/
+func (this *App_c) debugLogLevel (w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		req := logLevel_t{}
+		if err := json.NewDecoder (r.Body).Decode (&req); err != nil {
+			this.ErrorWithMsg (nil, w, http.StatusBadRequest, ApiErrorCode_parsingRequestBody, "Unable to parse the request body")
+			return
+		}
+		if err := this.SetLogLevel (req.Level); err != nil {
+			this.MissingParam (w, "Level should be one of debug, info, warn or error")
+			return
+		}
+	}
+
+	this.SuccessWithMsg (w, logLevel_t { Level: this.LogLevel.Level().String() })
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PUBLIC FUNCTIONS --------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief If we have a separate debug port configured, this starts a server listening on it
+	Otherwise the debug routes are on the main router, but only when there's a token to protect them
+	Without a token we only listen on localhost, so reaching it means being on the box or tunneling in
+*/
+func (this *App_c) ServeDebug () *http.Server {
+	if len(CFG.Debug.Port) == 0 { return nil }
+
+	mux := mux.NewRouter()
+	this.debugRoutes (mux)
+
+	addr := ":" + CFG.Debug.Port
+	if len(CFG.Debug.Token) == 0 { addr = "127.0.0.1" + addr }
+
+	srv := &http.Server { Addr: addr, Handler: mux }
+
+	go func() {
+		this.Log.Info ("Starting debug server", "addr", addr)
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			this.Log.Error ("debug server ListenAndServe", "error", err)
+		}
+	}()
+
+	return srv
+}
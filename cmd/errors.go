@@ -0,0 +1,144 @@
+/*! \file errors.go
+	\brief Our catalog of error codes, and writing errors out as problem+json (RFC 7807)
+	Every ApiErrorCode_ should have an entry here, the codes are stable so clients can switch on them
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- DEFINES -----------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+const (
+	ErrorFormat_legacy		= ""		// our original {"Error":{"Msg","Code"}} object
+	ErrorFormat_problem		= "problem"	// always application/problem+json
+
+	ContentType_problem		= "application/problem+json"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- TYPES -------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+//! A single entry in our error catalog
+type ErrorCode_t struct {
+	Code int
+	Name string			// stable identifier, this is what the problem type uri ends with
+	Title string		// short human readable summary, same for every occurrence
+	Description string	// when a client should expect to see it
+	Status int			// http status it's normally sent with
+}
+
+//! RFC 7807 problem details, with our own code, reference and field extensions
+type Problem_t struct {
+	Type		string	`json:"type"`
+	Title		string	`json:"title"`
+	Status		int		`json:"status"`
+	Detail		string	`json:"detail,omitempty"`
+	Instance	string	`json:"instance,omitempty"`
+	Code		int		`json:"code"`
+	Ref			string	`json:"ref,omitempty"`
+	Fields		interface{}	`json:"fields,omitempty"`
+}
+
+//! The registry, keyed by code
+var errorCodes = map[int]ErrorCode_t {}
+
+func init () {
+	for _, ec := range []ErrorCode_t {
+		{ ApiErrorCode_internal, "internal", "Internal error", "Something went wrong on our end, the response has a ref to give to support", http.StatusInternalServerError },
+		{ ApiErrorCode_passwordGuessing, "too_many_requests", "Too many requests", "Too many requests from this address in a short time", http.StatusTooManyRequests },
+		{ ApiErrorCode_parsingRequestBody, "invalid_body", "Invalid request body", "The request body couldn't be read into the expected object", http.StatusBadRequest },
+		{ ApiErrorCode_noIdentifiersForUser, "unauthorized", "Login required", "The bearer token is missing or isn't valid", http.StatusUnauthorized },
+		{ ApiErrorCode_permissions, "forbidden", "Forbidden", "The user doesn't have permission to do this", http.StatusForbidden },
+		{ ApiErrorCode_invalidInputField, "invalid_input", "Invalid input", "One or more values passed in are invalid, the detail or fields say which", http.StatusBadRequest },
+		{ ApiErrorCode_emailExistsAlready, "email_exists", "Email already exists", "Another user already has this email", http.StatusBadRequest },
+		{ ApiErrorCode_endpointDoesNotExist, "not_found", "Endpoint not found", "There's no endpoint at this path", http.StatusNotFound },
+		{ ApiErrorCode_jsonMarshal, "response_encoding", "Response encoding failed", "We couldn't encode the response", http.StatusInternalServerError },
+		{ ApiErrorCode_panicRecovery, "panic", "Internal error", "The request crashed on our end, the response has a ref to give to support", http.StatusInternalServerError },
+		{ ApiErrorCode_missingUser, "missing_user", "User not found", "The user for this request couldn't be found", http.StatusNotFound },
+		{ ApiErrorCode_dbError, "database", "Database error", "A database call failed", http.StatusInternalServerError },
+		{ ApiErrorCode_invalidUrlParam, "invalid_url_param", "Invalid url parameter", "A parameter in the path or query string is invalid", http.StatusBadRequest },
+		{ ApiErrorCode_thirdPartyRequest, "third_party", "Third party request failed", "A call to one of our providers failed", http.StatusBadGateway },
+		{ ApiErrorCode_missingFromContext, "missing_context", "Internal error", "Something we expected to have for this request was missing", http.StatusInternalServerError },
+		{ ApiErrorCode_bodyTooLarge, "body_too_large", "Request body too large", "The body is larger than this endpoint accepts", http.StatusRequestEntityTooLarge },
+		{ ApiErrorCode_unsupportedMediaType, "unsupported_media_type", "Unsupported content type", "This endpoint doesn't accept the Content-Type sent", http.StatusUnsupportedMediaType },
+		{ ApiErrorCode_requestTimeout, "timeout", "Request timed out", "The request took longer than this endpoint allows, it's safe to retry with an Idempotency-Key", http.StatusServiceUnavailable },
+		{ ApiErrorCode_idempotencyInFlight, "idempotency_in_flight", "Request in progress", "A request with this Idempotency-Key is still running, retry after it finishes", http.StatusConflict },
+		{ ApiErrorCode_idempotencyMismatch, "idempotency_mismatch", "Idempotency-Key reused", "This Idempotency-Key was already used for a different request", http.StatusUnprocessableEntity },
+		{ ApiErrorCode_maintenance, "maintenance", "Down for maintenance", "We're in maintenance mode, retry after the Retry-After header", http.StatusServiceUnavailable },
+	} {
+		RegisterErrorCode (ec)
+	}
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- LOCAL FUNCTIONS ---------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Looks up the code, falling back to something generic based on the status
+*/
+func errorCode (code, status int) ErrorCode_t {
+	if ec, ok := errorCodes[code]; ok { return ec }
+	return ErrorCode_t { Code: code, Name: "unknown", Title: http.StatusText (status), Status: status }
+}
+
+/*! \brief The uri for this error's entry in our catalog
+*/
+func problemType (ec ErrorCode_t) string {
+	return strings.TrimSuffix (CFG.ApiUrl.String(), "/") + "/errors#" + ec.Name
+}
+
+/*! \brief Checks if this response should be problem+json
+*/
+func wantsProblem (w http.ResponseWriter) bool {
+	if CFG.Errors.Format == ErrorFormat_problem { return true }
+	aw := findApiWriter (w)
+	return aw != nil && strings.Contains (aw.accept, ContentType_problem)
+}
+
+/*! \brief Converts our standard error object to problem+json
+*/
+func (this *App_c) problem (w http.ResponseWriter, httpStatus int, errT ApiError_t) Problem_t {
+	ec := errorCode (errT.Error.Code, httpStatus)
+	p := Problem_t { Type: problemType (ec), Title: ec.Title, Status: httpStatus, Code: errT.Error.Code, Ref: errT.Error.Ref }
+
+	if errT.Error.Msg != ec.Title { p.Detail = errT.Error.Msg }
+	if len(errT.Error.Fields) > 0 { p.Fields = errT.Error.Fields }
+	if aw := findApiWriter (w); aw != nil && aw.scope != nil { p.Instance = "urn:request:" + aw.scope.ID } // ties it back to our logs
+
+	return p
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PUBLIC FUNCTIONS --------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Adds an error code to our catalog, apps can use this for their own codes starting at ApiErrorCode_range
+*/
+func RegisterErrorCode (ec ErrorCode_t) {
+	errorCodes[ec.Code] = ec
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- ROUTES ------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Lists every error code we can return
+*/
+func (this *App_c) errorCatalog (w http.ResponseWriter, r *http.Request) {
+	out := make([]ErrorCode_t, 0, len(errorCodes))
+	for _, ec := range errorCodes { out = append (out, ec) }
+	sort.Slice (out, func (i, j int) bool { return out[i].Code < out[j].Code })
+
+	jOut, err := json.Marshal (out)
+	if err != nil { this.ServerError (err, ApiErrorCode_jsonMarshal, w); return }
+	w.Write (jOut)
+}
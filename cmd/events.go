@@ -0,0 +1,218 @@
+/*! \file events.go
+	\brief Server-sent events, so we can push things to logged in users
+	Events come in over redis pub/sub and get fanned out to whichever connections this instance has for the user
+*/
+
+package cmd
+
+import (
+	"github.com/NathanRThomas/boiler_api/pkg/models"
+	"github.com/NathanRThomas/boiler_api/pkg/models/redis"
+
+	"github.com/pkg/errors"
+
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- DEFINES -----------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+const (
+	defaultEventHeartbeat	= 15	// seconds between pings, keeps proxies from closing idle connections
+	eventBuffer				= 32	// events we'll hold for a slow connection before we drop it
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- TYPES -------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+//! Fans events out to the connections on this instance, keyed by user id
+type eventHub_c struct {
+	mtx		sync.RWMutex
+	subs	map[string]map[chan redis.Event_t]struct{}
+	closed	chan struct{}	// closed when we're shutting down, this ends every stream
+	stop	func() error
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- LOCAL FUNCTIONS ---------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+func (this *eventHub_c) add (userID string) chan redis.Event_t {
+	ch := make(chan redis.Event_t, eventBuffer)
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+	if this.subs[userID] == nil { this.subs[userID] = make(map[chan redis.Event_t]struct{}) }
+	this.subs[userID][ch] = struct{}{}
+	return ch
+}
+
+func (this *eventHub_c) remove (userID string, ch chan redis.Event_t) {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+	if _, ok := this.subs[userID][ch]; !ok { return } // already dropped
+	delete (this.subs[userID], ch)
+	if len(this.subs[userID]) == 0 { delete (this.subs, userID) }
+	close (ch)
+}
+
+/*! \brief Sends the event to every connection for the user
+	Connections that can't keep up get dropped, they'll reconnect and catch up with their Last-Event-ID
+*/
+func (this *eventHub_c) dispatch (event redis.Event_t) {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+	for ch := range this.subs[event.UserID] {
+		select {
+		case ch <- event:
+		default:
+			delete (this.subs[event.UserID], ch)
+			close (ch)
+		}
+	}
+	if len(this.subs[event.UserID]) == 0 { delete (this.subs, event.UserID) }
+}
+
+/*! \brief Redis stream ids are ms-seq, this returns true if a is after b
+*/
+func eventAfter (a, b string) bool {
+	if len(b) == 0 { return true }
+	aMs, aSeq, _ := strings.Cut (a, "-")
+	bMs, bSeq, _ := strings.Cut (b, "-")
+	am, _ := strconv.ParseUint (aMs, 10, 64)
+	bm, _ := strconv.ParseUint (bMs, 10, 64)
+	if am != bm { return am > bm }
+	as, _ := strconv.ParseUint (aSeq, 10, 64)
+	bs, _ := strconv.ParseUint (bSeq, 10, 64)
+	return as > bs
+}
+
+/*! \brief Writes a single event in the sse format
+*/
+func writeEvent (w http.ResponseWriter, event redis.Event_t) error {
+	_, err := fmt.Fprintf (w, "id: %s\nevent: %s\ndata: %s\n\n", event.ID, event.Type, event.Data)
+	return err
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PUBLIC FUNCTIONS --------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Sends an event to the user, from any instance of the api or task service
+*/
+func (this *App_c) PublishEvent (ctx context.Context, userID models.UUID, eventType string, data interface{}) error {
+	_, err := this.Redis.PublishEvent (ctx, userID.String(), eventType, data, CFG.Events.Replay, CFG.Events.ReplayTTL)
+	return err
+}
+
+/*! \brief Subscribes to the events in redis, this needs to be running for GET /events to work
+*/
+func (this *App_c) StartEvents () error {
+	hub := &eventHub_c { subs: make(map[string]map[chan redis.Event_t]struct{}), closed: make(chan struct{}) }
+
+	in := make(chan redis.Event_t, 100)
+	stop, err := this.Redis.SubscribeEvents (in)
+	if err != nil { return err }
+	hub.stop = stop
+
+	go func() {
+		for {
+			select {
+			case <-hub.closed:
+				return
+			case event := <-in:
+				hub.dispatch (event)
+			}
+		}
+	}()
+
+	this.events = hub
+	return nil
+}
+
+/*! \brief Ends every open stream and stops listening to redis, register this with the server's RegisterOnShutdown
+	Otherwise the server will wait on these connections forever
+*/
+func (this *App_c) StopEvents () {
+	if this.events == nil { return }
+	close (this.events.closed)
+	this.StackTrace (this.events.stop())
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- ROUTES ------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief GET /events, streams the logged in user's events
+	Make sure the route opts out of the timeout and compression, ie RouteOpts_t { Timeout: -1, NoCompress: true }
+*/
+func (this *App_c) EventStream (w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	user, ok := ctx.Value("user").(*models.User_t)
+	if !ok { this.ServerError (errors.WithStack (models.ErrType_userMissing), ApiErrorCode_missingFromContext, w); return }
+
+	if this.events == nil {
+		this.ErrorWithMsg (nil, w, http.StatusServiceUnavailable, ApiErrorCode_internal, "Events aren't available right now")
+		return
+	}
+
+	rc := http.NewResponseController (w)
+	userID := user.ID.String()
+
+	// subscribe before we replay, so we don't miss anything sent in between
+	ch := this.events.add (userID)
+	defer this.events.remove (userID, ch)
+
+	w.Header().Set ("Content-Type", "text/event-stream")
+	w.Header().Set ("Cache-Control", "no-cache")
+	w.Header().Set ("X-Accel-Buffering", "no")	// stops nginx from buffering us
+	w.WriteHeader (http.StatusOK)
+	fmt.Fprintf (w, "retry: 3000\n\n")
+
+	lastID := r.Header.Get ("Last-Event-ID")
+	if len(lastID) == 0 { lastID = r.URL.Query().Get ("lastEventId") } // EventSource can't set headers on the first connect
+
+	if len(lastID) > 0 {
+		events, err := this.Redis.EventsSince (ctx, userID, lastID)
+		if err != nil { this.StackTraceCtx (ctx, err) } // they'll just miss what they missed
+		for _, event := range events {
+			if writeEvent (w, event) != nil { return }
+			lastID = event.ID
+		}
+	}
+	if rc.Flush() != nil { return }
+
+	heartbeat := CFG.Events.Heartbeat
+	if heartbeat <= 0 { heartbeat = defaultEventHeartbeat }
+	ticker := time.NewTicker (time.Second * time.Duration (heartbeat))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done(): // they went away
+			return
+
+		case <-this.events.closed: // we're shutting down, they'll reconnect to another instance
+			return
+
+		case <-ticker.C:
+			if _, err := fmt.Fprintf (w, ": ping\n\n"); err != nil { return }
+			if rc.Flush() != nil { return }
+
+		case event, ok := <-ch:
+			if !ok { return } // we dropped them for being too slow
+			if !eventAfter (event.ID, lastID) { continue } // already sent this in the replay
+			if writeEvent (w, event) != nil { return }
+			if rc.Flush() != nil { return }
+			lastID = event.ID
+		}
+	}
+}
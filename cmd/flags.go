@@ -0,0 +1,215 @@
+/*! \file flags.go
+	\brief Feature flags for handlers and tasks, ie this.Flags.Enabled (ctx, "new_login")
+	Every flag is cached locally, a change to one is published through redis so every instance drops its copy right away
+*/
+
+package cmd
+
+import (
+	"github.com/NathanRThomas/boiler_api/pkg/models"
+	"github.com/NathanRThomas/boiler_api/pkg/models/cockroach"
+	"github.com/NathanRThomas/boiler_api/pkg/models/redis"
+
+	"github.com/gorilla/mux"
+	"github.com/patrickmn/go-cache"
+	"github.com/pkg/errors"
+
+	"context"
+	"database/sql"
+	"net/http"
+	"time"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- DEFINES -----------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+const (
+	flagsCacheKey	= "flags"
+	flagsCache		= time.Minute	// in case we miss a change message
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- TYPES -------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+//! The functions on this are safe to call on a nil object, every flag is just off
+type Flags_c struct {
+	db		cockroach.Flag_c
+	redis	*redis.DB_c
+	cache	*cache.Cache
+	app		*App_c
+	stop	func() error
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- LOCAL FUNCTIONS ---------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Every flag by its key, from our cache if we have them
+	If we can't load them every flag is off, we'd rather ship dark than break
+*/
+func (this *Flags_c) all (ctx context.Context) map[string]*models.Flag_t {
+	if data, found := this.cache.Get (flagsCacheKey); found { return data.(map[string]*models.Flag_t) }	// we're cached
+
+	list, err := this.db.List (ctx)
+	if err != nil {
+		this.app.StackTraceCtx (ctx, err)
+		return nil
+	}
+
+	out := make(map[string]*models.Flag_t, len(list))
+	for _, f := range list { out[f.Key.String()] = f }
+
+	this.cache.Set (flagsCacheKey, out, flagsCache)
+	return out
+}
+
+/*! \brief Drops our cached flags and tells every other instance to do the same
+*/
+func (this *Flags_c) changed (ctx context.Context, key string) {
+	this.cache.Delete (flagsCacheKey)
+	this.app.StackTraceCtx (ctx, this.redis.PublishFlagsChanged (ctx, key))
+}
+
+/*! \brief Who the flags are for, the logged in user and their org if the app puts one in the context
+*/
+func flagTarget (ctx context.Context) models.FlagTarget_t {
+	target := models.FlagTarget_t{}
+	if user, ok := ctx.Value("user").(*models.User_t); ok {
+		target.UserID = user.ID.String()
+		target.Email = user.Email.String()
+	}
+	if org, ok := ctx.Value("org").(string); ok { target.Org = org }
+	return target
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PUBLIC FUNCTIONS --------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief True if the flag is on for the user in the context
+*/
+func (this *Flags_c) Enabled (ctx context.Context, key string) bool {
+	return this.EnabledFor (ctx, key, flagTarget (ctx))
+}
+
+/*! \brief True if the flag is on for the target, for tasks and anywhere else the user isn't in the context
+*/
+func (this *Flags_c) EnabledFor (ctx context.Context, key string, target models.FlagTarget_t) bool {
+	if this == nil { return false }
+	flag, ok := this.all (ctx)[key]
+	return ok && flag.On (target)
+}
+
+/*! \brief The variant of the flag the user in the context gets, empty if it's off for them
+*/
+func (this *Flags_c) Variant (ctx context.Context, key string) string {
+	return this.VariantFor (ctx, key, flagTarget (ctx))
+}
+
+func (this *Flags_c) VariantFor (ctx context.Context, key string, target models.FlagTarget_t) string {
+	if this == nil { return "" }
+	flag, ok := this.all (ctx)[key]
+	if !ok { return "" }
+	return flag.Variant (target)
+}
+
+/*! \brief Every flag for the target, on/off flags are a bool and variant flags are the variant they get
+*/
+func (this *Flags_c) For (ctx context.Context, target models.FlagTarget_t) map[string]interface{} {
+	out := make(map[string]interface{})
+	if this == nil { return out }
+
+	for key, flag := range this.all (ctx) {
+		if len(flag.Variants) > 0 {
+			out[key] = flag.Variant (target)
+		} else {
+			out[key] = flag.On (target)
+		}
+	}
+	return out
+}
+
+/*! \brief Loads the flags and listens for changes to them from the other instances
+	If we can't listen we still work, changes just take up to a minute to show up
+*/
+func (this *App_c) StartFlags () {
+	this.Flags = &Flags_c { redis: this.Redis, cache: this.Cache, app: this }
+
+	stop, err := this.Redis.SubscribeFlagsChanged (func (key string) {
+		this.Cache.Delete (flagsCacheKey)
+		this.Log.Debug ("feature flag changed", "flag", key)
+	})
+	if err != nil {
+		this.Log.Warn ("flag changes unavailable", "error", err)
+		return
+	}
+	this.Flags.stop = stop
+}
+
+/*! \brief Stops listening for flag changes
+*/
+func (this *App_c) StopFlags (ctx context.Context) error {
+	if this.Flags == nil || this.Flags.stop == nil { return nil }
+	return this.Flags.stop()
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- ROUTES ------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief GET /user/flags, every flag for the logged in user
+*/
+func (this *App_c) UserFlags (w http.ResponseWriter, r *http.Request) {
+	this.SuccessWithMsg (w, this.Flags.For (r.Context(), flagTarget (r.Context())))
+}
+
+/*! \brief GET /admin/flags, every flag
+*/
+func (this *App_c) FlagList (w http.ResponseWriter, r *http.Request) {
+	if this.Flags == nil { this.SuccessWithMsg (w, []*models.Flag_t{}); return }
+	flags, err := this.Flags.db.List (r.Context())
+	this.Respond (err, w, flags)
+}
+
+/*! \brief GET /admin/flags/{key}
+*/
+func (this *App_c) FlagGet (w http.ResponseWriter, r *http.Request) {
+	if this.Flags == nil { this.Respond (sql.ErrNoRows, w, nil); return }
+	flag, err := this.Flags.db.Get (r.Context(), mux.Vars(r)["key"])
+	this.Respond (err, w, flag)
+}
+
+/*! \brief PUT /admin/flags/{key}, creates or replaces the flag
+*/
+func (this *App_c) FlagSave (w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if this.Flags == nil { this.ServerError (errors.New ("flags weren't started"), ApiErrorCode_missingFromContext, w); return }
+
+	flag := &models.Flag_t { Key: models.ApiString (mux.Vars(r)["key"]) }
+	if err := this.ParseFromBody (ctx, flag); err != nil { this.BodyError (w, err); return }
+	flag.Key = models.ApiString (mux.Vars(r)["key"]) // the path wins
+
+	err := this.Flags.db.Save (ctx, flag)
+	if err == nil {
+		this.Flags.changed (ctx, flag.Key.String())
+		this.Logger(ctx).Info ("feature flag saved", "flag", flag.Key, "enabled", flag.Enabled, "percent", flag.Percent)
+	}
+	this.Respond (err, w, flag)
+}
+
+/*! \brief DELETE /admin/flags/{key}, the flag is off for everyone after this
+*/
+func (this *App_c) FlagDelete (w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if this.Flags == nil { this.ServerError (errors.New ("flags weren't started"), ApiErrorCode_missingFromContext, w); return }
+
+	key := mux.Vars(r)["key"]
+	err := this.Flags.db.Delete (ctx, key)
+	if err == nil {
+		this.Flags.changed (ctx, key)
+		this.Logger(ctx).Info ("feature flag deleted", "flag", key)
+	}
+	this.Respond (err, w, nil)
+}
@@ -0,0 +1,260 @@
+/*! \file grpc.go
+	\brief Shared setup for running a grpc server next to our http one
+	Messages are our same json objects, so there's no protobuf generation step, clients call with the "json" content-subtype
+*/
+
+package cmd
+
+import (
+	"github.com/NathanRThomas/boiler_api/pkg/models"
+	"github.com/NathanRThomas/boiler_api/pkg/models/redis"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net"
+	"runtime/debug"
+	"strconv"
+	"time"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- TYPES -------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+//! Lets grpc send our json objects as-is
+type jsonCodec_t struct {}
+
+func (jsonCodec_t) Name () string { return "json" }
+func (jsonCodec_t) Marshal (v interface{}) ([]byte, error) { return json.Marshal (v) }
+func (jsonCodec_t) Unmarshal (data []byte, v interface{}) error { return json.Unmarshal (data, v) }
+
+//! Checks the authorization metadata for a call, returning the user to put in the context
+type GrpcAuth_f func (ctx context.Context, authorization string) (*models.User_t, error)
+
+func init () {
+	encoding.RegisterCodec (jsonCodec_t{})
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- LOCAL FUNCTIONS ---------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Recovers from panics in the handler the same way recoverPanic does for http
+*/
+func (this *App_c) grpcRecover (ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			this.Logger(ctx).Error ("panic recovered", "panic", p, "stack", string(debug.Stack()))
+			err = status.Error (codes.Internal, "Internal error")
+		}
+	}()
+	return handler (ctx, req)
+}
+
+/*! \brief Gives the call a log scope, records the metrics and logs when it's done, like requestLog and metrics do for http
+*/
+func (this *App_c) grpcLog (ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	id := ""
+	if md, ok := metadata.FromIncomingContext (ctx); ok && len(md.Get ("x-request-id")) > 0 { id = md.Get ("x-request-id")[0] }
+	if len(id) == 0 || len(id) > maxRequestIDLen { id = newRequestID() }
+
+	scope := newLogScope (id, this.Log.With ("request_id", id, "rpc", info.FullMethod))
+	ctx = context.WithValue (ctx, "logScope", scope)
+	grpc.SetHeader (ctx, metadata.Pairs ("x-request-id", id))
+
+	startTime := time.Now()
+	resp, err := handler (ctx, req)
+	code := status.Code (err)
+
+	this.Metrics.Rpc (info.FullMethod, code.String(), time.Since (startTime))
+	scope.Logger().Debug ("rpc complete", "code", code.String(), "duration", time.Since (startTime))
+	return resp, err
+}
+
+/*! \brief Cancels the call once it's run longer than the request timeout in the config
+*/
+func (this *App_c) grpcTimeout (ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	timeout := time.Second * ContextTimeout
+	if CFG.Timeout.Request > 0 { timeout = time.Second * time.Duration (CFG.Timeout.Request) }
+
+	ctx, cancel := context.WithTimeout (ctx, timeout)
+	defer cancel()
+	return handler (ctx, req)
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PUBLIC FUNCTIONS --------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Converts one of our errors into a grpc status, logging anything that's our fault
+	Server errors get the same reference treatment as ServerError so they can be found in the logs
+*/
+func (this *App_c) GrpcError (ctx context.Context, err error) error {
+	if err == nil { return nil }
+	if _, ok := err.(interface { GRPCStatus() *status.Status }); ok { return err } // already a status
+
+	if fields, ok := errors.Cause (err).(*models.FieldErrors_t); ok { return status.Error (codes.InvalidArgument, fields.Error()) }
+
+	switch errors.Cause (err) {
+	case models.ErrType_returnToUser:
+		return status.Error (codes.InvalidArgument, err.Error())
+	case models.ErrType_noIdentifiers:
+		return status.Error (codes.Unauthenticated, "Please login")
+	case models.ErrType_permission:
+		return status.Error (codes.PermissionDenied, "You don't have access to this")
+	case sql.ErrNoRows:
+		return status.Error (codes.NotFound, "Not found")
+	case context.DeadlineExceeded:
+		return status.Error (codes.DeadlineExceeded, "Request timed out")
+	}
+
+	ref := newRequestID()
+	this.logError (this.Logger(ctx).With ("error_ref", ref), err)
+	return status.Errorf (codes.Internal, "Something went wrong on our end, please contact support with reference %s", ref)
+}
+
+/*! \brief True when the caller presented a client cert signed by our ClientCA, the grpc version of RequireClientCert
+*/
+func GrpcClientCert (ctx context.Context) bool {
+	p, ok := peer.FromContext (ctx)
+	if !ok { return false }
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	return ok && len(info.State.VerifiedChains) > 0
+}
+
+/*! \brief Authenticates every call except the ones listed as public, putting the user in the context like bearerCheck does
+*/
+func (this *App_c) GrpcAuth (auth GrpcAuth_f, public ...string) grpc.UnaryServerInterceptor {
+	open := make(map[string]bool)
+	for _, p := range public { open[p] = true }
+
+	return func (ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if open[info.FullMethod] { return handler (ctx, req) }
+
+		authorization := ""
+		if md, ok := metadata.FromIncomingContext (ctx); ok && len(md.Get ("authorization")) > 0 { authorization = md.Get ("authorization")[0] }
+
+		user, err := auth (ctx, authorization)
+		switch errors.Cause (err) {
+		case nil:
+		case models.ErrType_noIdentifiers, sql.ErrNoRows:
+			return nil, status.Error (codes.Unauthenticated, "Please login")
+		default:
+			return nil, this.GrpcError (ctx, err)
+		}
+
+		ctx = context.WithValue (ctx, "user", user)
+		this.LogWith (ctx, "user_id", user.ID)
+		return handler (ctx, req)
+	}
+}
+
+/*! \brief The grpc version of Ddos, limits the listed methods by the caller's ip, ie Login so passwords can't be guessed
+*/
+func (this *App_c) GrpcDdos (methods ...string) grpc.UnaryServerInterceptor {
+	limited := make(map[string]bool)
+	for _, m := range methods { limited[m] = true }
+
+	return func (ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if !limited[info.FullMethod] { return handler (ctx, req) }
+
+		p, ok := peer.FromContext (ctx)
+		if !ok || p.Addr == nil {
+			this.Logger(ctx).Info ("rpc had no remote address")
+			return handler (ctx, req)
+		}
+
+		remote := p.Addr.String()
+		if host, _, err := net.SplitHostPort (remote); err == nil { remote = host }	// a connection can carry many calls, so the port tells us nothing
+
+		if this.ddosBlocked (ctx, remote) { return nil, status.Error (codes.ResourceExhausted, "You're just guessing") }
+		return handler (ctx, req)
+	}
+}
+
+/*! \brief The grpc version of maintenance mode, put it after GrpcAuth so admins get through
+	The listed methods only read, so they're still allowed in read-only mode
+*/
+func (this *App_c) GrpcMaintenance (readOnly ...string) grpc.UnaryServerInterceptor {
+	reads := make(map[string]bool)
+	for _, m := range readOnly { reads[m] = true }
+
+	return func (ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		m := this.maintenanceMode (ctx)
+
+		switch {
+		case m.Mode == redis.Maintenance_off,
+			m.Mode == redis.Maintenance_readOnly && reads[info.FullMethod]:
+			return handler (ctx, req)
+		}
+
+		if user, ok := ctx.Value("user").(*models.User_t); ok && IsAdmin (user) { return handler (ctx, req) }
+
+		msg, retry := maintenanceMsg (m)
+		grpc.SetHeader (ctx, metadata.Pairs ("retry-after", strconv.Itoa (retry)))
+		return nil, status.Error (codes.Unavailable, msg)
+	}
+}
+
+/*! \brief Creates our grpc server with the same recovery, logging, metrics and tracing our http chain has
+	Any extra interceptors, ie GrpcAuth, run after ours. Call StartTLS first if we're serving over tls
+*/
+func (this *App_c) NewGrpcServer (interceptors ...grpc.UnaryServerInterceptor) *grpc.Server {
+	chain := append ([]grpc.UnaryServerInterceptor { this.grpcLog, this.grpcRecover, this.grpcTimeout }, interceptors...)
+
+	opts := []grpc.ServerOption {
+		grpc.StatsHandler (otelgrpc.NewServerHandler()),
+		grpc.ChainUnaryInterceptor (chain...),
+	}
+	if this.tlsConfig != nil { opts = append (opts, grpc.Creds (credentials.NewTLS (this.tlsConfig.Clone()))) } // same certs, and client certs, as https
+
+	return grpc.NewServer (opts...)
+}
+
+/*! \brief Starts listening on the grpc port from the config, does nothing if there isn't one
+*/
+func (this *App_c) ServeGrpc (srv *grpc.Server) error {
+	if len(CFG.Grpc.Port) == 0 || srv == nil { return nil }
+
+	lis, err := net.Listen ("tcp", ":" + CFG.Grpc.Port)
+	if err != nil { return errors.WithStack (err) }
+
+	go func() {
+		this.Log.Info ("Starting grpc server", "port", CFG.Grpc.Port)
+		if err := srv.Serve (lis); err != nil && err != grpc.ErrServerStopped {
+			this.Log.Error ("grpc server Serve", "error", err)
+		}
+	}()
+	return nil
+}
+
+/*! \brief Lets any calls in progress finish until the context is done, then stops the server
+*/
+func (this *App_c) StopGrpc (ctx context.Context, srv *grpc.Server) error {
+	if srv == nil { return nil }
+
+	done := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close (done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		this.Log.Warn ("grpc calls still running at shutdown, stopping them")
+		srv.Stop()
+	}
+	return nil
+}
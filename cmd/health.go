@@ -0,0 +1,269 @@
+/*! \file health.go
+	\brief Health checks for our kubernetes probes
+	Each dependency registers a check, critical ones failing mean we're down, anything else just means we're degraded
+	Only checks of our own state, ie heartbeats, count for the live probe, a database outage shouldn't get every instance restarted
+*/
+
+package cmd
+
+import (
+	"github.com/NathanRThomas/boiler_api/pkg/models/cockroach"
+	"github.com/NathanRThomas/boiler_api/pkg/toolz"
+
+	"github.com/pkg/errors"
+
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- DEFINES -----------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+const (
+	Health_ok		= "ok"
+	Health_degraded	= "degraded"	// a non-critical check failed, we can still do our job
+	Health_fail		= "fail"
+)
+
+const (
+	defaultHealthTimeout	= time.Second * 3
+	defaultHealthCache		= time.Second * 5	// probes come in often, this keeps us from pinging everything on every one
+	queSaturation			= 0.9	// how full the task que can get before we call it unhealthy
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- TYPES -------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+//! Returns an error if the thing being checked isn't healthy, it should give up when the context does
+type HealthCheck_f func (ctx context.Context) error
+
+//! A single check, zero for the timeout and cache uses our defaults
+type HealthCheck_t struct {
+	Name string
+	Check HealthCheck_f
+	Critical bool	// if this fails we're down, otherwise we're just degraded
+	Liveness bool	// only looks at our own state, so it's safe for the live probe to restart us over it
+	Timeout, Cache time.Duration
+}
+
+//! The outcome of a single check
+type HealthResult_t struct {
+	Name, Status string
+	Critical bool
+	Error string `json:",omitempty"`
+	Duration string
+	Checked time.Time
+}
+
+//! What the probes return
+type HealthReport_t struct {
+	Status, Version string
+	Checks []HealthResult_t `json:",omitempty"`
+}
+
+type healthCheck_t struct {
+	HealthCheck_t
+	mtx		sync.Mutex	// only one of us runs the check at a time, the rest wait for the result
+	last	HealthResult_t
+}
+
+type health_c struct {
+	mtx			sync.RWMutex
+	checks		[]*healthCheck_t
+	heartbeats	map[string]time.Time
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- LOCAL FUNCTIONS ---------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Runs the check if our last result is too old, otherwise hands back the last one
+*/
+func (this *healthCheck_t) run (ctx context.Context) HealthResult_t {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	if !this.last.Checked.IsZero() && time.Since (this.last.Checked) < this.Cache { return this.last }
+
+	ctx, cancel := context.WithTimeout (context.WithoutCancel (ctx), this.Timeout) // other probes get this result too, so it can't end with this request
+	defer cancel()
+
+	startTime := time.Now()
+	err := this.Check (ctx)
+
+	this.last = HealthResult_t { Name: this.Name, Status: Health_ok, Critical: this.Critical, Checked: startTime, Duration: time.Since (startTime).String() }
+	if err != nil {
+		this.last.Status = Health_fail
+		this.last.Error = err.Error()
+	}
+	return this.last
+}
+
+/*! \brief Runs every check the filter keeps at once, so the slowest one sets how long this takes
+*/
+func (this *health_c) run (ctx context.Context, filter func (*HealthCheck_t) bool) HealthReport_t {
+	this.mtx.RLock()
+	checks := make([]*healthCheck_t, 0, len(this.checks))
+	for _, c := range this.checks {
+		if filter (&c.HealthCheck_t) { checks = append (checks, c) }
+	}
+	this.mtx.RUnlock()
+
+	report := HealthReport_t { Status: Health_ok, Version: API_ver, Checks: make([]HealthResult_t, len(checks)) }
+
+	wg := new(sync.WaitGroup)
+	for i, c := range checks {
+		wg.Add(1)
+		go func (i int, c *healthCheck_t) {
+			defer wg.Done()
+			report.Checks[i] = c.run (ctx)
+		}(i, c)
+	}
+	wg.Wait()
+
+	for _, res := range report.Checks {
+		if res.Status == Health_ok { continue }
+		if res.Critical {
+			report.Status = Health_fail
+		} else if report.Status == Health_ok {
+			report.Status = Health_degraded
+		}
+	}
+	return report
+}
+
+/*! \brief Writes out the report, only a failure is a 503 so a degraded instance stays in service
+*/
+func (this *App_c) writeHealth (w http.ResponseWriter, report HealthReport_t) {
+	jOut, err := json.Marshal (report)
+	if err != nil { this.StackTrace (errors.WithStack (err)) }
+
+	w.Header().Set ("Content-Type", ContentType_json)
+	w.Header().Set ("Cache-Control", "no-store")
+	if report.Status == Health_fail { w.WriteHeader (http.StatusServiceUnavailable) }
+	w.Write (jOut)
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PUBLIC FUNCTIONS --------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Sets up our health checks with the ones every service needs, cockroach, redis, the task que and any providers we're configured for
+	Call this before registering any checks of your own
+*/
+func (this *App_c) StartHealth () {
+	this.health = &health_c { heartbeats: make(map[string]time.Time) }
+
+	this.RegisterHealthCheck (HealthCheck_t { Name: "cockroach", Critical: true, Check: cockroach.Ping })
+
+	// we can run without redis, so this only degrades us
+	this.RegisterHealthCheck (HealthCheck_t { Name: "redis", Check: func (ctx context.Context) error {
+		return this.Redis.Ping (ctx)
+	}})
+
+	this.RegisterHealthCheck (HealthCheck_t { Name: "task_que", Check: func (ctx context.Context) error {
+		stats := this.queStats (ctx)
+		if stats.Capacity > 0 && float64(stats.Length) >= float64(stats.Capacity) * queSaturation {
+			return errors.Errorf ("task que is at %d of %d", stats.Length, stats.Capacity)
+		}
+		return nil
+	}})
+
+	// providers, these don't change much so there's no need to check them often
+	if len(CFG.Slack.Token) > 0 {
+		this.RegisterHealthCheck (HealthCheck_t { Name: "slack", Cache: time.Minute, Check: func (ctx context.Context) error {
+			return toolz.Reachable (ctx, toolz.SlackHealthUrl)
+		}})
+	}
+	if len(CFG.Mailgun.Key) > 0 {
+		this.RegisterHealthCheck (HealthCheck_t { Name: "mailgun", Cache: time.Minute, Check: func (ctx context.Context) error {
+			return toolz.Reachable (ctx, toolz.MailgunHealthUrl)
+		}})
+	}
+}
+
+/*! \brief Adds a check to our probes, checks with the same name replace the old one
+*/
+func (this *App_c) RegisterHealthCheck (check HealthCheck_t) {
+	if this.health == nil { return } // StartHealth wasn't called
+	if check.Timeout <= 0 { check.Timeout = defaultHealthTimeout }
+	if check.Cache <= 0 { check.Cache = defaultHealthCache }
+
+	this.health.mtx.Lock()
+	defer this.health.mtx.Unlock()
+
+	for i, c := range this.health.checks {
+		if c.Name == check.Name {
+			this.health.checks[i] = &healthCheck_t { HealthCheck_t: check }
+			return
+		}
+	}
+	this.health.checks = append (this.health.checks, &healthCheck_t { HealthCheck_t: check })
+}
+
+/*! \brief Records that a background loop is still going, pair this with HeartbeatCheck
+*/
+func (this *App_c) Heartbeat (name string) {
+	if this.health == nil { return }
+	this.health.mtx.Lock()
+	defer this.health.mtx.Unlock()
+	this.health.heartbeats[name] = time.Now()
+}
+
+/*! \brief Fails if Heartbeat hasn't been called for the name within maxAge, ie for the queen
+	Register it with Liveness set, a loop that's stuck is something a restart fixes
+*/
+func (this *App_c) HeartbeatCheck (name string, maxAge time.Duration) HealthCheck_f {
+	return func (ctx context.Context) error {
+		this.health.mtx.RLock()
+		last, ok := this.health.heartbeats[name]
+		this.health.mtx.RUnlock()
+
+		if !ok { return errors.Errorf ("no heartbeat from %s yet", name) }
+		if time.Since (last) > maxAge { return errors.Errorf ("last heartbeat from %s was %s ago", name, time.Since (last).Round (time.Second)) }
+		return nil
+	}
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- ROUTES ------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief GET /status/startup, fails until we've finished starting and our critical checks pass
+*/
+func (this *App_c) startupStatus (w http.ResponseWriter, r *http.Request) {
+	if this.health == nil || this.Life == nil || this.Life.State() == State_starting {
+		this.writeHealth (w, HealthReport_t { Status: Health_fail, Version: API_ver })
+		return
+	}
+	this.writeHealth (w, this.health.run (r.Context(), func (c *HealthCheck_t) bool { return c.Critical }))
+}
+
+/*! \brief GET /status/ready, every check with its detail. Fails once we're shutting down, or if a critical check does,
+	so we're taken out of the load balancer until our dependencies are back
+*/
+func (this *App_c) readyStatus (w http.ResponseWriter, r *http.Request) {
+	if this.Life == nil || this.Life.State() != State_running {
+		this.writeHealth (w, HealthReport_t { Status: Health_fail, Version: API_ver })
+		return
+	}
+	if this.health == nil { this.writeHealth (w, HealthReport_t { Status: Health_ok, Version: API_ver }); return }
+	this.writeHealth (w, this.health.run (r.Context(), func (c *HealthCheck_t) bool { return true }))
+}
+
+/*! \brief GET /status/live, only our own state, failing this gets us restarted
+	Dependencies are left to the ready probe, restarting us won't bring cockroach back
+*/
+func (this *App_c) liveStatus (w http.ResponseWriter, r *http.Request) {
+	if this.Life != nil && this.Life.State() == State_stopped {
+		this.writeHealth (w, HealthReport_t { Status: Health_fail, Version: API_ver })
+		return
+	}
+	if this.health == nil { this.writeHealth (w, HealthReport_t { Status: Health_ok, Version: API_ver }); return }
+	this.writeHealth (w, this.health.run (r.Context(), func (c *HealthCheck_t) bool { return c.Liveness }))
+}
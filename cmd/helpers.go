@@ -11,11 +11,8 @@ import (
 
 	"fmt"
 	"net/http"
-	"context"
 	"encoding/json"
 	"database/sql"
-	"math/rand"
-	"time"
 )
 
   //-------------------------------------------------------------------------------------------------------------------------//
@@ -28,6 +25,8 @@ type ApiError_t struct {
 	Error struct {
 		Msg       string
 		Code      int
+		Fields	  []models.FieldError_t `json:",omitempty"`	// when the problem was with specific fields they're listed here
+		Ref		  string `json:",omitempty"`	// for server errors, this matches the error_ref in our logs
 	}
 }
 
@@ -35,37 +34,56 @@ type ApiError_t struct {
  //----- HANDLERS ----------------------------------------------------------------------------------------------------------//
 //-------------------------------------------------------------------------------------------------------------------------//
 
-func (this *App_c) RandError () string {
-	terms := [...]string {"There was an issue with the monkies", "Houston we have a problem", "The gerbil stopped running",
-		"Looks like the Fatherboard is burned out", "There's a loose wire between the mouse and keyboard", "That really didn't work",
-		"If at first you don't succeed... give up, this is a deterministic system", "The monkies are out of their cages",
-		"I can't tell for sure but I'm pretty sure this is your fault", "I think there's a gas leak", "Russia is hacking us", 
-		"North Korea is attacking", "We're being hacked by China" }
-
-	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
-	n := rnd.Intn(len(terms) - 1)
-	return terms[n]
+/*! \brief Handles an error returned from ParseFromBody
+	If it was specific fields that were wrong we list them for the user
+*/
+func (this *App_c) BodyError (w http.ResponseWriter, err error) {
+	if fields, ok := errors.Cause(err).(*models.FieldErrors_t); ok {
+		this.FieldErrors (w, fields)
+		return
+	}
+	if errors.Cause(err) == models.ErrType_bodyTooLarge { // streaming routes only find out once they've read too much
+		this.ErrorWithMsg (nil, w, http.StatusRequestEntityTooLarge, ApiErrorCode_bodyTooLarge, "Request body is too large")
+		return
+	}
+	this.ErrorWithMsg (err, w, http.StatusBadRequest, ApiErrorCode_parsingRequestBody, "")
 }
 
-/*! \brief Handles pulling in data from our body into whatever object we need to read it into
+/*! \brief Returns our standard error object with a list of the fields that had problems
 */
-func (this *App_c) ParseFromBody (ctx context.Context, out interface{}) error {
-	if body, ok := ctx.Value("body").([]byte); ok && len(body) > 0 { 
-		return errors.WithStack (json.Unmarshal (body, out))
-	}
-	return nil
+func (this *App_c) FieldErrors (w http.ResponseWriter, fields *models.FieldErrors_t) {
+	errT := ApiError_t {}
+	errT.Error.Msg = "One or more fields are invalid"
+	errT.Error.Code = ApiErrorCode_invalidInputField
+	errT.Error.Fields = fields.Fields
+
+	this.writeError (w, http.StatusBadRequest, errT)
 }
 
-// The serverError helper writes an error message and stack trace to the errorLog,
+// The serverError helper writes an error message and stack trace to the request logger,
 // then sends a generic 500 Internal Server Error response to the user.
+// The response has a reference that matches the logged error, so support can find it
 func (this *App_c) ServerError (err error, code int, w http.ResponseWriter) {
-	this.ErrorWithMsg (err, w, http.StatusInternalServerError, code, this.RandError())
+	ref := newRequestID()
+	logger := this.writerLogger (w).With ("error_ref", ref)
+	if err != nil {
+		this.logError (logger, err)
+	} else {
+		logger.Error ("server error", "code", code)
+	}
+
+	errT := ApiError_t {}
+	errT.Error.Msg = fmt.Sprintf("Something went wrong on our end, please contact support with reference %s", ref)
+	errT.Error.Code = code
+	errT.Error.Ref = ref
+	this.writeError (w, http.StatusInternalServerError, errT)
 }
 
 /*! \brief Handles a "successful" api call
-	Commits the transaction log, and writs out our response to the user
+	Commits the transaction log, and writs out our response to the user, in the format for their version of the api
 */
 func (this *App_c) SuccessWithMsg (w http.ResponseWriter, in interface{}) {
+	if aw := findApiWriter (w); aw != nil { in = aw.version.transform (in) } // older versions may want this to look different
 	if in == nil { w.Write([]byte("{}")); return } // we're done
 
 	jOut, err := json.Marshal (in)
@@ -80,7 +98,7 @@ func (this *App_c) SuccessWithMsg (w http.ResponseWriter, in interface{}) {
 /*! \brief Main error handling function, doesn't do anything with the transaction, but handles the error response object
 */
 func (this *App_c) ErrorWithMsg (err error, w http.ResponseWriter, httpStatus, code int, msg string, params ...interface{}) {
-	if err != nil { this.StackTrace (err) }  // record this
+	if err != nil { this.logError (this.writerLogger (w), err) }  // record this
 
 	final := fmt.Sprintf(msg, params...)
 	if len(final) == 0 { final = http.StatusText(httpStatus) }	// default to the text version of the status code
@@ -88,10 +106,31 @@ func (this *App_c) ErrorWithMsg (err error, w http.ResponseWriter, httpStatus, c
 	errT := ApiError_t {}
 	errT.Error.Msg = final 
 	errT.Error.Code = code
-	jOut, err := json.Marshal (errT)	// always use this object for errors
-	if err != nil { this.StackTrace (err) }  // record this
+	this.writeError (w, httpStatus, errT)
+}
 
-	http.Error (w, string(jOut), httpStatus)	// now give the requester some info
+/*! \brief Writes out our error object, always use this object for errors
+	This is problem+json if the config says so or the client asked for it
+*/
+func (this *App_c) writeError (w http.ResponseWriter, httpStatus int, errT ApiError_t) {
+	var jOut []byte
+	var err error
+	contentType := ContentType_json
+
+	if wantsProblem (w) {
+		contentType = ContentType_problem
+		jOut, err = json.Marshal (this.problem (w, httpStatus, errT))
+	} else {
+		jOut, err = json.Marshal (errT)
+	}
+	if err != nil { this.logError (this.writerLogger (w), err) }  // record this
+
+	// now give the requester some info
+	w.Header().Del ("Content-Length")
+	w.Header().Set ("Content-Type", contentType)
+	w.Header().Set ("X-Content-Type-Options", "nosniff")
+	w.WriteHeader (httpStatus)
+	w.Write (jOut)
 }
 
 /*! \brief I seemed to be calling this a lot, so i put a wrapper around missing/bad url and query params
@@ -107,6 +146,11 @@ func (this *App_c) Forbidden (w http.ResponseWriter, msg string, params ...inter
 /*! \brief When we had an issue that may have been caused by user input, this decides which error should be returned to the user
 */
 func (this *App_c) Respond (err error, w http.ResponseWriter, success interface{}) {
+	if fields, ok := errors.Cause(err).(*models.FieldErrors_t); ok {
+		this.FieldErrors (w, fields)
+		return
+	}
+
 	switch errors.Cause(err) {
 	case models.ErrType_returnToUser:
 		this.ErrorWithMsg (nil, w, http.StatusBadRequest, ApiErrorCode_invalidInputField, err.Error())
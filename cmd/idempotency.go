@@ -0,0 +1,174 @@
+/*! \file idempotency.go
+	\brief Idempotency-Key support for our mutating routes
+	Mobile clients retry on flaky networks, so the first request's response is saved in redis and replayed for any retries
+*/
+
+package cmd
+
+import (
+	"github.com/NathanRThomas/boiler_api/pkg/models/redis"
+
+	"github.com/pkg/errors"
+
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- DEFINES -----------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+const (
+	defaultIdempotentTTL	= 24 * 60 * 60	// seconds we hold onto the response for retries
+	maxIdempotentKeyLen		= 255
+)
+
+//! Headers we save with the response, everything else is specific to the request
+var idempotentHeaders = []string { "Content-Type", "Location", "Last-Modified" }
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- TYPES -------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+//! Copies the response as it's written so we can save it once the handler is done
+type idemWriter_t struct {
+	http.ResponseWriter
+	status	int
+	buf		bytes.Buffer
+}
+
+func (this *idemWriter_t) WriteHeader (status int) {
+	if this.status == 0 { this.status = status }
+	this.ResponseWriter.WriteHeader (status)
+}
+
+func (this *idemWriter_t) Write (b []byte) (int, error) {
+	if this.status == 0 { this.status = http.StatusOK }
+	this.buf.Write (b)
+	return this.ResponseWriter.Write (b)
+}
+
+func (this *idemWriter_t) Unwrap () http.ResponseWriter {
+	return this.ResponseWriter
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- LOCAL FUNCTIONS ---------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Hashes the parts of the request that have to match for it to be the "same" request
+*/
+func idempotentFingerprint (r *http.Request) string {
+	h := sha256.New()
+	h.Write ([]byte(r.Method + " " + r.URL.Path + "?" + r.URL.RawQuery + "\n"))
+
+	if body, ok := r.Context().Value("body").([]byte); ok {
+		h.Write (body)
+	} else if form, ok := r.Context().Value("form").(url.Values); ok {
+		h.Write ([]byte(form.Encode())) // this sorts by key, so the order they sent it in doesn't matter
+	}
+	return hex.EncodeToString (h.Sum (nil))
+}
+
+/*! \brief Keys are scoped to whoever sent them, so two users can't collide or read each other's responses
+*/
+func idempotentKey (r *http.Request, key string) string {
+	sum := sha256.Sum256 ([]byte(r.Header.Get ("Authorization") + "\n" + r.Method + " " + r.URL.Path + "\n" + key))
+	return hex.EncodeToString (sum[:])
+}
+
+/*! \brief Sends back the response we saved from the first request
+*/
+func replayIdempotent (w http.ResponseWriter, rec *redis.Idempotent_t) {
+	for k, v := range rec.Header { w.Header()[k] = v }
+	w.Header().Set ("Idempotent-Replayed", "true")
+	w.WriteHeader (rec.Status)
+	w.Write (rec.Body)
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- LOCAL MIDDLEWARE --------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Honors the Idempotency-Key header on POST, PUT, PATCH and DELETE
+	Retries get the saved response, a 409 if the first one is still running, or a 422 if the body changed
+*/
+func (this *App_c) idempotency (next http.Handler) http.Handler {
+	return http.HandlerFunc (func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get ("Idempotency-Key")
+		switch r.Method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		default:
+			key = "" // reads are already safe to retry
+		}
+
+		if len(key) == 0 || this.Redis == nil {
+			next.ServeHTTP (w, r)
+			return
+		}
+
+		if len(key) > maxIdempotentKeyLen {
+			this.MissingParam (w, "Idempotency-Key can't be longer than %d characters", maxIdempotentKeyLen)
+			return
+		}
+
+		ctx := context.WithoutCancel (r.Context()) // we still need to save the response if the request times out
+		rKey := idempotentKey (r, key)
+		fingerprint := idempotentFingerprint (r)
+
+		ttl := CFG.Idempotency.TTL
+		if ttl <= 0 { ttl = defaultIdempotentTTL }
+
+		lockTTL := int(this.routeTimeout (r).Seconds()) * 2 // if we die while running, this is how long until the key is usable again
+		if lockTTL <= 0 { lockTTL = ContextTimeout * 2 }
+
+		existing, err := this.Redis.IdempotentStart (ctx, rKey, fingerprint, lockTTL)
+		if err != nil { // don't fail the request just because redis is having a bad day
+			this.Logger(ctx).Warn ("idempotency key check failed, running without it", "error", err.Error())
+			next.ServeHTTP (w, r)
+			return
+		}
+
+		if existing != nil {
+			switch {
+			case existing.Fingerprint != fingerprint:
+				this.ErrorWithMsg (nil, w, http.StatusUnprocessableEntity, ApiErrorCode_idempotencyMismatch, "Idempotency-Key was already used for a different request")
+			case !existing.Done:
+				w.Header().Set ("Retry-After", "1")
+				this.ErrorWithMsg (nil, w, http.StatusConflict, ApiErrorCode_idempotencyInFlight, "A request with this Idempotency-Key is still in progress")
+			default:
+				replayIdempotent (w, existing)
+			}
+			return
+		}
+
+		defer func() {
+			if p := recover(); p != nil { // free the key up before recoverPanic deals with this
+				this.Redis.IdempotentRelease (ctx, rKey)
+				panic (p)
+			}
+		}()
+
+		iw := &idemWriter_t { ResponseWriter: w }
+		next.ServeHTTP (iw, r)
+
+		if iw.status == 0 { iw.status = http.StatusOK }
+		if iw.status >= http.StatusInternalServerError {
+			this.Redis.IdempotentRelease (ctx, rKey) // this failed on our end, so let the retry actually run
+			return
+		}
+
+		rec := &redis.Idempotent_t { Fingerprint: fingerprint, Status: iw.status, Body: iw.buf.Bytes(), Header: make(map[string][]string) }
+		for _, k := range idempotentHeaders {
+			if v := w.Header().Values (k); len(v) > 0 { rec.Header[k] = v }
+		}
+
+		if !this.Redis.IdempotentFinish (ctx, rKey, rec, ttl) {
+			this.StackTraceCtx (ctx, errors.Errorf ("saving idempotent response for key %s", key))
+		}
+	})
+}
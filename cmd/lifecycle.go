@@ -0,0 +1,275 @@
+/*! \file lifecycle.go
+	\brief Starting and stopping everything in the right order
+	Components register hooks in a phase, starts go from the first phase to the last and stops go back the other way.
+	The whole shutdown has a deadline, anything still going when it hits gets logged and we exit anyway
+*/
+
+package cmd
+
+import (
+	"github.com/pkg/errors"
+
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- DEFINES -----------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+//! Phases, in the order they start. They stop in the reverse order
+const (
+	Phase_telemetry		= iota	// tracing, metrics and debugging, so we can see everything else start and stop
+	Phase_connections			// databases
+	Phase_workers				// task que, queen, event streams
+	Phase_servers				// anything taking requests
+)
+
+var phaseNames = map[int]string { Phase_telemetry: "telemetry", Phase_connections: "connections", Phase_workers: "workers", Phase_servers: "servers" }
+
+const (
+	State_starting	int32 = iota
+	State_running
+	State_stopping	// we're draining, the ready probe fails from here on
+	State_stopped
+)
+
+const (
+	defaultShutdownTimeout	= 30	// seconds for the whole shutdown
+	defaultShutdownDrain	= 5		// seconds to wait for the load balancer to take us out before we stop anything
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- TYPES -------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+//! Starts or stops a single component, stops should return once the context is done
+type Hook_f func (ctx context.Context) error
+
+type lifeHook_t struct {
+	name		string
+	phase		int
+	start, stop	Hook_f
+}
+
+type Lifecycle_c struct {
+	log			*slog.Logger
+	state		atomic.Int32
+	mtx			sync.Mutex
+	hooks		[]*lifeHook_t
+	stopping	chan error	// something asked us to stop, nil for a normal shutdown
+	stopOnce	sync.Once
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- LOCAL FUNCTIONS ---------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+func phaseName (phase int) string {
+	if name, ok := phaseNames[phase]; ok { return name }
+	return "custom"
+}
+
+/*! \brief Our hooks sorted into their phases, in the order they start
+*/
+func (this *Lifecycle_c) phases () [][]*lifeHook_t {
+	this.mtx.Lock()
+	hooks := append ([]*lifeHook_t{}, this.hooks...)
+	this.mtx.Unlock()
+
+	sort.SliceStable (hooks, func (i, j int) bool { return hooks[i].phase < hooks[j].phase })
+
+	out := make([][]*lifeHook_t, 0)
+	for i, h := range hooks {
+		if i == 0 || h.phase != hooks[i-1].phase {
+			out = append (out, []*lifeHook_t { h })
+		} else {
+			out[len(out)-1] = append (out[len(out)-1], h)
+		}
+	}
+	return out
+}
+
+/*! \brief Runs the start hooks a phase at a time, in the order they were added
+*/
+func (this *Lifecycle_c) start (ctx context.Context) error {
+	for _, phase := range this.phases() {
+		for _, h := range phase {
+			if h.start == nil { continue }
+			if err := h.start (ctx); err != nil { return errors.Wrapf (err, "starting %s", h.name) }
+		}
+	}
+	return nil
+}
+
+/*! \brief Runs the stop hooks a phase at a time, last phase first. The hooks in a phase stop together
+	If we hit the deadline we log what's still running, and what never got a chance to stop, then give up
+*/
+func (this *Lifecycle_c) stop (ctx context.Context) error {
+	phases := this.phases()
+
+	for i := len(phases) -1; i >= 0; i-- {
+		phase := phases[i]
+
+		var mtx sync.Mutex
+		pending := make(map[string]bool)
+		done := make(chan struct{})
+		wg := new(sync.WaitGroup)
+
+		for _, h := range phase {
+			if h.stop == nil { continue }
+			pending[h.name] = true
+			wg.Add(1)
+
+			go func (h *lifeHook_t) {
+				defer wg.Done()
+				startTime := time.Now()
+				if err := h.stop (ctx); err != nil {
+					this.log.Error ("stopping", "component", h.name, "error", err)
+				} else {
+					this.log.Debug ("stopped", "component", h.name, "duration", time.Since (startTime))
+				}
+
+				mtx.Lock()
+				delete (pending, h.name)
+				mtx.Unlock()
+			}(h)
+		}
+
+		go func() {
+			wg.Wait()
+			close (done)
+		}()
+
+		select {
+		case <-done:
+		case <-ctx.Done():
+			mtx.Lock()
+			still := make([]string, 0, len(pending))
+			for name := range pending { still = append (still, name) }
+			mtx.Unlock()
+
+			skipped := make([]string, 0)
+			for _, p := range phases[:i] {
+				for _, h := range p {
+					if h.stop != nil { skipped = append (skipped, h.name) }
+				}
+			}
+
+			this.log.Warn ("shutdown deadline hit", "phase", phaseName (phase[0].phase), "pending", still, "skipped", skipped)
+			return errors.WithStack (ctx.Err())
+		}
+	}
+	return nil
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PUBLIC FUNCTIONS --------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+func NewLifecycle (log *slog.Logger) *Lifecycle_c {
+	return &Lifecycle_c { log: log, stopping: make(chan error, 1) }
+}
+
+/*! \brief Adds a component to start when we Run
+*/
+func (this *Lifecycle_c) OnStart (name string, phase int, fn Hook_f) {
+	this.Register (name, phase, fn, nil)
+}
+
+/*! \brief Adds a component to stop when we shutdown
+*/
+func (this *Lifecycle_c) OnStop (name string, phase int, fn Hook_f) {
+	this.Register (name, phase, nil, fn)
+}
+
+/*! \brief Adds a component with both hooks, either can be nil
+*/
+func (this *Lifecycle_c) Register (name string, phase int, start, stop Hook_f) {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+	this.hooks = append (this.hooks, &lifeHook_t { name: name, phase: phase, start: start, stop: stop })
+}
+
+/*! \brief Listens on the server when we start, and lets the requests in progress finish when we stop
+	If the server dies on its own, ie the port is taken, we shut everything down
+*/
+func (this *Lifecycle_c) Serve (name string, phase int, srv *http.Server) {
+	this.Register (name, phase, func (ctx context.Context) error {
+		go func() {
+			this.log.Info ("Starting server", "server", name, "addr", srv.Addr, "tls", srv.TLSConfig != nil)
+			if err := ListenAndServe (srv); err != http.ErrServerClosed {
+				this.Stop (errors.Wrap (err, name))
+			}
+		}()
+		return nil
+	}, srv.Shutdown)
+}
+
+func (this *Lifecycle_c) State () int32 {
+	return this.state.Load()
+}
+
+/*! \brief True until we start shutting down, background loops should stop once this is false
+*/
+func (this *Lifecycle_c) Running () bool {
+	return this.state.Load() < State_stopping
+}
+
+/*! \brief Starts the shutdown, pass in an error if it's because something failed
+*/
+func (this *Lifecycle_c) Stop (err error) {
+	this.stopOnce.Do (func() { this.stopping <- err })
+}
+
+/*! \brief Starts everything, waits for a signal or a Stop, and then shuts it all down
+	Returns whatever error stopped us, or the shutdown hitting its deadline
+*/
+func (this *Lifecycle_c) Run () error {
+	sigs := []os.Signal { os.Interrupt, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT }
+	if len(CFG.TLS.Cert) == 0 { sigs = append (sigs, syscall.SIGHUP) } // when we're serving https a SIGHUP reloads the certificate instead
+
+	c := make(chan os.Signal, 1)
+	signal.Notify (c, sigs...)
+	defer signal.Stop (c)
+
+	go func() {	//listen for kill messages
+		sig, ok := <-c
+		if ok { this.log.Info ("shutdown signal", "signal", sig.String()) }
+		this.Stop (nil)
+	}()
+
+	err := this.start (context.Background())
+	if err == nil {
+		this.state.Store (State_running)
+		err = <-this.stopping
+	}
+
+	timeout := CFG.Shutdown.Timeout
+	if timeout <= 0 { timeout = defaultShutdownTimeout }
+	ctx, cancel := context.WithTimeout (context.Background(), time.Second * time.Duration (timeout))
+	defer cancel()
+
+	// stops the queen/workers background tasks, and the ready probe starts failing so we're taken out of the load balancer
+	this.state.Store (State_stopping)
+	if err != nil { this.log.Error ("shutting down", "error", err) }
+
+	drain := CFG.Shutdown.Drain
+	if drain <= 0 { drain = defaultShutdownDrain }
+	select {
+	case <-time.After (time.Second * time.Duration (drain)):
+	case <-ctx.Done():
+	}
+
+	if stopErr := this.stop (ctx); err == nil { err = stopErr }
+	this.state.Store (State_stopped)
+	return err
+}
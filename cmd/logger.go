@@ -0,0 +1,281 @@
+/*! \file logger.go
+	\brief Structured, leveled logging shared by the api and task services
+	Everything goes out as json or logfmt so our log aggregators can parse it
+*/
+
+package cmd
+
+import (
+	"github.com/NathanRThomas/boiler_api/pkg/models"
+
+	"github.com/pkg/errors"
+
+	"fmt"
+	"os"
+	"strings"
+	"context"
+	"net/http"
+	"log/slog"
+	"crypto/rand"
+	"encoding/hex"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- DEFINES -----------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+const (
+	LogFormat_json		= "json"
+	LogFormat_logfmt	= "logfmt"
+)
+
+const maxRequestIDLen	= 64 // we'll take a request id from the caller, but only if it's reasonable
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- TYPES -------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+//! Follows a single request or task through our code so every log line gets the same contextual fields
+type logScope_t struct {
+	ID string
+	log atomic.Pointer[slog.Logger]	// a handler we stopped waiting on can still be adding fields while we log the request, so it's swapped rather than written
+}
+
+//! Wraps the response writer so our error handlers can find the logger for the request
+type apiWriter_t struct {
+	http.ResponseWriter
+	scope *logScope_t
+	status int
+	version *Version_c	// set when it came in through a versioned route
+	accept string	// the Accept header, so our errors can be written in the format they asked for
+}
+
+func newLogScope (id string, log *slog.Logger) *logScope_t {
+	ret := &logScope_t { ID: id }
+	ret.log.Store (log)
+	return ret
+}
+
+func (this *logScope_t) Logger () *slog.Logger {
+	return this.log.Load()
+}
+
+/*! \brief Adds fields to the scope's logger, retrying if someone else added theirs at the same time so neither is lost
+*/
+func (this *logScope_t) With (args ...interface{}) {
+	for {
+		old := this.log.Load()
+		if this.log.CompareAndSwap (old, old.With (args...)) { return }
+	}
+}
+
+func (this *apiWriter_t) WriteHeader (status int) {
+	if this.status == 0 { this.status = status }
+	this.ResponseWriter.WriteHeader (status)
+}
+
+func (this *apiWriter_t) Write (b []byte) (int, error) {
+	if this.status == 0 { this.status = http.StatusOK }
+	return this.ResponseWriter.Write (b)
+}
+
+func (this *apiWriter_t) Flush () {
+	if f, ok := this.ResponseWriter.(http.Flusher); ok { f.Flush() }
+}
+
+func (this *apiWriter_t) Unwrap () http.ResponseWriter {
+	return this.ResponseWriter
+}
+
+/*! \brief Returns the status code we sent, defaults to a 200 if nothing was written
+*/
+func (this *apiWriter_t) Status () int {
+	if this.status == 0 { return http.StatusOK }
+	return this.status
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- LOCAL FUNCTIONS ---------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Pulls the pkg/errors stack trace out of an error so it can be logged as a single field
+*/
+func errStack (err error) (out []string) {
+	if err, ok := err.(stackTracer); ok {
+		for _, f := range err.StackTrace() {
+			out = append (out, fmt.Sprintf("%+s:%d", f, f))
+		}
+	}
+	return
+}
+
+/*! \brief Generates a random id we can use to tie log lines together
+*/
+func newRequestID () string {
+	b := make([]byte, 8)
+	rand.Read (b)
+	return hex.EncodeToString (b)
+}
+
+/*! \brief Walks down any wrapped response writers looking for our own
+*/
+func findApiWriter (w http.ResponseWriter) *apiWriter_t {
+	for w != nil {
+		switch t := w.(type) {
+		case *apiWriter_t:
+			return t
+		case interface { Unwrap() http.ResponseWriter }:
+			w = t.Unwrap()
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+/*! \brief Records the error along with its stack trace to the logger passed in
+*/
+func (this *App_c) logError (logger *slog.Logger, err error) {
+	if err == nil { return }
+
+	if errors.Cause (err) == models.ErrType_nonFatal {
+		logger.Warn (err.Error())
+	} else {
+		logger.Error (err.Error(), "stack", errStack (err))
+	}
+
+	if CFG.LocalRun { os.Exit (1) } // bail after an error for local testing
+}
+
+/*! \brief Returns the logger associated with this response writer, or our default one
+*/
+func (this *App_c) writerLogger (w http.ResponseWriter) *slog.Logger {
+	if aw := findApiWriter (w); aw != nil && aw.scope != nil { return aw.scope.Logger() }
+	return this.Log
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- MIDDLEWARE --------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Attaches a request id and a logger to the request so everything downstream logs with the same fields
+*/
+func (this *App_c) requestLog (next http.Handler) http.Handler {
+	return http.HandlerFunc (func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get ("X-Request-ID")
+		if len(id) == 0 || len(id) > maxRequestIDLen { id = newRequestID() }
+
+		scope := newLogScope (id, this.Log.With ("request_id", id, "route", routeTemplate (r), "method", r.Method))
+		aw := &apiWriter_t { ResponseWriter: w, scope: scope, accept: r.Header.Get ("Accept") }
+		if v, ok := r.Context().Value("apiVersion").(*Version_c); ok {
+			aw.version = v
+			scope.With ("api_version", v.Name)
+		}
+		aw.Header().Set ("X-Request-ID", id)
+
+		startTime := time.Now()
+		next.ServeHTTP (aw, r.WithContext (context.WithValue (r.Context(), "logScope", scope)))
+
+		scope.Logger().Debug ("request complete", "status", aw.Status(), "duration", time.Since (startTime))
+	})
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PUBLIC FUNCTIONS --------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Returns the logger with all the fields for this request or task, or our default one if there isn't one
+*/
+func (this *App_c) Logger (ctx context.Context) *slog.Logger {
+	if scope, ok := ctx.Value("logScope").(*logScope_t); ok { return scope.Logger() }
+	return this.Log
+}
+
+/*! \brief Adds more fields to the logger for this request/task, ie once we know who the user is
+*/
+func (this *App_c) LogWith (ctx context.Context, args ...interface{}) {
+	if scope, ok := ctx.Value("logScope").(*logScope_t); ok { scope.With (args...) }
+}
+
+/*! \brief Creates a new logging scope for a background task
+*/
+func (this *App_c) LogScope (ctx context.Context, args ...interface{}) context.Context {
+	id := newRequestID()
+	return context.WithValue (ctx, "logScope", newLogScope (id, this.Log.With (append ([]interface{}{"task_id", id}, args...)...)))
+}
+
+/*! \brief Same as StackTrace but uses the logger from the context so we get the request/task fields
+*/
+func (this *App_c) StackTraceCtx (ctx context.Context, err error) {
+	this.logError (this.Logger (ctx), err)
+}
+
+/*! \brief Changes the level we're logging at, this can be done while we're running
+*/
+func (this *App_c) SetLogLevel (level string) error {
+	lvl, err := ParseLogLevel (level)
+	if err != nil { return err }
+
+	this.LogLevel.Set (lvl)
+	this.Log.Info ("log level changed", "level", lvl.String())
+	return nil
+}
+
+/*! \brief Flips us into debug logging on a SIGUSR1 and back to our configured level on a SIGUSR2
+*/
+func (this *App_c) MonitorLogLevel () {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1, syscall.SIGUSR2)
+
+	go func() {
+		for sig := range c {
+			level := CFG.Log.Level
+			if sig == syscall.SIGUSR1 { level = "debug" }
+			this.StackTrace (this.SetLogLevel (level))
+		}
+	}()
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- FUNCTIONS ---------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Converts the string version of a level, debug, info, warn, error, into the slog version
+*/
+func ParseLogLevel (level string) (lvl slog.Level, err error) {
+	if len(level) == 0 { return slog.LevelInfo, nil } // default to info
+	err = errors.Wrap (lvl.UnmarshalText ([]byte(strings.TrimSpace (level))), level)
+	return
+}
+
+/*! \brief Creates our logger based on the format and level set in the config
+	The level var is returned so it can be changed at runtime
+*/
+func CreateLogger () (*slog.Logger, *slog.LevelVar, error) {
+	level := new(slog.LevelVar)
+	lvl, err := ParseLogLevel (CFG.Log.Level)
+	if err != nil { return nil, nil, err }
+	level.Set (lvl)
+
+	opts := &slog.HandlerOptions { Level: level }
+
+	switch strings.ToLower (CFG.Log.Format) {
+	case LogFormat_json, "":
+		return slog.New (slog.NewJSONHandler (os.Stdout, opts)), level, nil
+	case LogFormat_logfmt:
+		return slog.New (slog.NewTextHandler (os.Stdout, opts)), level, nil
+	default:
+		return nil, nil, errors.Errorf ("unknown log format '%s', expecting %s or %s", CFG.Log.Format, LogFormat_json, LogFormat_logfmt)
+	}
+}
+
+/*! \brief Logs the error and exits, for use during startup
+*/
+func LogFatal (logger *slog.Logger, msg string, err error) {
+	logger.Error (msg, "error", err, "stack", errStack (err))
+	os.Exit (1)
+}
@@ -12,22 +12,19 @@ package cmd
 	"github.com/NathanRThomas/boiler_api/pkg/toolz"
 	
 	"github.com/pkg/errors"
+	"github.com/gorilla/mux"
 	"github.com/mediocregopher/radix/v3"
 	"github.com/patrickmn/go-cache"
-	"github.com/prometheus/client_golang/prometheus"
 	
 	"fmt"
 	"os"
+	"crypto/tls"
 	"encoding/json"
 	"database/sql"
 	_ "github.com/lib/pq"
-	"time"
-	"context"
-	"net/http"
-	"os/signal"
-	"syscall"
-	"log"
+	"log/slog"
 	"sync"
+	"context"
  )
 
   //-------------------------------------------------------------------------------------------------------------------------//
@@ -39,6 +36,7 @@ const API_ver = "0.1.0" // major version for all related builds
 // global config object
 var CFG struct {
 	Port string
+	TLS TLSConfig_t
 	ApiUrl, WebsiteUrl models.ApiString
 	ProductionLevel models.ProductionLevel
 	Version, LocalRun bool
@@ -52,6 +50,70 @@ var CFG struct {
 	}
 	Slack toolz.SlackConfig_t
 	Mailgun toolz.MailgunConfig_t
+	Twilio toolz.TwilioConfig_t
+	Log struct {
+		Format, Level string	// json or logfmt, and debug, info, warn, error
+	}
+	Grpc struct {
+		Port string		// leave empty to not run the grpc server
+	}
+	Metrics struct {
+		Port string		// leave empty to serve /metrics on the main router
+	}
+	Admin struct {
+		Users []string	// ids of the users that can use the admin endpoints, and get through maintenance mode
+	}
+	Debug struct {
+		Token string	// required to reach /debug on the main router, leave empty to turn it off there
+		Port string		// serves /debug on its own port instead, only on localhost unless there's a Token
+	}
+	Body struct {
+		MaxBytes int64	// largest request body we'll read, routes can override this
+	}
+	Errors struct {
+		Format string	// "problem" to always send application/problem+json, otherwise only when it's in the Accept header
+	}
+	Compress struct {
+		MinBytes int	// responses smaller than this aren't compressed
+	}
+	Events struct {
+		Heartbeat int	// seconds between pings on open streams
+		Replay, ReplayTTL int	// events we keep per user for reconnects, and how many seconds we keep them
+	}
+	Idempotency struct {
+		TTL int		// seconds we keep responses around for retries, defaults to a day
+	}
+	Versions map[string]struct {
+		Deprecated, Sunset string	// RFC3339 or YYYY-MM-DD, leave empty while it's still current
+		Link string		// where to read about moving off of it
+	}
+	Timeout struct {
+		Request int		// seconds a request can run before we give up on it, routes can override this
+	}
+	OpenApi struct {
+		Validate bool	// checks request bodies against the schema for the object they're read into
+	}
+	Shutdown struct {
+		Timeout int		// seconds we give everything to stop before we exit anyway
+		Drain int		// seconds we wait after failing the ready probe, so we're out of the load balancer before we stop
+	}
+	Tasks struct {
+		Backend string		// "redis" to share the que between instances, otherwise it's in memory
+		Visibility int		// seconds a worker has a task before it's given to someone else, defaults to 100
+		MaxPayload int		// largest payload in bytes we'll queue, defaults to 64KB
+	}
+	Webhooks struct {
+		MaxAttempts int		// attempts at a delivery before we give up on it
+		DisableAfter int	// failed attempts in a row before we turn the webhook off
+		Timeout int			// seconds we wait on their server
+		Batch int			// deliveries the task service picks up at once
+		AllowPrivate bool	// lets webhooks go over http and to private addresses, only for local development
+	}
+	Tracing struct {
+		Exporter, Endpoint string	// otlp or stdout, leave empty to turn tracing off
+		Insecure bool
+		SampleRatio float64		// 0 - 1, defaults to everything
+	}
 }
 
   //-------------------------------------------------------------------------------------------------------------------------//
@@ -64,31 +126,41 @@ type stackTracer interface {
 
 //----- HANDLER
 type App_c struct {
-	InfoLog, ErrorLog  *log.Logger
-	Running bool
+	Log			*slog.Logger
+	LogLevel	*slog.LevelVar
+	Life		*Lifecycle_c
 	WG *sync.WaitGroup
 
-	ApiRequests *prometheus.CounterVec 
+	Metrics		*Metrics_c
+
+	router		*mux.Router
+	routeOpts	map[*mux.Route]*RouteOpts_t
+	versions	map[string]*Version_c
+	tlsConfig	*tls.Config
+	events		*eventHub_c
+	health		*health_c
 	Redis 		*redis.DB_c
 	Cache 		*cache.Cache
-	TaskQue chan *models.Que_t
+	TaskQue		TaskQue_i
 
 	Users		cockroach.User_c
+	Webhooks	cockroach.Webhook_c
+	Providers	cockroach.Provider_c
+	Flags		*Flags_c
+
+	Authenticate func (ctx context.Context, authorization string) (*models.User_t, error)	// logs in a user from the Authorization header, for checks before the app's own auth runs
+}
+
+/*! \brief True until we start shutting down, background loops should stop once this is false
+*/
+func (this *App_c) Running () bool {
+	return this.Life != nil && this.Life.Running()
 }
 
 /*! \brief Pulls out the stack trace error info
 */
 func (this *App_c) StackTrace (err error) {
-	if err == nil { return }
-	this.ErrorLog.Println(err) 
-
-	if err, ok := err.(stackTracer); ok {
-		for _, f := range err.StackTrace() {
-			fmt.Printf("%+s:%d\n", f, f)
-		}
-	}
-
-	if CFG.LocalRun { os.Exit (1) } // bail after an error for local testing
+	this.logError (this.Log, err)
 }
 
 /*! \brief Wrapper around stacktrace so we don't have to create the error each time
@@ -118,17 +190,11 @@ func ParseConfig () error {
 	}
 
 	// validate anything else
+	toolz.WebhookAllowPrivate = CFG.Webhooks.AllowPrivate
 	
 	return nil
 }
 
-func CreateLoggers () (errorLog, infoLog *log.Logger) {
-	errorLog = log.New(os.Stderr, "ERROR\t", log.LstdFlags | log.Lmicroseconds | log.Llongfile | log.LUTC)	// error log handler
-	infoLog = log.New(os.Stdout, "INFO\t", log.LstdFlags | log.Lmicroseconds)	// for info level messages
-	if errorLog == nil || infoLog == nil { log.Panic ("unable to create loggers") }
-	return
-}
-
 func ConnectCockroach (ip string, port int, database, user string) (*sql.DB, error) {
     sslmode := "sslmode=disable"
     if CFG.ProductionLevel == models.ProductionLevel_Production {
@@ -148,18 +214,3 @@ func ConnectCockroach (ip string, port int, database, user string) (*sql.DB, err
 func ConnectRedis (ip string, port int) (*radix.Pool, error) {
 	return radix.NewPool("tcp", fmt.Sprintf("%s:%d", ip, port), redis.MaxPoolSize)
 }
-
-/*! \brief Handles marking the server as shutting down based on a cancel call
-*/
-func MonitorSignals (running *bool, srv *http.Server) {
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
-
-	go func() {	//listen for kill messages
-		<-c
-		*running = false 	//stops the queen/workers background tasks.  This also stops health checks so this looks unhealthy now
-		time.Sleep(time.Second * 5)	//sleep here, this is needed for this to be taken out of the load balancer before stopping to handle requests
-		srv.Shutdown (context.Background())  //shutsdown the http server
-	}()
-}
-
@@ -0,0 +1,140 @@
+/*! \file maintenance.go
+	\brief Maintenance mode, for putting the whole api into read-only or turning it off during migrations
+	The flag lives in redis so it's cluster-wide, each instance only checks it every few seconds
+*/
+
+package cmd
+
+import (
+	"github.com/NathanRThomas/boiler_api/pkg/models/redis"
+
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- DEFINES -----------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+const (
+	maintenanceCacheKey		= "maintenance"
+	maintenanceCache		= time.Second * 5	// how long it can take an instance to notice a change
+	defaultRetryAfter		= 300	// seconds
+	defaultMaintenanceMsg	= "We're down for maintenance, please try again shortly"
+	readOnlyMsg				= "We're in read-only mode for maintenance, please try again shortly"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- LOCAL FUNCTIONS ---------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Returns the current maintenance setting, from our local cache if we checked recently
+	If we can't reach redis we assume we're not in maintenance, better than taking everything down with it
+*/
+func (this *App_c) maintenanceMode (ctx context.Context) *redis.Maintenance_t {
+	if data, found := this.Cache.Get (maintenanceCacheKey); found { return data.(*redis.Maintenance_t) }	// we're cached
+
+	m, err := this.Redis.GetMaintenance (ctx)
+	if err != nil {
+		this.StackTraceCtx (ctx, err)
+		m = &redis.Maintenance_t {}
+	}
+
+	this.Cache.Set (maintenanceCacheKey, m, maintenanceCache)
+	return m
+}
+
+/*! \brief What we tell callers while we're in maintenance, and how many seconds until they should try again
+*/
+func maintenanceMsg (m *redis.Maintenance_t) (string, int) {
+	retry := m.RetryAfter
+	if retry <= 0 { retry = defaultRetryAfter }
+
+	msg := m.Message
+	if len(msg) == 0 {
+		msg = defaultMaintenanceMsg
+		if m.Mode == redis.Maintenance_readOnly { msg = readOnlyMsg }
+	}
+	return msg, retry
+}
+
+/*! \brief Admins get through maintenance, since they're usually the ones doing it
+	The user isn't in the context yet at this point, so we log them in ourselves
+*/
+func (this *App_c) maintenanceBypass (r *http.Request) bool {
+	if this.Authenticate == nil || len(r.Header.Get ("Authorization")) == 0 { return false }
+
+	user, err := this.Authenticate (r.Context(), r.Header.Get ("Authorization"))
+	return err == nil && IsAdmin (user)
+}
+
+/*! \brief Turns away requests while we're in maintenance, with a 503 and a Retry-After
+	Read-only lets the GETs through, full blocks everything
+*/
+func (this *App_c) maintenance (next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m := this.maintenanceMode (r.Context())
+
+		switch m.Mode {
+		case redis.Maintenance_off:
+			next.ServeHTTP(w, r)
+			return
+		case redis.Maintenance_readOnly:
+			if r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		if this.maintenanceBypass (r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		msg, retry := maintenanceMsg (m)
+		w.Header().Set ("Retry-After", strconv.Itoa (retry))
+		this.ErrorWithMsg (nil, w, http.StatusServiceUnavailable, ApiErrorCode_maintenance, "%s", msg)
+	})
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- ROUTES ------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief GET /admin/maintenance, the current setting, the Mode is empty when we're not in maintenance
+*/
+func (this *App_c) MaintenanceGet (w http.ResponseWriter, r *http.Request) {
+	m, err := this.Redis.GetMaintenance (r.Context())
+	this.Respond (err, w, m)
+}
+
+/*! \brief PUT /admin/maintenance, turns on maintenance mode for every instance
+*/
+func (this *App_c) MaintenanceSet (w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	m := &redis.Maintenance_t {}
+	if err := this.ParseFromBody (ctx, m); err != nil { this.BodyError (w, err); return }
+
+	err := this.Redis.SetMaintenance (ctx, m)
+	if err == nil {
+		this.Cache.Delete (maintenanceCacheKey) // we see it right away, the other instances within a few seconds
+		this.Logger(ctx).Warn ("maintenance mode on", "mode", m.Mode)
+	}
+	this.Respond (err, w, m)
+}
+
+/*! \brief DELETE /admin/maintenance, takes us out of maintenance mode
+*/
+func (this *App_c) MaintenanceClear (w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	err := this.Redis.ClearMaintenance (ctx)
+	if err == nil {
+		this.Cache.Delete (maintenanceCacheKey)
+		this.Logger(ctx).Warn ("maintenance mode off")
+	}
+	this.Respond (err, w, nil)
+}
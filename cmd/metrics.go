@@ -0,0 +1,239 @@
+/*! \file metrics.go
+	\brief Prometheus metrics for both services
+	Each app gets its own registry, so creating the routes more than once doesn't panic on a duplicate register
+*/
+
+package cmd
+
+import (
+	"github.com/NathanRThomas/boiler_api/pkg/models"
+	"github.com/NathanRThomas/boiler_api/pkg/models/cockroach"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- TYPES -------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+//! Holds all our collectors, the functions on this are safe to call on a nil object, they just don't do anything
+type Metrics_c struct {
+	registry	*prometheus.Registry
+
+	requests	*prometheus.CounterVec
+	latency		*prometheus.HistogramVec
+	timeouts	*prometheus.CounterVec
+	rpcs		*prometheus.HistogramVec
+	queries		*prometheus.HistogramVec
+	cache		*prometheus.CounterVec
+	tasks		*prometheus.HistogramVec
+	queen		*prometheus.HistogramVec
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- LOCAL FUNCTIONS ---------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+func newMetrics () *Metrics_c {
+	this := &Metrics_c {
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec (prometheus.CounterOpts {
+			Name: "api_requests_total",
+			Help: "How many requests processed, partitioned by route template, method and status code.",
+		}, []string{"route", "method", "code"}),
+		latency: prometheus.NewHistogramVec (prometheus.HistogramOpts {
+			Name: "api_request_duration_seconds",
+			Help: "How long requests took to complete, partitioned by route template, method and status code.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"route", "method", "code"}),
+		timeouts: prometheus.NewCounterVec (prometheus.CounterOpts {
+			Name: "api_request_timeouts_total",
+			Help: "How many requests hit their timeout, partitioned by route template and method.",
+		}, []string{"route", "method"}),
+		rpcs: prometheus.NewHistogramVec (prometheus.HistogramOpts {
+			Name: "grpc_request_duration_seconds",
+			Help: "How long grpc calls took to complete, partitioned by method and status code.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method", "code"}),
+		queries: prometheus.NewHistogramVec (prometheus.HistogramOpts {
+			Name: "cockroach_query_duration_seconds",
+			Help: "How long cockroach queries took, partitioned by query and result.",
+			Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+		}, []string{"query", "result"}),
+		cache: prometheus.NewCounterVec (prometheus.CounterOpts {
+			Name: "redis_commands_total",
+			Help: "Redis commands issued, partitioned by command and result (hit, miss, ok, error).",
+		}, []string{"command", "result"}),
+		tasks: prometheus.NewHistogramVec (prometheus.HistogramOpts {
+			Name: "task_duration_seconds",
+			Help: "How long background tasks took, partitioned by task type and outcome.",
+			Buckets: []float64{.01, .05, .1, .5, 1, 5, 10, 30, 60},
+		}, []string{"type", "outcome"}),
+		queen: prometheus.NewHistogramVec (prometheus.HistogramOpts {
+			Name: "queen_duration_seconds",
+			Help: "How long each of the queen's functions took per loop.",
+			Buckets: []float64{.01, .05, .1, .5, 1, 5, 10, 30, 60},
+		}, []string{"func"}),
+	}
+
+	this.registry.MustRegister (this.requests, this.latency, this.timeouts, this.rpcs, this.queries, this.cache, this.tasks, this.queen,
+		collectors.NewGoCollector(), collectors.NewProcessCollector (collectors.ProcessCollectorOpts{}))
+
+	return this
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PUBLIC FUNCTIONS --------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Records a single http request
+*/
+func (this *Metrics_c) Request (route, method string, status int, dur time.Duration) {
+	if this == nil { return }
+	code := fmt.Sprintf("%d", status)
+	this.requests.WithLabelValues (route, method, code).Inc()
+	this.latency.WithLabelValues (route, method, code).Observe (dur.Seconds())
+}
+
+/*! \brief Records a request that ran past its timeout
+*/
+func (this *Metrics_c) Timeout (route, method string) {
+	if this == nil { return }
+	this.timeouts.WithLabelValues (route, method).Inc()
+}
+
+/*! \brief Records a single grpc call
+*/
+func (this *Metrics_c) Rpc (method, code string, dur time.Duration) {
+	if this == nil { return }
+	this.rpcs.WithLabelValues (method, code).Observe (dur.Seconds())
+}
+
+/*! \brief Records a single cockroach query, this is what we hand to the cockroach package as its observer
+*/
+func (this *Metrics_c) Query (query string, dur time.Duration, err error) {
+	if this == nil { return }
+	result := "ok"
+	if err == sql.ErrNoRows {
+		result = "no_rows"
+	} else if err != nil {
+		result = "error"
+	}
+	this.queries.WithLabelValues (query, result).Observe (dur.Seconds())
+}
+
+/*! \brief Records a single redis command, this is what we hand to our redis object as its observer
+*/
+func (this *Metrics_c) Cache (command, result string) {
+	if this == nil { return }
+	this.cache.WithLabelValues (command, result).Inc()
+}
+
+/*! \brief Records how a background task went
+*/
+func (this *Metrics_c) Task (taskType models.QueTask, outcome string, dur time.Duration) {
+	if this == nil { return }
+	this.tasks.WithLabelValues (fmt.Sprintf("%d", taskType), outcome).Observe (dur.Seconds())
+}
+
+/*! \brief Records how long one of the queen's functions took
+*/
+func (this *Metrics_c) Queen (name string, dur time.Duration) {
+	if this == nil { return }
+	this.queen.WithLabelValues (name).Observe (dur.Seconds())
+}
+
+/*! \brief Adds more collectors to our registry, for things specific to a single service
+*/
+func (this *Metrics_c) Register (cs ...prometheus.Collector) error {
+	if this == nil { return nil }
+	for _, c := range cs {
+		if err := this.registry.Register (c); err != nil { return err }
+	}
+	return nil
+}
+
+/*! \brief The /metrics endpoint
+*/
+func (this *Metrics_c) Handler () http.Handler {
+	return promhttp.HandlerFor (this.registry, promhttp.HandlerOpts{})
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- MIDDLEWARE --------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Counts and times every request by its route template so we don't explode our label cardinality with ids
+*/
+func (this *App_c) metrics (next http.Handler) http.Handler {
+	return http.HandlerFunc (func(w http.ResponseWriter, r *http.Request) {
+		startTime := time.Now()
+		next.ServeHTTP(w, r)
+
+		status := http.StatusOK
+		if aw := findApiWriter (w); aw != nil { status = aw.Status() }
+
+		this.Metrics.Request (routeTemplate (r), r.Method, status, time.Since (startTime))
+	})
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- ENTRY POINTS ------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Creates our collectors and hooks them into the database, cache and task que
+*/
+func (this *App_c) StartMetrics () {
+	this.Metrics = newMetrics()
+
+	cockroach.SetObserver (this.Metrics.Query)
+	if this.Redis != nil { this.Redis.Observer = this.Metrics.Cache }
+
+	this.StackTrace (this.Metrics.Register (
+		prometheus.NewGaugeFunc (prometheus.GaugeOpts {
+			Name: "task_que_depth",
+			Help: "Number of tasks waiting in the que.",
+		}, func() float64 { return float64(this.queStats (context.Background()).Length) }),
+		prometheus.NewGaugeFunc (prometheus.GaugeOpts {
+			Name: "task_que_capacity",
+			Help: "Max number of tasks the que can hold, zero when it's shared in redis.",
+		}, func() float64 { return float64(this.queStats (context.Background()).Capacity) }),
+		prometheus.NewGaugeFunc (prometheus.GaugeOpts {
+			Name: "task_que_leased",
+			Help: "Number of tasks in the shared que being worked on right now.",
+		}, func() float64 { return float64(this.queStats (context.Background()).Leased) }),
+		prometheus.NewGaugeFunc (prometheus.GaugeOpts {
+			Name: "task_dead_letters",
+			Help: "Number of tasks we gave up on, waiting to be replayed or purged.",
+		}, func() float64 { return float64(this.queStats (context.Background()).Dead) }),
+	))
+}
+
+/*! \brief If we have a separate metrics port configured, this starts a server listening on it
+	Otherwise the metrics are served on the main router
+*/
+func (this *App_c) ServeMetrics () *http.Server {
+	if len(CFG.Metrics.Port) == 0 || this.Metrics == nil { return nil }
+
+	mux := http.NewServeMux()
+	mux.Handle ("/metrics", this.Metrics.Handler())
+
+	srv := &http.Server { Addr: ":" + CFG.Metrics.Port, Handler: mux }
+
+	go func() {
+		this.Log.Info ("Starting metrics server", "port", CFG.Metrics.Port)
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			this.Log.Error ("metrics server ListenAndServe", "error", err)
+		}
+	}()
+
+	return srv
+}
@@ -0,0 +1,330 @@
+/*! \file openapi.go
+	\brief Generates an OpenAPI 3 document from our routes and the go structs they read and write
+	Also handles validating request bodies against those same schemas
+*/
+
+package cmd
+
+import (
+	"github.com/NathanRThomas/boiler_api/pkg/models"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+
+	"fmt"
+	"time"
+	"bytes"
+	"regexp"
+	"reflect"
+	"sort"
+	"strings"
+	"net/http"
+	"encoding/json"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- TYPES -------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+//! Our slimmed down version of an openapi schema object, we only use what we can generate from go types
+type schema_t struct {
+	Ref string `json:"$ref,omitempty"`
+	Type string `json:"type,omitempty"`
+	Format string `json:"format,omitempty"`
+	Items *schema_t `json:"items,omitempty"`
+	Properties map[string]*schema_t `json:"properties,omitempty"`
+	AdditionalProperties *schema_t `json:"additionalProperties,omitempty"`
+}
+
+//! Keeps track of the named types we've already generated, these go into the components section of the doc
+type schemas_t map[string]*schema_t
+
+var (
+	timeType		= reflect.TypeOf (time.Time{})
+	uuidType		= reflect.TypeOf (models.UUID(""))
+	rawType			= reflect.TypeOf (json.RawMessage{})
+	pathVarRegex	= regexp.MustCompile (`\{([^}:]+)(:[^}]+)?\}`)
+)
+
+const swaggerUI = `<!DOCTYPE html>
+<html>
+<head>
+	<title>API Docs</title>
+	<link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css" />
+</head>
+<body>
+	<div id="swagger-ui"></div>
+	<script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+	<script>window.ui = SwaggerUIBundle({ url: "/openapi.json", dom_id: "#swagger-ui" });</script>
+</body>
+</html>`
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- LOCAL FUNCTIONS ---------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Generates the schema for a go type
+	Named structs are added to the components and referenced so we don't repeat them
+*/
+func (this schemas_t) schemaFor (t reflect.Type) *schema_t {
+	for t.Kind() == reflect.Ptr { t = t.Elem() }
+
+	switch t {
+	case timeType:
+		return &schema_t { Type: "string", Format: "date-time" }
+	case uuidType:
+		return &schema_t { Type: "string", Format: "uuid" }
+	case rawType:
+		return &schema_t{} // could be anything
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return &schema_t { Type: "string" }
+	case reflect.Bool:
+		return &schema_t { Type: "boolean" }
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &schema_t { Type: "integer", Format: "int64" }
+	case reflect.Float32, reflect.Float64:
+		return &schema_t { Type: "number" }
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 { return &schema_t { Type: "string", Format: "byte" } } // json sends these base64 encoded
+		return &schema_t { Type: "array", Items: this.schemaFor (t.Elem()) }
+	case reflect.Map:
+		return &schema_t { Type: "object", AdditionalProperties: this.schemaFor (t.Elem()) }
+	case reflect.Struct:
+		if len(t.Name()) == 0 { return this.structSchema (t) } // anonymous structs just go inline
+
+		if _, ok := this[t.Name()]; !ok {
+			this[t.Name()] = &schema_t{}	// placeholder so we don't recurse forever on self referencing types
+			this[t.Name()] = this.structSchema (t)
+		}
+		return &schema_t { Ref: "#/components/schemas/" + t.Name() }
+	}
+
+	return &schema_t{}	// interfaces and anything else we don't know about
+}
+
+func (this schemas_t) structSchema (t reflect.Type) *schema_t {
+	out := &schema_t { Type: "object", Properties: make(map[string]*schema_t) }
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, ok := models.JsonFieldName (f)
+		if !ok { continue }
+
+		ft := f.Type
+		for ft.Kind() == reflect.Ptr { ft = ft.Elem() }
+
+		if f.Anonymous && ft.Kind() == reflect.Struct && len(f.Tag.Get ("json")) == 0 { // embedded structs get flattened by json, so do the same here
+			for k, v := range this.structSchema (ft).Properties { out.Properties[k] = v }
+			continue
+		}
+
+		out.Properties[name] = this.schemaFor (f.Type)
+	}
+
+	return out
+}
+
+/*! \brief Follows a reference to the schema it's pointing at
+*/
+func (this schemas_t) resolve (s *schema_t) *schema_t {
+	for s != nil && len(s.Ref) > 0 {
+		s = this[strings.TrimPrefix (s.Ref, "#/components/schemas/")]
+	}
+	return s
+}
+
+/*! \brief Json matches field names without caring about case, so we need to do the same
+*/
+func findProperty (props map[string]*schema_t, key string) (*schema_t, bool) {
+	if s, ok := props[key]; ok { return s, true }
+	for k, s := range props {
+		if strings.EqualFold (k, key) { return s, true }
+	}
+	return nil, false
+}
+
+/*! \brief Checks a decoded json value against the schema, recording every field that doesn't match
+*/
+func (this schemas_t) validate (val interface{}, s *schema_t, path string, errs *models.FieldErrors_t) {
+	s = this.resolve (s)
+	if s == nil || len(s.Type) == 0 || val == nil { return } // anything goes, and null is always allowed in go
+
+	field := path
+	if len(field) == 0 { field = "body" }
+
+	switch s.Type {
+	case "string":
+		str, ok := val.(string)
+		if !ok { errs.Add (field, "expected a string"); return }
+
+		switch s.Format {
+		case "uuid":
+			if len(str) > 0 && !models.UUID(str).Valid() { errs.Add (field, "expected a uuid") }
+		case "date-time":
+			if _, err := time.Parse (time.RFC3339, str); err != nil { errs.Add (field, "expected an RFC 3339 date-time") }
+		}
+
+	case "integer":
+		num, ok := val.(json.Number)
+		if !ok { errs.Add (field, "expected an integer"); return }
+		if _, err := num.Int64(); err != nil { errs.Add (field, "expected an integer") }
+
+	case "number":
+		if _, ok := val.(json.Number); !ok { errs.Add (field, "expected a number") }
+
+	case "boolean":
+		if _, ok := val.(bool); !ok { errs.Add (field, "expected a boolean") }
+
+	case "array":
+		arr, ok := val.([]interface{})
+		if !ok { errs.Add (field, "expected an array"); return }
+		for i, v := range arr {
+			this.validate (v, s.Items, fmt.Sprintf("%s[%d]", path, i), errs)
+		}
+
+	case "object":
+		obj, ok := val.(map[string]interface{})
+		if !ok { errs.Add (field, "expected an object"); return }
+
+		keys := make([]string, 0, len(obj))
+		for k := range obj { keys = append (keys, k) }
+		sort.Strings (keys)	// so our errors always come back in the same order
+
+		for _, k := range keys {
+			v := obj[k]
+			child := k
+			if len(path) > 0 { child = path + "." + k }
+
+			if s.AdditionalProperties != nil {
+				this.validate (v, s.AdditionalProperties, child, errs)
+			} else if prop, ok := findProperty (s.Properties, k); ok {
+				this.validate (v, prop, child, errs)
+			} // json ignores fields it doesn't know about, so we do too
+		}
+	}
+}
+
+/*! \brief Validates the raw json body against the schema for the object we're about to read it into
+*/
+func validateBody (body []byte, out interface{}) error {
+	var val interface{}
+	dec := json.NewDecoder (bytes.NewReader (body))
+	dec.UseNumber()
+	if err := dec.Decode (&val); err != nil { return errors.WithStack (err) }
+
+	schemas := make(schemas_t)
+	errs := &models.FieldErrors_t{}
+	schemas.validate (val, schemas.schemaFor (reflect.TypeOf (out)), "", errs)
+
+	return errors.WithStack (errs.Err())
+}
+
+/*! \brief Converts a mux path template into the openapi version, and returns any path variables
+*/
+func openApiPath (tmpl string) (string, []string) {
+	vars := make([]string, 0)
+	for _, m := range pathVarRegex.FindAllStringSubmatch (tmpl, -1) {
+		vars = append (vars, m[1])
+	}
+	return pathVarRegex.ReplaceAllString (tmpl, "{$1}"), vars
+}
+
+/*! \brief Builds our full openapi document by walking our router
+*/
+func (this *App_c) openApiDoc () (map[string]interface{}, error) {
+	schemas := make(schemas_t)
+	paths := make(map[string]map[string]interface{})
+
+	jsonContent := func (in interface{}) map[string]interface{} {
+		return map[string]interface{} { "application/json": map[string]interface{} { "schema": schemas.schemaFor (reflect.TypeOf (in)) } }
+	}
+
+	errContent := jsonContent (ApiError_t{})
+	errContent[ContentType_problem] = jsonContent (Problem_t{})[ContentType_json]
+
+	err := this.router.Walk (func (route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		opts, ok := this.routeOpts[route]
+		if !ok { return nil } // only document the routes we've described
+
+		tmpl, err := route.GetPathTemplate()
+		if err != nil { return nil }
+		methods, _ := route.GetMethods()
+
+		path, vars := openApiPath (tmpl)
+		if paths[path] == nil { paths[path] = make(map[string]interface{}) }
+
+		for _, method := range methods {
+			if method == http.MethodOptions { continue } // that's just for cors
+
+			op := map[string]interface{} {
+				"summary": opts.Summary,
+				"responses": map[string]interface{} {
+					"default": map[string]interface{} { "description": "Error", "content": errContent },
+				},
+			}
+
+			if len(opts.Description) > 0 { op["description"] = opts.Description }
+			if len(opts.Tags) > 0 { op["tags"] = opts.Tags }
+			if opts.Auth { op["security"] = []map[string][]string { { "bearer": {} } } }
+
+			if opts.Response != nil {
+				op["responses"].(map[string]interface{})["200"] = map[string]interface{} { "description": "Success", "content": jsonContent (opts.Response) }
+			} else {
+				op["responses"].(map[string]interface{})["200"] = map[string]interface{} { "description": "Success" }
+			}
+
+			if opts.Request != nil {
+				content := jsonContent (opts.Request)
+				for _, ct := range opts.ContentTypes { // forms use the same schema, they just encode it differently
+					if ct != ContentType_json { content[ct] = content[ContentType_json] }
+				}
+				if len(opts.ContentTypes) > 0 && !contentTypeAllowed (ContentType_json, opts.ContentTypes) { delete (content, ContentType_json) }
+				op["requestBody"] = map[string]interface{} { "content": content }
+			}
+
+			params := make([]interface{}, 0)
+			for _, v := range vars {
+				params = append (params, map[string]interface{} { "name": v, "in": "path", "required": true, "schema": &schema_t { Type: "string" } })
+			}
+			if len(params) > 0 { op["parameters"] = params }
+
+			paths[path][strings.ToLower (method)] = op
+		}
+		return nil
+	})
+	if err != nil { return nil, errors.WithStack (err) }
+
+	return map[string]interface{} {
+		"openapi": "3.0.3",
+		"info": map[string]interface{} { "title": "API", "version": API_ver },
+		"servers": []map[string]string { { "url": CFG.ApiUrl.String() } },
+		"paths": paths,
+		"components": map[string]interface{} {
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{} {
+				"bearer": map[string]string { "type": "http", "scheme": "bearer", "bearerFormat": "user_id:token" },
+			},
+		},
+	}, nil
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- ROUTES ------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+func (this *App_c) openApiJson (w http.ResponseWriter, r *http.Request) {
+	doc, err := this.openApiDoc()
+	if err != nil { this.ServerError (err, ApiErrorCode_internal, w); return }
+
+	w.Header().Set ("Content-Type", "application/json")
+	this.SuccessWithMsg (w, doc)
+}
+
+func (this *App_c) openApiDocs (w http.ResponseWriter, r *http.Request) {
+	w.Header().Set ("Content-Type", "text/html; charset=utf-8")
+	w.Write ([]byte(swaggerUI))
+}
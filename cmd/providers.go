@@ -0,0 +1,137 @@
+/*! \file providers.go
+	\brief Follow up on what mailgun and twilio tell us, bounces and complaints suppress an email, STOP suppresses a phone number
+	The callbacks only save the event and queue a task, so we can answer them quickly and nothing's lost if handling it fails
+*/
+
+package cmd
+
+import (
+	"github.com/NathanRThomas/boiler_api/pkg/models"
+
+	"github.com/justinas/alice"
+
+	"context"
+	"strconv"
+	"strings"
+	"time"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- DEFINES -----------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+const (
+	providerEventBatch	= 100	// events we handle in a single task
+	providerEventLease	= time.Second * ContextTimeout * 2	// how long a batch is ours, longer than the task can run
+)
+
+//! Twilio error codes that mean we shouldn't text the number again
+var twilioSuppressCodes = map[int]string {
+	21610:	"unsubscribed",			// they replied STOP at some point
+	21614:	"not a mobile number",
+	30005:	"unknown destination",
+	30006:	"landline or unreachable carrier",
+}
+
+func init () {
+	RegisterTask (models.QueTask_providerEvents, "provider_events", func (ctx context.Context, app *App_c, que *models.Que_t) error {
+		return app.HandleProviderEvents (ctx)
+	}, TaskOpts_t { Concurrency: 1 })	// the rows are claimed so instances don't step on each other, but there's no need for more than one each
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- LOCAL FUNCTIONS ---------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Does whatever the event calls for, most of them are just for the record
+*/
+func (this *App_c) handleProviderEvent (ctx context.Context, e *models.ProviderEvent_t) error {
+	suppress := func (channel, reason string) error {
+		this.Logger(ctx).Info ("suppressing address", "channel", channel, "recipient", e.Recipient, "reason", reason)
+		return this.Providers.Suppress (ctx, &models.Suppression_t { Channel: channel, Address: e.Recipient, Reason: reason })
+	}
+
+	switch e.Provider {
+	case models.Provider_mailgun:
+		switch e.Event {
+		case "failed":
+			if e.Attr.Severity == "permanent" { return suppress (models.Channel_email, "bounced: " + e.Attr.Reason) }
+		case "complained", "unsubscribed":
+			return suppress (models.Channel_email, e.Event)
+		}
+
+	case models.Provider_twilio:
+		switch e.Event {
+		case models.ProviderEvent_inbound:
+			switch e.Attr.OptOut {
+			case "STOP":
+				return suppress (models.Channel_sms, "replied " + strings.ToUpper (strings.TrimSpace (e.Attr.Body)))
+			case "START":
+				this.Logger(ctx).Info ("unsuppressing address", "channel", models.Channel_sms, "recipient", e.Recipient)
+				return this.Providers.Unsuppress (ctx, models.Channel_sms, e.Recipient)
+			}
+		case "failed", "undelivered":
+			if reason, ok := twilioSuppressCodes[e.Attr.Code]; ok { return suppress (models.Channel_sms, reason + " (" + strconv.Itoa (e.Attr.Code) + ")") }
+		}
+	}
+	return nil
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PUBLIC FUNCTIONS --------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Middleware for callbacks from our providers. They're server to server so there's no cors,
+	and they don't go through maintenance mode since we'd rather not lose what they're telling us
+*/
+func (this *App_c) ProviderChain () alice.Chain {
+	return alice.New (this.requestLog, this.tracing, this.metrics, this.recoverPanic, this.requestTimeout, this.contextConfig, this.readBody)
+}
+
+/*! \brief True if we shouldn't send to the address, check this before sending an email or text
+*/
+func (this *App_c) Suppressed (ctx context.Context, channel, address string) (bool, error) {
+	return this.Providers.Suppressed (ctx, channel, address)
+}
+
+/*! \brief Handles the provider events we've saved but haven't followed up on, this is the QueTask_providerEvents task
+	Each batch is claimed, so every instance can run this. One that fails is left until its claim runs out
+*/
+func (this *App_c) HandleProviderEvents (ctx context.Context) error {
+	events, err := this.Providers.Unprocessed (ctx, providerEventBatch, providerEventLease)
+	if err != nil { return err }
+
+	handled := 0
+	for _, e := range events {
+		if ctx.Err() != nil { return nil }	// the rest wait for the next run
+
+		if err = this.handleProviderEvent (ctx, e); err != nil {
+			this.StackTraceCtx (ctx, err)
+			continue
+		}
+		if err = this.Providers.Processed (ctx, e.ID); err != nil {
+			this.StackTraceCtx (ctx, err)
+			continue
+		}
+		handled++
+	}
+
+	// there's more, unless we're stuck on the ones that keep failing
+	if len(events) == providerEventBatch && handled > 0 { return this.QueTask (ctx, &models.Que_t { Type: models.QueTask_providerEvents }) }
+	return nil
+}
+
+/*! \brief Saves a provider event and queues the task to follow up on it, duplicates are ignored
+*/
+func (this *App_c) SaveProviderEvent (ctx context.Context, e *models.ProviderEvent_t) error {
+	e.Recipient = strings.TrimSpace (e.Recipient)
+
+	added, err := this.Providers.SaveEvent (ctx, e)
+	if err != nil || !added { return err }
+
+	this.LogWith (ctx, "provider", e.Provider, "event", e.Event)
+	if err = this.QueTask (ctx, &models.Que_t { Type: models.QueTask_providerEvents }); err != nil {
+		this.StackTraceCtx (ctx, err)	// it's saved, the queen picks it up later
+	}
+	return nil
+}
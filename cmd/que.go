@@ -8,10 +8,14 @@ package cmd
 	"github.com/NathanRThomas/boiler_api/pkg/models"
 	
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	
-	//"fmt"
 	"time"
 	"context"
+	"database/sql"
+	"encoding/json"
 
  )
 
@@ -19,88 +23,295 @@ package cmd
  //----- DEFINES -----------------------------------------------------------------------------------------------------------//
 //-------------------------------------------------------------------------------------------------------------------------//
 
-const taskThreadCount		= 9 // Number of threads in our "pool" of task handlers
+const (
+	taskThreadCount		= 9 // Number of threads in our "pool" of task handlers
+	taskTimeoutGrace	= time.Second * 5	// how long a timed out handler has to notice and return before we give up on it
+	taskBusyDelay		= time.Second	// how long a task waits to be tried again when its handler is already running as many as it's allowed
+)
 
   //-------------------------------------------------------------------------------------------------------------------------//
  //----- LOCAL FUNCTIONS ---------------------------------------------------------------------------------------------------//
 //-------------------------------------------------------------------------------------------------------------------------//
 
+/*! \brief Checks the payload is one we'll be able to run, so a bad one is the caller's error rather than a worker's
+*/
+func checkQuePayload (que *models.Que_t) error {
+	if len(que.Payload) == 0 { return nil }
+
+	limit := CFG.Tasks.MaxPayload
+	if limit <= 0 { limit = defaultMaxPayload }
+	if len(que.Payload) > limit { return errors.Wrapf (models.ErrType_payloadTooLarge, "task %d payload is %d bytes, limit %d", que.Type, len(que.Payload), limit) }
+
+	if !json.Valid (que.Payload) { return errors.Errorf ("task %d payload isn't valid json", que.Type) }
+	return taskHandler (que.Type).checkPayload (que)	// for types registered with a payload on this instance
+}
+
 //----- MAIN ENTRY -----//
 
 /*! \brief Publically avialable entry point into this shared class
-	Looks for a que object and handles whatever is thrown at it
+	Looks up the handler registered for the que type and hands it the task, types without one are a permanent error
 */
 func (this *App_c) TaskQueEntry (ctx context.Context, ch chan error, que *models.Que_t) {
+	handler := taskHandler (que.Type)
+	if handler == nil {
+		ch <- errors.Wrapf (models.ErrType_taskPermanent, "Unknown Que Type : %d", que.Type)
+		return
+	}
+
 	// do some base-work here
-	var user *models.User_t
-	
 	if que.UserID.Valid() {
-		user = &models.User_t { ID: que.UserID }	// init this
-		err := this.Users.Get (user) // get our user
+		this.LogWith (ctx, "user_id", que.UserID)
+
+		user := &models.User_t { ID: que.UserID }	// init this
+		err := this.Users.Get (ctx, user) // get our user
+		if errors.Cause (err) == sql.ErrNoRows { err = errors.Wrapf (models.ErrType_taskPermanent, "user %s : %s", que.UserID, err) }	// they're gone, they won't be back for the retry
 		if err != nil { ch <- err; return }
 
 		ctx = context.WithValue (ctx, "user", user)	// add this to our context
 	}
 
-	// now see what our switch is doing
-	switch que.Type {
-	/*
-	case models.QueType_notifyUser:
-		if user == nil { ch <- errors.Errorf("user is missing"); return }
-	*/
-
-	default:
-		ch <- errors.Errorf("Unknown Que Type : %d", que.Type)
-		return
-	}
-
-	// if we're here we're done
-	ch <- nil
+	ch <- handler.fn (ctx, this, que)
 }
 
   //-------------------------------------------------------------------------------------------------------------------------//
  //----- PUBLIC FUNCTIONS --------------------------------------------------------------------------------------------------//
 //-------------------------------------------------------------------------------------------------------------------------//
 
+/*! \brief Adds a task to our que, carrying the trace context from the request that created it
+	Tasks with a payload that's too large, or won't decode for its handler, are rejected here
+*/
+func (this *App_c) QueTask (ctx context.Context, que *models.Que_t) error {
+	if this.TaskQue == nil { return errors.Wrapf (models.ErrType_queClosed, "%+v", que) }
+	if err := checkQuePayload (que); err != nil { return err }
+	if len(que.ID) == 0 { que.ID = newRequestID() }
+
+	que.Trace = make(map[string]string)
+	otel.GetTextMapPropagator().Inject (ctx, propagation.MapCarrier (que.Trace))
+
+	return this.TaskQue.Push (ctx, que)
+}
+
+/*! \brief Creates the que from our config, without starting any workers on it
+	Redis is shared with the other instances and survives restarts, memory is the default and only this instance sees it
+*/
+func (this *App_c) OpenTaskQue () error {
+	if this.TaskQue != nil { return nil }	// already open
+
+	switch CFG.Tasks.Backend {
+	case "", TaskBackend_memory:
+		this.TaskQue = NewMemoryQue (models.MaxQueSize, func (que *models.Que_t, err error) {
+			ctx := this.LogScope (context.Background(), "que_id", que.ID)
+			this.Logger(ctx).Error ("couldn't push a retry back on the que", "task_type", taskHandler (que.Type).label (que.Type), "error", err.Error())
+			this.deadLetter (ctx, que, err)	// replayable from there
+		})
+	case TaskBackend_redis:
+		if this.Redis == nil || this.Redis.DB == nil { return errors.New ("the redis task que needs a redis connection") }
+		this.TaskQue = NewRedisQue (this.Redis)
+	default:
+		return errors.Errorf ("unknown task que backend : %s", CFG.Tasks.Backend)
+	}
+	return nil
+}
+
 /*! \brief We have lots of "things" that we need to que for completion in a background process.  
-			These items stay locally in memory for this instance, so it's important it never gets too large and that it completes before
-			the service terminates
+			This opens the que if it isn't already, and starts the workers that pull tasks off of it
 */
-func (this *App_c) StartTaskQue () {
-	this.TaskQue = make (chan *models.Que_t, models.MaxQueSize)	// allocate our global channel
+func (this *App_c) StartTaskQue () error {
+	if err := this.OpenTaskQue(); err != nil { return err }
+
+	visibility := time.Second * time.Duration (CFG.Tasks.Visibility)
+	if visibility <= 0 { visibility = time.Second * defaultVisibility }
 
 	// launch our background proccesing thread
 	for i := 0; i < taskThreadCount; i++ {	// this creates n processing threads using the anonymous function below
 		this.WG.Add(1)
 		go func () {
 			defer this.WG.Done()
-			ch := make(chan error, 1)	//channel for tracking when the entry call finishes
 
 			for {	// stay in this loop. as long as we're still running or there's still messages in the que, we're not done
-				select {
-				case que := <- this.TaskQue:
-					if que == nil { return } // means the channel was closed
-					ctx, cancel := context.WithTimeout (context.Background(), time.Second * ContextTimeout) // no single task should take longer than this, otherwise we have an issue
+				que, err := this.TaskQue.Pop (context.Background(), visibility)
+				switch {
+				case errors.Cause (err) == models.ErrType_queClosed:
+					return	// nothing left for us
+				case err != nil:
+					this.StackTrace (err)
+					time.Sleep (time.Second)	// probably redis, give it a second before we ask again
+				case que != nil:
+					this.workTask (que, visibility)
+				}
+			}
+		}()
+	}
+	return nil
+}
 
-					ctx = context.WithValue (ctx, "slackConfig", &CFG.Slack)	// add this to our context, some tasks need it
-					ctx = context.WithValue (ctx, "mailgunConfig", &CFG.Mailgun)	// add this to our context, some tasks need it
+/*! \brief Handles a single task off the que, then acks it, retries it or dead letters it depending on how it went
+*/
+func (this *App_c) workTask (que *models.Que_t, visibility time.Duration) {
+	handler := taskHandler (que.Type)	// nil for types we don't know, the entry errors on those
 
-					//we got a message in our que
-					go this.TaskQueEntry (ctx, ch, que)	// handle things
+	ctx := this.LogScope (context.Background(), "task_type", handler.label (que.Type), "que_id", que.ID, "attempt", que.Attempts + 1)	// so everything this task logs can be tied together
+	if que.Expired() {
+		this.Metrics.Task (que.Type, "expired", 0)
+		this.Logger(ctx).Warn ("task expired before it ran", "expires", que.Expires)
+		this.ackTask (ctx, que)
+		return
+	}
 
-					var err error
-					select {
-					case <-ctx.Done():
-						//this is bad, the context expired on us
-						err = errors.Errorf ("context expired for que: %s : %+v\n", ctx.Err(), que)
-					case err = <- ch: // finished normally
-					}
+	// a busy handler goes back on the que rather than holding this worker, while we waited our lease could run out and other handlers would starve
+	if !handler.tryAcquire() {
+		this.Metrics.Task (que.Type, "busy", 0)
 
-					this.StackTrace (err) // record this error, if one exists
+		rctx, rcancel := context.WithTimeout (ctx, time.Second * 5)
+		err := this.TaskQue.Retry (rctx, que, taskBusyDelay)	// not an attempt, it never ran
+		rcancel()
+		if err == nil { return }	// the retry replaces the ack
 
-					cancel()	// don't defer since we're in a loop, just call it here everytime
-				}
-			}
-		}()
+		this.StackTraceCtx (ctx, err)	// we can't put it back so we have to wait, keep our lease for as long as that might take
+		this.StackTraceCtx (ctx, this.TaskQue.Extend (ctx, que, handler.timeout() * 2 + visibility))
+		handler.acquire()
+
+		if que.Expired() {
+			handler.release()
+			this.Metrics.Task (que.Type, "expired", 0)
+			this.Logger(ctx).Warn ("task expired waiting for its handler", "expires", que.Expires)
+			this.ackTask (ctx, que)
+			return
+		}
+	}
+
+	ch := make(chan error, 1)	// channel for tracking when the entry call finishes, new each time so a late finish can't be read by the next task
+	ctx, cancel := context.WithTimeout (ctx, handler.timeout()) // no single task should take longer than this, otherwise we have an issue
+	defer cancel()
+
+	ctx = context.WithValue (ctx, "slackConfig", &CFG.Slack)	// add this to our context, some tasks need it
+	ctx = context.WithValue (ctx, "mailgunConfig", &CFG.Mailgun)	// add this to our context, some tasks need it
+
+	// this gets its own trace, linked back to the request that queued it
+	opts := []trace.SpanStartOption { trace.WithSpanKind (trace.SpanKindConsumer) }
+	queued := trace.SpanContextFromContext (otel.GetTextMapPropagator().Extract (context.Background(), propagation.MapCarrier (que.Trace)))
+	if queued.IsValid() { opts = append (opts, trace.WithLinks (trace.Link { SpanContext: queued })) }
+
+	ctx, span := tracer.Start (ctx, "task " + handler.label (que.Type), opts...)
+	if span.SpanContext().IsValid() { this.LogWith (ctx, "trace_id", span.SpanContext().TraceID().String()) }
+
+	// the lease has to outlast the handler, otherwise another worker picks it up while we're still on it
+	if timeout := handler.timeout(); timeout >= visibility {
+		this.StackTraceCtx (ctx, this.TaskQue.Extend (ctx, que, timeout + visibility))
+	}
+
+	//we got a message in our que
+	startTime := time.Now()
+	que.Attempts++
+	go func() {
+		defer handler.release()	// once it's actually done, even if we stopped waiting on it
+		this.TaskQueEntry (ctx, ch, que)	// handle things
+	}()
+
+	var err error
+	outcome := "success"
+	select {
+	case <-ctx.Done():
+		//this is bad, the context expired on us
+		err = errors.Errorf ("context expired for que: %s : %+v\n", ctx.Err(), que)
+		outcome = "timeout"
+
+		// it's only safe to retry once the handler has stopped, otherwise the retry could run alongside it
+		wctx, wcancel := context.WithTimeout (context.WithoutCancel (ctx), time.Second * 5)
+		this.StackTraceCtx (ctx, this.TaskQue.Extend (wctx, que, taskTimeoutGrace + visibility))	// so nobody else picks it up while we wait
+		wcancel()
+
+		select {
+		case <-ch:	// it gave up along with its context
+		case <-time.After (taskTimeoutGrace):
+			err = errors.Wrap (models.ErrType_taskPermanent, err.Error())	// still going, so it's dead lettered rather than retried
+		}
+	case err = <- ch: // finished normally
+		if err != nil { outcome = "error" }
+	}
+
+	this.Metrics.Task (que.Type, outcome, time.Since (startTime))
+	EndSpan (span, err)
+
+	this.finishTask (ctx, handler, que, err)
+}
+
+/*! \brief Decides what happens to the task after a run
+	Non fatal errors are logged and we're done with it, permanent errors and the last attempt are dead lettered, anything else is retried
+*/
+func (this *App_c) finishTask (ctx context.Context, handler *taskHandler_c, que *models.Que_t, err error) {
+	switch {
+	case err == nil, errors.Cause (err) == models.ErrType_nonFatal:
+		this.StackTraceCtx (ctx, err)	// only a warning
+
+	case errors.Cause (err) == models.ErrType_taskPermanent, que.Attempts >= handler.maxAttempts():
+		this.StackTraceCtx (ctx, err)
+		this.deadLetter (ctx, que, err)
+
+	default:
+		delay := handler.backoff (que.Attempts)
+		if que.Expires > 0 && time.Now().Add (delay).Unix() >= que.Expires {	// it'll be too late by then
+			this.Logger(ctx).Warn ("task will expire before it can be retried", "error", err.Error(), "expires", que.Expires)
+			break
+		}
+
+		this.Logger(ctx).Warn ("task failed, retrying", "error", err.Error(), "stack", errStack (err), "delay", delay.String())
+
+		rctx, cancel := context.WithTimeout (context.WithoutCancel (ctx), time.Second * 5)	// the task's context may be what timed out
+		defer cancel()
+		rerr := this.TaskQue.Retry (rctx, que, delay)
+		if rerr == nil { return }	// the retry replaces the ack
+
+		this.StackTraceCtx (ctx, rerr)
+		this.deadLetter (ctx, que, err)	// we can't retry it, so don't lose it
+	}
+
+	this.ackTask (ctx, que)
+}
+
+/*! \brief Removes the task from the que for good
+*/
+func (this *App_c) ackTask (ctx context.Context, que *models.Que_t) {
+	ctx, cancel := context.WithTimeout (context.WithoutCancel (ctx), time.Second * 5)	// the task's context may be what timed out
+	defer cancel()
+	this.StackTraceCtx (ctx, this.TaskQue.Ack (ctx, que))
+}
+
+/*! \brief Length and capacity of the que, how many are being worked on and waiting on a retry when it's shared, and how many we gave up on
+*/
+func (this *App_c) queStats (ctx context.Context) queStats_t {
+	stats := queStats_t { Backend: TaskBackend_memory }
+	if this.TaskQue == nil { return stats }
+
+	stats.Length = this.TaskQue.Len (ctx)
+	stats.Capacity = this.TaskQue.Cap()
+	if rq, ok := this.TaskQue.(*redisQue_c); ok {
+		stats.Backend = TaskBackend_redis
+		stats.Leased = rq.db.QueLeased (ctx)
+		stats.Delayed = rq.db.QueDelayed (ctx)
+	}
+	if this.Redis != nil { stats.Dead = this.Redis.DeadLetterCount (ctx) }
+	return stats
+}
+
+/*! \brief Closes the que and waits for the workers to finish what they have, or for the context to be done
+	Only call this once nothing else can add to the que, ie after the servers have stopped
+	The memory que is worked until it's empty, anything left in redis waits there for the next worker
+*/
+func (this *App_c) StopTaskQue (ctx context.Context) error {
+	if this.TaskQue == nil { return nil }
+	this.TaskQue.Close()
+
+	done := make(chan struct{})
+	go func() {
+		this.WG.Wait() //wait for the workers, and the queen if she's running
+		close (done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return errors.Wrapf (ctx.Err(), "%d tasks left in the que", this.TaskQue.Len (context.Background()))
 	}
 }
@@ -5,24 +5,58 @@
 package cmd
 
 import (
-	"github.com/NathanRThomas/boiler_api/pkg/models/redis"
-	"github.com/NathanRThomas/boiler_api/pkg/models/cockroach"
+	"github.com/NathanRThomas/boiler_api/pkg/models"
 	
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
-
 	"github.com/justinas/alice"
 	"github.com/gorilla/mux"
-	"github.com/pkg/errors"
 
 	//"fmt"
 	"net/http"
-	"io/ioutil"
 	"context"
 	"runtime/debug"
 	"time"
 )
 
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- TYPES -------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+//! Options for a single route, these describe it in the openapi doc and change how our middleware treats it
+type RouteOpts_t struct {
+	Summary, Description string
+	Tags []string
+	Request, Response interface{}	// an instance of the objects read from and written to the body, ie models.User_t{}
+	Auth bool		// requires the bearer token
+
+	MaxBody int64			// max bytes we'll read from the body, defaults to Body.MaxBytes in the config
+	ContentTypes []string	// content types we accept in the body, defaults to json, form and multipart
+	Stream bool				// we don't read the body, the handler reads it itself through BodyReader
+	NoCompress bool			// for streaming responses, we don't compress or buffer them for an etag
+	Timeout time.Duration	// how long the request can run, defaults to Timeout.Request in the config, negative turns it off
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- LOCAL FUNCTIONS ---------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Returns the options for the route we matched, or the defaults if it wasn't described
+*/
+func (this *App_c) routeOptions (r *http.Request) *RouteOpts_t {
+	if cur := mux.CurrentRoute (r); cur != nil {
+		if opts, ok := this.routeOpts[cur]; ok { return opts }
+	}
+	return &RouteOpts_t{}
+}
+
+/*! \brief Returns the path template for the route we matched, ie /user/{id}, falls back to the raw path
+*/
+func routeTemplate (r *http.Request) string {
+	if cur := mux.CurrentRoute (r); cur != nil {
+		if tmpl, err := cur.GetPathTemplate(); err == nil { return tmpl }
+	}
+	return r.URL.Path
+}
+
   //-------------------------------------------------------------------------------------------------------------------------//
  //----- LOCAL MIDDLEWARE --------------------------------------------------------------------------------------------------//
 //-------------------------------------------------------------------------------------------------------------------------//
@@ -31,12 +65,12 @@ import (
 */
 func (this *App_c) cors (next http.Handler) http.Handler {
 	return http.HandlerFunc (func(w http.ResponseWriter, r *http.Request) {
-		//app.infoLog.Printf("%s - %s %s %s", r.RemoteAddr, r.Proto, r.Method, r.URL.RequestURI())
+		//this.Logger(r.Context()).Debug("cors", "remote", r.RemoteAddr, "proto", r.Proto, "uri", r.URL.RequestURI())
 
-		w.Header().Set("Vary", "Origin")
+		w.Header().Add("Vary", "Origin")	// add, AcceptVersion may have already set one
 		w.Header().Add("Vary", "Access-Control-Request-Method")
 		w.Header().Add("Vary", "Access-Control-Request-Headers")
-		w.Header().Set("Access-Control-Allow-Headers", "Authorization,Content-Type,Accept,Origin,User-Agent,DNT,Cache-Control,X-Mx-ReqToken,Keep-Alive,X-Requested-With,If-Modified-Since,Content-Range, Content-Disposition, Content-Description")
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization,Content-Type,Accept,Origin,User-Agent,DNT,Cache-Control,X-Mx-ReqToken,Keep-Alive,X-Requested-With,If-Modified-Since,Content-Range, Content-Disposition, Content-Description, Accept-Version, Idempotency-Key, Last-Event-ID")
 		w.Header().Set("Access-Control-Allow-Methods", "GET,POST,OPTIONS,PUT,DELETE")
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Content-Type", "application/json")  //we're handling things via json objects in the body of the request
@@ -61,8 +95,7 @@ func (this *App_c) recoverPanic (next http.Handler) http.Handler {
 			if err := recover(); err != nil {
 				// Set a "Connection: close" header on the response.
                 w.Header().Set("Connection", "close")
-                this.ErrorLog.Println(err)
-				debug.PrintStack()
+                this.writerLogger(w).Error("panic recovered", "panic", err, "stack", string(debug.Stack()))
 				this.ServerError (nil, ApiErrorCode_panicRecovery, w)
 			}
         }()
@@ -77,35 +110,19 @@ func (this *App_c) contextConfig (next http.Handler) http.Handler {
     return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ctx := context.WithValue (r.Context(), "slackConfig", &CFG.Slack)	// add this to our context, some tasks need it
 		ctx = context.WithValue (ctx, "mailgunConfig", &CFG.Mailgun)	// add this to our context, some tasks need it
+		ctx = context.WithValue (ctx, "twilioConfig", &CFG.Twilio)
 		
         next.ServeHTTP(w, r.WithContext(ctx))
     })
 }
 
-/*! \brief Creates a timeout for the request context so we bail on long-running requests
-*/
-func (this *App_c) requestTimeout (next http.Handler) http.Handler {
+func (this *App_c) longRequestCheck (next http.Handler) http.Handler {
     return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ctx, cancel := context.WithCancel (r.Context())
-		defer cancel()
-
-		go func() {
-			next.ServeHTTP(w, r.WithContext(ctx))
-			cancel()
-		}()
-
-		select {
-		case <- ctx.Done():
-			// we're good
-		case <-time.After(time.Second * ContextTimeout):
-			this.ErrorLog.Printf("Request timed out: %s %s %s\n", r.Proto, r.Method, r.URL.RequestURI())
-			w.WriteHeader(http.StatusRequestTimeout)
+		if this.routeTimeout (r) == 0 { // these are meant to run for a while, ie event streams
+			next.ServeHTTP(w, r)
+			return
 		}
-    })
-}
 
-func (this *App_c) longRequestCheck (next http.Handler) http.Handler {
-    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		startTime := time.Now()
 		next.ServeHTTP(w, r)
 
@@ -115,23 +132,7 @@ func (this *App_c) longRequestCheck (next http.Handler) http.Handler {
 				str = string(body)
 			}
 			
-			this.InfoLog.Printf("Request took %s to complete: %s %s %s\n%s\n", time.Now().Sub(startTime), r.Proto, r.Method, r.URL.RequestURI(), str)
-		}
-    })
-}
-
-/*! \brief Our api works using json encoded bodies in the requests, this reads it out for us and puts it into our context
-*/
-func (this *App_c) readBody (next http.Handler) http.Handler {
-    return http.HandlerFunc (func(w http.ResponseWriter, r *http.Request) {
-		body, err := ioutil.ReadAll(r.Body)	//reads the entire body posted by the user
-		if err == nil {
-			ctx := r.Context()
-			ctx = context.WithValue(ctx, "body", body)
-			next.ServeHTTP(w, r.WithContext(ctx))
-		} else {
-			this.StackTrace (errors.WithStack (err))
-			next.ServeHTTP(w, r)
+			this.Logger(r.Context()).Warn("long request", "duration", time.Now().Sub(startTime), "proto", r.Proto, "uri", r.URL.RequestURI(), "body", str)
 		}
     })
 }
@@ -140,27 +141,37 @@ func (this *App_c) readBody (next http.Handler) http.Handler {
  //----- MIDDLEWARE --------------------------------------------------------------------------------------------------------//
 //-------------------------------------------------------------------------------------------------------------------------//
 
+/*! \brief Counts another request from the address, true once they've had too many in the last minute
+	Shared by Ddos and GrpcDdos so guessing over grpc is limited the same way
+*/
+func (this *App_c) ddosBlocked (ctx context.Context, remote string) bool {
+	var cnt int64 // start at zero
+	key := "ddos:" + remote
+	if data, found := this.Cache.Get (key); found { cnt = data.(int64) }	// we're cached
+	
+	cnt++	// keep adding to our count
+	if cnt > 10 {
+		this.Logger(ctx).Info ("ddos blocked", "remote", remote)
+		return true
+	}
+
+	this.Cache.Set (key, cnt, time.Minute) // cache this again for another minute
+	return false
+}
+
 /*! \brief Monitors the ip address of the requester and returns an error if they've had too many requests
 */
 func (this *App_c) Ddos (next http.Handler) http.Handler {
     return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if len(r.RemoteAddr) > 0 {
-			//this.InfoLog.Printf("remote address: %s\n", r.RemoteAddr)
+			//this.Logger(r.Context()).Debug("remote address", "remote", r.RemoteAddr)
 
-			var cnt int64 // start at zero
-			key := "ddos:" + r.RemoteAddr
-			if data, found := this.Cache.Get (key); found { cnt = data.(int64) }	// we're cached
-			
-			cnt++	// keep adding to our count
-			if cnt > 10 {
-				this.InfoLog.Println ("ddos blocked", r.RemoteAddr)
+			if this.ddosBlocked (r.Context(), r.RemoteAddr) {
 				this.ErrorWithMsg (nil, w, http.StatusTooManyRequests, ApiErrorCode_passwordGuessing, "You're just guessing")
 				return // don't serve next
 			}
-
-			this.Cache.Set (key, cnt, time.Minute) // cache this again for another minute
 		} else {
-			this.InfoLog.Println("request had no remote address")
+			this.Logger(r.Context()).Info("request had no remote address")
 		}
         next.ServeHTTP(w, r)
     })
@@ -170,41 +181,6 @@ func (this *App_c) Ddos (next http.Handler) http.Handler {
  //----- ROUTES ------------------------------------------------------------------------------------------------------------//
 //-------------------------------------------------------------------------------------------------------------------------//
 
-func (this *App_c) ready (next http.Handler) http.Handler {
-	return http.HandlerFunc (func(w http.ResponseWriter, r *http.Request) {
-		if this.Running {
-			next.ServeHTTP(w, r)
-		} else {
-			//if we're here it's bad
-			w.WriteHeader(http.StatusServiceUnavailable)
-			w.Write([]byte("Not Running"))
-		}
-    })
-}
-
-func (this *App_c) live (next http.Handler) http.Handler {
-    return http.HandlerFunc (func(w http.ResponseWriter, r *http.Request) {
-		if err := cockroach.TestDB(); err == nil {
-			err := this.Redis.Ping()
-			if err == nil || errors.Cause(err) == redis.ErrServiceDown {
-				next.ServeHTTP(w, r)
-			} else {
-				//if we're here it's bad
-				w.WriteHeader(http.StatusServiceUnavailable)
-				w.Write([]byte("Redis cache service is down"))
-			}
-		} else {
-			//if we're here it's bad
-			w.WriteHeader(http.StatusServiceUnavailable)
-			w.Write([]byte(err.Error()))
-		}
-    })
-}
-
-func (this *App_c) thingsLookGood (w http.ResponseWriter, r *http.Request) {
-	w.Write([]byte("Things look good")) //we're good
-}
-
 func (this *App_c) notFound (w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNotFound)
 }
@@ -215,34 +191,48 @@ func (this *App_c) notFound (w http.ResponseWriter, r *http.Request) {
 
 func (this *App_c) Routes () *mux.Router {
 	mux := mux.NewRouter().StrictSlash(true)
+	this.router = mux // we need this to walk our routes for the openapi doc
 	
-	// standard chain that all calls make
-	readyCheck := alice.New (this.ready)
-	liveCheck := readyCheck.Append (this.live)
 	cors := alice.New (this.cors)
 
 	mux.Handle ("/", cors.ThenFunc(this.notFound)) // default not found handler
 
-	mux.Handle("/status/ready", readyCheck.ThenFunc(this.thingsLookGood)).Methods(http.MethodGet)	// default check
-	mux.Handle("/status/live", liveCheck.ThenFunc(this.thingsLookGood)).Methods(http.MethodGet)	// database connection check
+	// kubernetes probes
+	mux.HandleFunc("/status/startup", this.startupStatus).Methods(http.MethodGet)	// we've finished starting up
+	mux.HandleFunc("/status/ready", this.readyStatus).Methods(http.MethodGet)	// we're not shutting down and our dependencies are up
+	mux.HandleFunc("/status/live", this.liveStatus).Methods(http.MethodGet)	// our own loops are still going
+
+	// documentation
+	mux.Handle("/errors", cors.ThenFunc(this.errorCatalog)).Methods(http.MethodGet)
+	mux.Handle("/openapi.json", cors.ThenFunc(this.openApiJson)).Methods(http.MethodGet)
+	if CFG.ProductionLevel == models.ProductionLevel_Dev {
+		mux.HandleFunc("/docs", this.openApiDocs).Methods(http.MethodGet)	// only expose the ui while developing
+	}
 
-	// metrics handled through prometheus
-	this.ApiRequests = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "api_requests_total",
-			Help: "How many requests processed, partitioned by bot.",
-		},
-		[]string{"bot", "endpoint", "code"},
-	)
+	// metrics handled through prometheus, unless they're on their own port
+	if this.Metrics != nil && len(CFG.Metrics.Port) == 0 {
+		mux.Handle("/metrics", this.Metrics.Handler()).Methods(http.MethodGet)
+	}
 
-	prometheus.MustRegister(this.ApiRequests)
-	http.Handle("/metrics", promhttp.Handler())
+	// debugging, only when there's a token protecting it and it's not on its own port
+	if len(CFG.Debug.Token) > 0 && len(CFG.Debug.Port) == 0 {
+		this.debugRoutes (mux)
+	}
 
     return mux
 }
 
+/*! \brief Attaches our options to a route, this is how a route ends up in the openapi doc and how it changes our middleware
+	Call this when registering the route, it passes the route back out so it can be chained
+*/
+func (this *App_c) Describe (route *mux.Route, opts RouteOpts_t) *mux.Route {
+	if this.routeOpts == nil { this.routeOpts = make(map[*mux.Route]*RouteOpts_t) }
+	this.routeOpts[route] = &opts
+	return route
+}
+
 /*! \brief Re-used default starting point for any api endpoint
 */
 func (this *App_c) ApiChain () (alice.Chain)  {
-	return alice.New (this.recoverPanic, this.requestTimeout, this.cors, this.contextConfig, this.readBody, this.longRequestCheck)
+	return alice.New (this.requestLog, this.tracing, this.metrics, this.recoverPanic, this.requestTimeout, this.cors, this.maintenance, this.conditionalGet, this.compress, this.contextConfig, this.readBody, this.idempotency, this.longRequestCheck)
 }
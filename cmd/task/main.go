@@ -1,120 +1,145 @@
-/*! \file main.go
-	\brief CLI version, or could be used a
-*/
-
-package main 
-
- import (
-	"github.com/NathanRThomas/boiler_api/cmd"
-	"github.com/NathanRThomas/boiler_api/pkg/models/redis"
-	"github.com/NathanRThomas/boiler_api/pkg/models/cockroach"
-		
-	"github.com/patrickmn/go-cache"
-
-	"fmt"
-	"os"
-	"net/http"
-	"flag"
-	"time"
-	"sync"
-	
- )
-
-  //-------------------------------------------------------------------------------------------------------------------------//
- //----- STRUCTS -----------------------------------------------------------------------------------------------------------//
-//-------------------------------------------------------------------------------------------------------------------------//
-
-type app_c struct {
-	cmd.App_c
-
-	tasks	cockroach.Task_c
-}
-
-  //-------------------------------------------------------------------------------------------------------------------------//
- //----- MAIN --------------------------------------------------------------------------------------------------------------//
-//-------------------------------------------------------------------------------------------------------------------------//
-
-/*! \brief You got to start somewhere
-*/
-func main() {
-	// create our logs
-	errorLog, infoLog := cmd.CreateLoggers ()
-	
-	// parse from file first
-	err := cmd.ParseConfig ()
-	if err != nil { errorLog.Fatalf ("Invalid Config: %s", err.Error()) }
-
-	// now handle command line flags, these override the config file
-	flag.BoolVar (&cmd.CFG.Version, "v", false, "Returns the version of the backend task service")
-	flag.StringVar (&cmd.CFG.Port, "p", "8051", "Port to run the task service on")
-	flag.BoolVar (&cmd.CFG.LocalRun, "local", false, "Used for regression testing, runs as a 'fails fast' setup")
-	
-	flag.Parse()
-
-	if cmd.CFG.Version {
-		fmt.Printf("\nCLI Version: %s\n\n", cmd.API_ver)
-		os.Exit(0)
-	}
-
-	// connect to our database(s)
-	// redis
-	if len(cmd.CFG.Redis.IPs) == 0 { errorLog.Fatal ("no redis ip address") }
-	ip := cmd.CFG.Redis.IPs[len(cmd.CFG.Redis.IPs) -1] // always get the last one
-	
-	redisDB, err := cmd.ConnectRedis (ip, cmd.CFG.Redis.Port)
-	if err != nil { errorLog.Fatal (err) }	// we can't start without the cache service running
-	
-	// cockroach
-	cockDB, err := cmd.ConnectCockroach (cmd.CFG.Cockroach.IP, cmd.CFG.Cockroach.Port, cmd.CFG.Cockroach.Database, cmd.CFG.Cockroach.User)
-	if err != nil { errorLog.Fatal (err) }
-
-	// local cache
-	cacheDB := cache.New(120*time.Second, 10*time.Minute)
-
-	app := &app_c { App_c: cmd.App_c { 
-			Running: true,
-			WG: new(sync.WaitGroup),
-			ErrorLog: errorLog, 
-			InfoLog: infoLog,
-			Redis: &redis.DB_c { DB: redisDB }, 
-			Cache: cacheDB,
-		},
-	}
-
-	// task handlers
-	app.StartTaskQue()
-
-	// server
-	srv := &http.Server {
-        Addr:     ":" + cmd.CFG.Port,
-        ErrorLog: errorLog,
-		Handler:  app.routes(),
-		//WriteTimeout: 15 * time.Second, // don't set this, it prevents us from writing a response to the request after the timeout
-		ReadTimeout:  15 * time.Second,
-	}
-
-	// signal handling
-	cmd.MonitorSignals(&app.Running, srv)
-	
-	// start the background processes
-	app.WG.Add(1)
-	go app.queen()	// this gets its own thread
-	
-	infoLog.Printf("Starting task server on port %s\n", cmd.CFG.Port)
-	if err := srv.ListenAndServe(); err != http.ErrServerClosed {	// Error starting or closing listener:
-		errorLog.Printf("Task server ListenAndServe: %v", err)
-	}
-	
-	// we're out of the LB at this point, but we still need to make sure we aren't still adding to the queues before we close them
-	time.Sleep(time.Second * 3)
-	close(app.TaskQue) // close this que, this will wait for all the queued items to get processed
-	
-	app.WG.Wait() //wait for the workers and queen to finish
-	time.Sleep(time.Second * 3) //just to make sure we're really done
-
-	// close down the database connections now that we're done handling requests
-	cockDB.Close ()
-	redisDB.Close ()
-	
-	os.Exit(0)	//final exit
+/*! \file main.go
+	\brief CLI version, or could be used a
+*/
+
+package main 
+
+ import (
+	"github.com/NathanRThomas/boiler_api/cmd"
+	"github.com/NathanRThomas/boiler_api/pkg/models"
+	"github.com/NathanRThomas/boiler_api/pkg/models/redis"
+	"github.com/NathanRThomas/boiler_api/pkg/models/cockroach"
+	"github.com/NathanRThomas/boiler_api/pkg/toolz"
+		
+	"github.com/patrickmn/go-cache"
+
+	"fmt"
+	"os"
+	"net/http"
+	"flag"
+	"context"
+	"log"
+	"log/slog"
+	"time"
+	"sync"
+	
+ )
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- STRUCTS -----------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+type app_c struct {
+	cmd.App_c
+
+	tasks	cockroach.Task_c
+	mailgun	toolz.Mailgun_c
+	twilio	toolz.Twilio_c
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- MAIN --------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief You got to start somewhere
+*/
+func main() {
+	// parse from file first
+	err := cmd.ParseConfig ()
+	if err != nil { log.Fatalf ("Invalid Config: %s", err.Error()) }
+
+	// create our logs, the format and level come from the config
+	logger, logLevel, err := cmd.CreateLogger ()
+	if err != nil { log.Fatalf ("Invalid Log Config: %s", err.Error()) }
+
+	// now handle command line flags, these override the config file
+	flag.BoolVar (&cmd.CFG.Version, "v", false, "Returns the version of the backend task service")
+	flag.StringVar (&cmd.CFG.Port, "p", "8051", "Port to run the task service on")
+	flag.BoolVar (&cmd.CFG.LocalRun, "local", false, "Used for regression testing, runs as a 'fails fast' setup")
+	
+	flag.Parse()
+
+	if cmd.CFG.Version {
+		fmt.Printf("\nCLI Version: %s\n\n", cmd.API_ver)
+		os.Exit(0)
+	}
+
+	// tracing, this needs to be up before we start making any calls
+	stopTracing, err := cmd.StartTracing ("task")
+	if err != nil { cmd.LogFatal (logger, "tracing", err) }
+
+	// connect to our database(s)
+	// redis
+	if len(cmd.CFG.Redis.IPs) == 0 { cmd.LogFatal (logger, "no redis ip address", nil) }
+	ip := cmd.CFG.Redis.IPs[len(cmd.CFG.Redis.IPs) -1] // always get the last one
+	
+	redisDB, err := cmd.ConnectRedis (ip, cmd.CFG.Redis.Port)
+	if err != nil { cmd.LogFatal (logger, "redis connect", err) }	// we can't start without the cache service running
+	
+	// cockroach
+	cockDB, err := cmd.ConnectCockroach (cmd.CFG.Cockroach.IP, cmd.CFG.Cockroach.Port, cmd.CFG.Cockroach.Database, cmd.CFG.Cockroach.User)
+	if err != nil { cmd.LogFatal (logger, "cockroach connect", err) }
+
+	// local cache
+	cacheDB := cache.New(120*time.Second, 10*time.Minute)
+
+	app := &app_c { App_c: cmd.App_c { 
+			Life: cmd.NewLifecycle (logger),
+			WG: new(sync.WaitGroup),
+			Log: logger,
+			LogLevel: logLevel,
+			Redis: &redis.DB_c { DB: redisDB, Addr: fmt.Sprintf("%s:%d", ip, cmd.CFG.Redis.Port) }, 
+			Cache: cacheDB,
+		},
+	}
+
+	// nothing goes out to an address that bounced, complained or texted STOP
+	app.mailgun.Suppressed = func (ctx context.Context, address string) (bool, error) { return app.Suppressed (ctx, models.Channel_email, address) }
+	app.twilio.Suppressed = func (ctx context.Context, address string) (bool, error) { return app.Suppressed (ctx, models.Channel_sms, address) }
+
+	// tracing first, so it's the last thing we stop and we keep every span
+	app.Life.OnStop ("tracing", cmd.Phase_telemetry, stopTracing)
+	app.Life.OnStop ("cockroach", cmd.Phase_connections, func (context.Context) error { return cockDB.Close() })
+	app.Life.OnStop ("redis", cmd.Phase_connections, func (context.Context) error { return redisDB.Close() })
+
+	// health checks, metrics and flags are all used by the workers, so they have to be set up before any start
+	app.StartHealth()
+	app.RegisterHealthCheck (cmd.HealthCheck_t { Name: "queen", Critical: true, Liveness: true, Check: app.HeartbeatCheck ("queen", queenHeartbeat) })
+	app.StartMetrics()	// this also needs to happen before we create our routes
+	app.StartFlags()
+
+	// task handlers, this also waits for the queen since she's in the same wait group
+	if err := app.StartTaskQue(); err != nil { cmd.LogFatal (logger, "task que", err) }
+	app.Life.OnStop ("task que", cmd.Phase_workers, app.StopTaskQue)
+	app.Life.OnStop ("flags", cmd.Phase_workers, app.StopFlags)
+
+	if metricsSrv := app.ServeMetrics(); metricsSrv != nil { app.Life.OnStop ("metrics", cmd.Phase_telemetry, metricsSrv.Shutdown) }
+	if debugSrv := app.ServeDebug(); debugSrv != nil { app.Life.OnStop ("debug", cmd.Phase_telemetry, debugSrv.Shutdown) }
+
+	// server
+	srv := &http.Server {
+        Addr:     ":" + cmd.CFG.Port,
+        ErrorLog: slog.NewLogLogger (logger.Handler(), slog.LevelError),
+		Handler:  app.routes(),
+		//WriteTimeout: 15 * time.Second, // don't set this, it prevents us from writing a response to the request after the timeout
+		ReadTimeout:  15 * time.Second,
+	}
+	app.Life.Serve ("task", cmd.Phase_servers, srv)
+
+	// start the background processes, she stops on her own once we're shutting down
+	app.Life.OnStart ("queen", cmd.Phase_workers, func (context.Context) error {
+		app.WG.Add(1)
+		go app.queen()	// this gets its own thread
+		return nil
+	})
+
+	app.MonitorLogLevel()
+	
+	logger.Info("Starting task server", "port", cmd.CFG.Port, "version", cmd.API_ver)
+	if err := app.Life.Run(); err != nil {
+		logger.Error("Task server stopped", "error", err)
+		os.Exit(1)
+	}
+	
+	os.Exit(0)	//final exit
 }
\ No newline at end of file
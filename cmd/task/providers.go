@@ -0,0 +1,140 @@
+/*! \file providers.go
+	\brief Callbacks from mailgun and twilio, delivery status for what we've sent and texts sent to us
+	Every one is signed by them, we check it, save the event and let a task follow up on it
+*/
+
+package main
+
+import (
+	"github.com/NathanRThomas/boiler_api/cmd"
+	"github.com/NathanRThomas/boiler_api/pkg/models"
+	"github.com/NathanRThomas/boiler_api/pkg/toolz"
+
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- CONSTS ------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+const mailgunTolerance = time.Minute * 15	// how old a signature can be, we remember tokens this long so they can't be replayed
+
+const emptyTwiml = `<?xml version="1.0" encoding="UTF-8"?><Response></Response>`	// we don't reply, twilio answers STOP and HELP itself
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- HELPER FUNCTIONS --------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief The url twilio called, it's part of their signature
+	We're usually behind a load balancer, so this comes from the config when it's set
+*/
+func twilioUrl (r *http.Request) string {
+	base := strings.TrimRight (cmd.CFG.Twilio.CallbackUrl, "/")
+	if len(base) == 0 {
+		scheme := "http"
+		if r.TLS != nil || r.Header.Get ("X-Forwarded-Proto") == "https" { scheme = "https" }
+		base = scheme + "://" + r.Host
+	}
+	return base + r.URL.RequestURI()
+}
+
+/*! \brief Checks the twilio signature and returns the params they posted, writes the error if it's not good
+*/
+func (this *app_c) twilioForm (w http.ResponseWriter, r *http.Request) (url.Values, bool) {
+	form, _ := r.Context().Value("form").(url.Values)
+
+	if err := this.twilio.VerifySignature (cmd.CFG.Twilio.Token, twilioUrl (r), form, r.Header.Get (toolz.TwilioHeader_signature)); err != nil {
+		this.Logger(r.Context()).Warn ("invalid twilio signature", "error", err, "url", twilioUrl (r))
+		this.Forbidden (w, "Invalid signature")
+		return nil, false
+	}
+	return form, true
+}
+
+/*! \brief Everything they posted, for the record
+*/
+func formData (form url.Values) json.RawMessage {
+	data, _ := json.Marshal (form)
+	return data
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- MAILGUN -----------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief POST /providers/mailgun, their webhook for delivered, failed, complained, unsubscribed etc
+*/
+func (this *app_c) mailgunWebhook (w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	body, _ := ctx.Value("body").([]byte)
+	hook := &toolz.MailgunWebhook_t{}
+	var raw struct {
+		EventData json.RawMessage `json:"event-data"`
+	}
+	if err := json.Unmarshal (body, hook); err != nil { this.ErrorWithMsg (err, w, http.StatusBadRequest, cmd.ApiErrorCode_parsingRequestBody, ""); return }
+	json.Unmarshal (body, &raw)	// can't fail if the one above didn't
+
+	if err := this.mailgun.VerifyWebhook (cmd.CFG.Mailgun.WebhookKey, hook.Signature, mailgunTolerance); err != nil {
+		this.Logger(ctx).Warn ("invalid mailgun signature", "error", err)
+		this.Forbidden (w, "Invalid signature")
+		return
+	}
+
+	// shared through redis, a replay to any of our instances gets turned away
+	fresh, err := this.Redis.ProviderTokenClaim (ctx, models.Provider_mailgun, hook.Signature.Token, int(mailgunTolerance / time.Second))
+	if err != nil { this.ServerError (err, cmd.ApiErrorCode_internal, w); return }	// they retry, better than letting a replay through
+	if !fresh { this.Forbidden (w, "Signature already used"); return }
+
+	ed := hook.EventData
+	e := &models.ProviderEvent_t { Provider: models.Provider_mailgun, Event: ed.Event, ProviderID: ed.ID, Recipient: ed.Recipient, Data: raw.EventData }
+	e.Attr.Severity, e.Attr.Reason = ed.Severity, ed.Reason
+	e.Attr.Code, e.Attr.Message = ed.DeliveryStatus.Code, ed.DeliveryStatus.Message
+	if len(e.ProviderID) == 0 { e.ProviderID = hook.Signature.Token }	// every event should have an id, but just in case
+
+	err = this.SaveProviderEvent (ctx, e)
+	if err != nil { this.Redis.ProviderTokenRelease (ctx, models.Provider_mailgun, hook.Signature.Token) }	// so their retry works
+	this.Respond (err, w, nil)
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- TWILIO ------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief POST /providers/twilio/status, the status callback for the texts we send
+*/
+func (this *app_c) twilioStatus (w http.ResponseWriter, r *http.Request) {
+	form, ok := this.twilioForm (w, r)
+	if !ok { return }
+
+	e := &models.ProviderEvent_t { Provider: models.Provider_twilio, Event: form.Get ("MessageStatus"), ProviderID: form.Get ("MessageSid"),
+		Recipient: form.Get ("To"), Data: formData (form) }
+	e.Attr.Code, _ = strconv.Atoi (form.Get ("ErrorCode"))
+	e.Attr.Message = form.Get ("ErrorMessage")
+
+	if len(e.Event) == 0 || len(e.ProviderID) == 0 { this.MissingParam (w, "MessageSid and MessageStatus are required"); return }
+	this.Respond (this.SaveProviderEvent (r.Context(), e), w, nil)
+}
+
+/*! \brief POST /providers/twilio/inbound, texts sent to one of our numbers
+*/
+func (this *app_c) twilioInbound (w http.ResponseWriter, r *http.Request) {
+	form, ok := this.twilioForm (w, r)
+	if !ok { return }
+
+	e := &models.ProviderEvent_t { Provider: models.Provider_twilio, Event: models.ProviderEvent_inbound, ProviderID: form.Get ("MessageSid"),
+		Recipient: form.Get ("From"), Data: formData (form) }
+	e.Attr.Body = form.Get ("Body")
+	e.Attr.OptOut = this.twilio.OptOut (form.Get ("OptOutType"), e.Attr.Body)
+
+	if len(e.ProviderID) == 0 { this.MissingParam (w, "MessageSid is required"); return }
+	if err := this.SaveProviderEvent (r.Context(), e); err != nil { this.ServerError (err, cmd.ApiErrorCode_dbError, w); return }
+
+	w.Header().Set ("Content-Type", "text/xml")
+	w.Write ([]byte(emptyTwiml))
+}
@@ -1,34 +1,53 @@
-/*! \file routes.go
-	\brief Pulls out the routing of the urls to functions
-*/
-
-package main
-
-import (
-	//"fmt"
-	"net/http"
-)
-
-  //-------------------------------------------------------------------------------------------------------------------------//
- //----- MIDDLEWARE --------------------------------------------------------------------------------------------------------//
-//-------------------------------------------------------------------------------------------------------------------------//
-
-func (this *app_c) notFound (w http.ResponseWriter, r *http.Request) {
-	http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
-}
-
-
-  //-------------------------------------------------------------------------------------------------------------------------//
- //----- ROUTES ------------------------------------------------------------------------------------------------------------//
-//-------------------------------------------------------------------------------------------------------------------------//
-
-/*! \brief Define our routes for this service
-	this one is pretty simple, just a 404 for any other endpoints
-*/
-func (this *app_c) routes () http.Handler {
-	mux := this.Routes () // get our base mux for handling things
-
-	mux.HandleFunc("/", this.notFound)	// just return 404
-	
-    return mux
-}
+/*! \file routes.go
+	\brief Pulls out the routing of the urls to functions
+*/
+
+package main
+
+import (
+	"github.com/NathanRThomas/boiler_api/cmd"
+
+	//"fmt"
+	"net/http"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- MIDDLEWARE --------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+func (this *app_c) notFound (w http.ResponseWriter, r *http.Request) {
+	http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+}
+
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- ROUTES ------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Define our routes for this service
+	this one is pretty simple, callbacks from our providers and a 404 for any other endpoints
+*/
+func (this *app_c) routes () http.Handler {
+	mux := this.Routes () // get our base mux for handling things
+
+	providers := this.ProviderChain()	// these check their own signatures
+
+	this.Describe (mux.Handle("/providers/mailgun", providers.ThenFunc (this.mailgunWebhook)).Methods(http.MethodPost), cmd.RouteOpts_t {
+		Summary: "Mailgun webhook for delivery events, signed with the Mailgun.WebhookKey", Tags: []string{"providers"},
+		MaxBody: 256 << 10, ContentTypes: []string{ cmd.ContentType_json },
+	})
+
+	this.Describe (mux.Handle("/providers/twilio/status", providers.ThenFunc (this.twilioStatus)).Methods(http.MethodPost), cmd.RouteOpts_t {
+		Summary: "Twilio status callback for the texts we send, signed with X-Twilio-Signature", Tags: []string{"providers"},
+		MaxBody: 64 << 10, ContentTypes: []string{ cmd.ContentType_form },
+	})
+
+	this.Describe (mux.Handle("/providers/twilio/inbound", providers.ThenFunc (this.twilioInbound)).Methods(http.MethodPost), cmd.RouteOpts_t {
+		Summary: "Twilio webhook for texts sent to our numbers, STOP and START change whether we can text them", Tags: []string{"providers"},
+		MaxBody: 64 << 10, ContentTypes: []string{ cmd.ContentType_form },
+	})
+
+	mux.HandleFunc("/", this.notFound)	// just return 404
+	
+    return mux
+}
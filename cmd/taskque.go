@@ -0,0 +1,212 @@
+/*! \file taskque.go
+	\brief Where queued tasks wait for a worker. Redis is shared by every instance and survives restarts,
+	the in-memory channel is only seen by the instance that queued it and is meant for running locally
+*/
+
+package cmd
+
+import (
+	"github.com/NathanRThomas/boiler_api/pkg/models"
+	"github.com/NathanRThomas/boiler_api/pkg/models/redis"
+
+	"github.com/pkg/errors"
+
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- DEFINES -----------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+const (
+	TaskBackend_memory		= "memory"
+	TaskBackend_redis		= "redis"
+
+	defaultVisibility		= ContextTimeout * 2	// seconds a popped task is ours before someone else can have it
+	quePollInterval			= time.Millisecond * 250	// how often we check redis when it's empty
+	queRecoverBatch			= 500	// most orphans we put back in a single pass
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- TYPES -------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+//! A backend for the task que
+type TaskQue_i interface {
+	Push (ctx context.Context, que *models.Que_t) error
+	Pop (ctx context.Context, visibility time.Duration) (*models.Que_t, error)	// waits for a task, nil if the context ended first. ErrType_queClosed once it's closed
+	Extend (ctx context.Context, que *models.Que_t, visibility time.Duration) error	// for tasks that need longer than they were popped with
+	Ack (ctx context.Context, que *models.Que_t) error	// we're done with it, it won't come back
+	Retry (ctx context.Context, que *models.Que_t, delay time.Duration) error	// instead of an ack, it comes back once the delay is up
+	Recover (ctx context.Context) (int, error)	// puts tasks whose worker died, and retries that are due, back in the que
+	Len (ctx context.Context) int	// waiting for a worker
+	Cap () int	// most it can hold, zero when there's no fixed limit
+	Local () bool	// true when only this instance sees what's queued, so it has to work them itself
+	Close () error	// nothing more can be pushed, pops end once the local que is empty
+}
+
+//----- MEMORY -----//
+type memoryQue_c struct {
+	mtx		sync.RWMutex
+	ch		chan *models.Que_t
+	closed	bool
+	lost	func (*models.Que_t, error)	// a retry we couldn't push back once its delay was up
+}
+
+//----- REDIS -----//
+type redisQue_c struct {
+	db		*redis.DB_c
+	closed	chan struct{}
+	once	sync.Once
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- MEMORY ------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+func NewMemoryQue (size int, lost func (*models.Que_t, error)) *memoryQue_c {
+	return &memoryQue_c { ch: make(chan *models.Que_t, size), lost: lost }
+}
+
+/*! \brief Doesn't block the caller if we're backed up, it's an error instead
+*/
+func (this *memoryQue_c) Push (ctx context.Context, que *models.Que_t) error {
+	this.mtx.RLock()
+	defer this.mtx.RUnlock()
+	if this.closed { return errors.Wrapf (models.ErrType_queClosed, "%+v", que) }
+
+	select {
+	case this.ch <- que:
+		return nil
+	default:
+		return errors.Wrapf (models.ErrType_queFull, "%+v", que)
+	}
+}
+
+func (this *memoryQue_c) Pop (ctx context.Context, visibility time.Duration) (*models.Que_t, error) {
+	select {
+	case que, ok := <-this.ch:
+		if !ok { return nil, errors.WithStack (models.ErrType_queClosed) }
+		return que, nil
+	case <-ctx.Done():
+		return nil, nil
+	}
+}
+
+func (this *memoryQue_c) Extend (ctx context.Context, que *models.Que_t, visibility time.Duration) error { return nil }	// nobody else can see it
+func (this *memoryQue_c) Ack (ctx context.Context, que *models.Que_t) error { return nil }
+
+/*! \brief Pushes it back once the delay is up
+	If the que is full or closed by then it goes to lost, so it isn't just dropped
+*/
+func (this *memoryQue_c) Retry (ctx context.Context, que *models.Que_t, delay time.Duration) error {
+	time.AfterFunc (delay, func() {
+		if err := this.Push (context.Background(), que); err != nil && this.lost != nil { this.lost (que, err) }
+	})
+	return nil
+}
+
+func (this *memoryQue_c) Recover (ctx context.Context) (int, error) { return 0, nil }	// if we died, so did everything in it
+func (this *memoryQue_c) Len (ctx context.Context) int { return len(this.ch) }
+func (this *memoryQue_c) Cap () int { return cap(this.ch) }
+func (this *memoryQue_c) Local () bool { return true }
+
+func (this *memoryQue_c) Close () error {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+	if !this.closed {
+		this.closed = true
+		close (this.ch)
+	}
+	return nil
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- REDIS -------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+func NewRedisQue (db *redis.DB_c) *redisQue_c {
+	return &redisQue_c { db: db, closed: make(chan struct{}) }
+}
+
+func (this *redisQue_c) Push (ctx context.Context, que *models.Que_t) error {
+	select {
+	case <-this.closed:
+		return errors.Wrapf (models.ErrType_queClosed, "%+v", que)
+	default:
+	}
+	return this.db.QuePush (ctx, que.ID, que)
+}
+
+/*! \brief Polls redis until there's a task, the context ends or we're closed
+	Whatever's left in redis when we close stays there for the other instances, or for us when we're back
+*/
+func (this *redisQue_c) Pop (ctx context.Context, visibility time.Duration) (*models.Que_t, error) {
+	for {
+		select {
+		case <-this.closed:
+			return nil, errors.WithStack (models.ErrType_queClosed)
+		case <-ctx.Done():
+			return nil, nil
+		default:
+		}
+
+		id, raw, err := this.db.QuePop (ctx, visibility)
+		switch errors.Cause (err) {
+		case nil:
+			que := &models.Que_t{}
+			if err = json.Unmarshal (raw, que); err != nil { return nil, this.deadLetter (ctx, id, raw, errors.Wrapf (err, "%s : %s", id, raw)) }
+			que.ID = id	// what we ack it with
+			return que, nil
+
+		case redis.ErrKeyNotFound: // nothing waiting, check again in a bit
+		default:
+			return nil, err
+		}
+
+		select {
+		case <-this.closed:
+		case <-ctx.Done():
+		case <-time.After (quePollInterval):
+		}
+	}
+}
+
+/*! \brief For a task we popped but can't read, it would just fail again. It's dead lettered as it was so it isn't lost, then acked
+	If the dead letter doesn't save it stays leased, and comes back for another try once the lease is up
+*/
+func (this *redisQue_c) deadLetter (ctx context.Context, id string, raw []byte, reason error) error {
+	task := json.RawMessage (raw)
+	if !json.Valid (raw) { task, _ = json.Marshal (string(raw)) }	// it has to be json to be stored, this way it can still be looked at
+
+	if err := this.db.PushDeadLetter (ctx, &redis.DeadLetter_t { Task: task, Error: reason.Error(), Stack: errStack (reason) }); err != nil {
+		return errors.Wrap (err, reason.Error())
+	}
+	if err := this.db.QueAck (ctx, id); err != nil { return err }
+	return errors.Wrap (reason, "dead lettered a task we couldn't read")
+}
+
+func (this *redisQue_c) Extend (ctx context.Context, que *models.Que_t, visibility time.Duration) error {
+	return this.db.QueExtend (ctx, que.ID, visibility)
+}
+
+func (this *redisQue_c) Ack (ctx context.Context, que *models.Que_t) error {
+	return this.db.QueAck (ctx, que.ID)
+}
+
+func (this *redisQue_c) Retry (ctx context.Context, que *models.Que_t, delay time.Duration) error {
+	return this.db.QueRetry (ctx, que.ID, que, delay)
+}
+
+func (this *redisQue_c) Recover (ctx context.Context) (int, error) { return this.db.QueRecover (ctx, queRecoverBatch) }
+func (this *redisQue_c) Len (ctx context.Context) int { return this.db.QueLen (ctx) }
+func (this *redisQue_c) Cap () int { return 0 }
+func (this *redisQue_c) Local () bool { return false }
+
+func (this *redisQue_c) Close () error {
+	this.once.Do (func() { close (this.closed) })
+	return nil
+}
@@ -0,0 +1,314 @@
+/*! \file tasks.go
+	\brief Registry of task and schedule handlers, so products add their work without editing the shared que code
+	Register from an init, or from main before StartTaskQue. ie
+
+	cmd.RegisterTask (QueTask_report, "report", func (ctx context.Context, app *cmd.App_c, que *models.Que_t) error { ... }, cmd.TaskOpts_t { Concurrency: 2 })
+
+	Tasks with a payload are registered with RegisterPayloadTask, and queued with the PayloadTask_t it returns so the payload is checked before it's queued
+*/
+
+package cmd
+
+import (
+	"github.com/NathanRThomas/boiler_api/pkg/models"
+	"github.com/NathanRThomas/boiler_api/pkg/models/redis"
+
+	"github.com/pkg/errors"
+
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- DEFINES -----------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+const (
+	defaultTaskAttempts		= 3
+	defaultTaskBackoff		= time.Second * 30
+	defaultTaskMaxBackoff	= time.Hour
+	defaultMaxPayload		= 64 << 10	// bytes, payloads are meant to point at data not carry it
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- TYPES -------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+//! Handles a single task, the app is passed in so packages can register these from their init
+type TaskHandler_f func (ctx context.Context, app *App_c, que *models.Que_t) error
+
+//! Handles a single schedule from the schedules table
+type ScheduleHandler_f func (ctx context.Context, app *App_c, sched *models.Schedule_t) error
+
+type TaskOpts_t struct {
+	Timeout time.Duration	// how long a single run can take, defaults to ContextTimeout
+	Concurrency int			// most of these running at once on this instance, zero is only limited by our worker count
+	MaxAttempts int			// runs before we give up and dead letter it, defaults to 3. 1 never retries
+	Backoff time.Duration	// wait before the first retry, doubled for each one after that. defaults to 30 seconds
+	MaxBackoff time.Duration	// longest we'll wait between runs, defaults to an hour
+}
+
+type taskHandler_c struct {
+	name	string
+	fn		TaskHandler_f
+	opts	TaskOpts_t
+	slots	chan struct{}	// nil when there's no limit
+	check	func (que *models.Que_t) error	// checks the payload decodes before it's queued, nil for tasks without one
+}
+
+//! A task type with a payload of T, so the two can't be mixed up when it's queued or decoded
+type PayloadTask_t[T any] struct {
+	Type models.QueTask
+}
+
+type scheduleHandler_t struct {
+	name	string
+	fn		ScheduleHandler_f
+	opts	TaskOpts_t
+}
+
+var handlers = struct {
+	sync.RWMutex
+	tasks		map[models.QueTask]*taskHandler_c
+	schedules	map[models.ScheduleType]*scheduleHandler_t
+} { tasks: make(map[models.QueTask]*taskHandler_c), schedules: make(map[models.ScheduleType]*scheduleHandler_t) }
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- LOCAL FUNCTIONS ---------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Returns the handler for the task type, nil if we don't have one
+	The functions on the handler are safe to call on nil, so unknown types get our defaults
+*/
+func taskHandler (taskType models.QueTask) *taskHandler_c {
+	handlers.RLock()
+	defer handlers.RUnlock()
+	return handlers.tasks[taskType]
+}
+
+func (this *taskHandler_c) label (taskType models.QueTask) string {
+	if this == nil { return fmt.Sprintf("%d", taskType) }
+	return this.name
+}
+
+func (this *taskHandler_c) timeout () time.Duration {
+	if this == nil || this.opts.Timeout <= 0 { return time.Second * ContextTimeout }
+	return this.opts.Timeout
+}
+
+func (this *taskHandler_c) maxAttempts () int {
+	if this == nil || this.opts.MaxAttempts <= 0 { return defaultTaskAttempts }
+	return this.opts.MaxAttempts
+}
+
+/*! \brief How long to wait before running it again, doubles with each attempt up to the max
+	Only half of it is fixed, the rest is random so a batch that failed together doesn't all come back together
+*/
+func (this *taskHandler_c) backoff (attempts int) time.Duration {
+	delay, max := defaultTaskBackoff, defaultTaskMaxBackoff
+	if this != nil && this.opts.Backoff > 0 { delay = this.opts.Backoff }
+	if this != nil && this.opts.MaxBackoff > 0 { max = this.opts.MaxBackoff }
+
+	for i := 1; i < attempts && delay < max; i++ { delay *= 2 }
+	if delay > max { delay = max }
+
+	half := delay / 2
+	return half + time.Duration (rand.Int63n (int64(delay - half) + 1))
+}
+
+/*! \brief Makes sure the payload is one the handler can decode, so the caller finds out rather than a worker
+*/
+func (this *taskHandler_c) checkPayload (que *models.Que_t) error {
+	if this == nil || this.check == nil { return nil }
+	return this.check (que)
+}
+
+/*! \brief Takes a slot when the handler has a concurrency limit, false if they're all in use
+	The worker puts the task back when this fails, so one busy handler can't tie up every worker
+*/
+func (this *taskHandler_c) tryAcquire () bool {
+	if this == nil || this.slots == nil { return true }
+	select {
+	case this.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+/*! \brief Waits for a slot, only for when we couldn't put the task back
+*/
+func (this *taskHandler_c) acquire () {
+	if this == nil || this.slots == nil { return }
+	this.slots <- struct{}{}
+}
+
+func (this *taskHandler_c) release () {
+	if this == nil || this.slots == nil { return }
+	<-this.slots
+}
+
+/*! \brief Puts a task we can't handle, or gave up on, on the dead letter list with the error from its last run
+	So it isn't just lost in the logs, and it can be replayed once whatever was wrong is fixed
+*/
+func (this *App_c) deadLetter (ctx context.Context, que *models.Que_t, reason error) {
+	if this.Redis == nil { return }
+
+	jTask, err := json.Marshal (que)
+	if err != nil { this.StackTraceCtx (ctx, errors.WithStack (err)); return }
+
+	dl := &redis.DeadLetter_t { Task: jTask }
+	if reason != nil {
+		dl.Error = reason.Error()
+		dl.Stack = errStack (reason)
+	}
+
+	ctx, cancel := context.WithTimeout (context.WithoutCancel (ctx), time.Second * 5)	// the task's context may be what timed out
+	defer cancel()
+	this.StackTraceCtx (ctx, this.Redis.PushDeadLetter (ctx, dl))
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PUBLIC FUNCTIONS --------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Adds the handler for a task type, registering the same type again replaces it
+	Types defined outside of this package should start at models.QueTask_app so they never collide with ours
+*/
+func RegisterTask (taskType models.QueTask, name string, fn TaskHandler_f, opts TaskOpts_t) {
+	registerTask (taskType, &taskHandler_c { name: name, fn: fn, opts: opts })
+}
+
+func registerTask (taskType models.QueTask, h *taskHandler_c) {
+	if h.opts.Concurrency > 0 { h.slots = make(chan struct{}, h.opts.Concurrency) }
+
+	handlers.Lock()
+	defer handlers.Unlock()
+	handlers.tasks[taskType] = h
+}
+
+/*! \brief Adds a handler that gets the task's payload decoded into a T for it
+	A payload that doesn't decode, or doesn't pass its validate tags, is an error and the handler isn't called
+	Returns the task type for queueing it with a T
+*/
+func RegisterPayloadTask[T any] (taskType models.QueTask, name string, fn func (ctx context.Context, app *App_c, que *models.Que_t, payload *T) error, opts TaskOpts_t) PayloadTask_t[T] {
+	registerTask (taskType, &taskHandler_c { name: name, opts: opts,
+		fn: func (ctx context.Context, app *App_c, que *models.Que_t) error {
+			payload, err := DecodePayloadAs[T] (que)
+			if err != nil { return err }
+			return fn (ctx, app, que, payload)
+		},
+		check: func (que *models.Que_t) error {
+			return decodePayload (que, new(T))
+		},
+	})
+	return PayloadTask_t[T] { Type: taskType }
+}
+
+/*! \brief Adds the handler for a schedule type, registering the same type again replaces it
+	Only the Timeout option applies, schedules are run one at a time by the queen
+*/
+func RegisterSchedule (schedType models.ScheduleType, name string, fn ScheduleHandler_f, opts TaskOpts_t) {
+	handlers.Lock()
+	defer handlers.Unlock()
+	handlers.schedules[schedType] = &scheduleHandler_t { name: name, fn: fn, opts: opts }
+}
+
+/*! \brief Reads the payload into out and checks its validate tags
+	Payloads from an older version go through its upgrade, when it has one, otherwise they're read as they are
+*/
+func decodePayload (que *models.Que_t, out interface{}) error {
+	if len(que.Payload) == 0 { return errors.Errorf ("task %d is missing its payload", que.Type) }
+
+	version := payloadVersion (out)
+	if que.Version > version { return errors.Wrapf (models.ErrType_payloadVersion, "task %d payload is version %d, we know %d", que.Type, que.Version, version) }
+
+	if up, ok := out.(models.PayloadUpgrade_i); ok && que.Version < version {
+		if err := up.UpgradePayload (que.Version, que.Payload); err != nil { return errors.Wrapf (err, "task %d payload upgrading from version %d", que.Type, que.Version) }
+	} else {
+		dec := json.NewDecoder (bytes.NewReader (que.Payload))
+		dec.DisallowUnknownFields()	// we queued it, so anything extra means the two sides don't agree on what it is
+		if err := dec.Decode (out); err != nil { return errors.Wrapf (err, "task %d payload", que.Type) }
+	}
+
+	return errors.Wrapf (models.Validate (out), "task %d payload", que.Type)
+}
+
+/*! \brief Schema version of the payload, zero for ones that don't have one
+*/
+func payloadVersion (payload interface{}) int {
+	if v, ok := payload.(models.PayloadVersion_i); ok { return v.PayloadVersion() }
+	return 0
+}
+
+/*! \brief Reads the task's payload into out, and checks its validate tags
+	These errors are permanent, the payload won't be any different next time
+	Except for a payload newer than we know, that's retried since it should be fine once this instance is deployed
+*/
+func DecodePayload (que *models.Que_t, out interface{}) error {
+	err := decodePayload (que, out)
+	if err == nil || errors.Cause (err) == models.ErrType_payloadVersion { return err }
+	return errors.Wrap (models.ErrType_taskPermanent, err.Error())
+}
+
+/*! \brief Same as DecodePayload, but returns a new T
+*/
+func DecodePayloadAs[T any] (que *models.Que_t) (*T, error) {
+	payload := new(T)
+	if err := DecodePayload (que, payload); err != nil { return nil, err }
+	return payload, nil
+}
+
+/*! \brief Adds the payload to the task and queues it
+	The payload is checked against its validate tags here, so the caller finds out it's bad rather than a worker
+*/
+func Enqueue[T any] (ctx context.Context, app *App_c, que *models.Que_t, payload *T) error {
+	if payload == nil { return errors.Errorf ("task %d is missing its payload", que.Type) }
+	if err := models.Validate (payload); err != nil { return errors.Wrapf (err, "task %d payload", que.Type) }
+
+	jPayload, err := json.Marshal (payload)
+	if err != nil { return errors.Wrapf (err, "task %d payload", que.Type) }
+
+	que.Payload = jPayload
+	que.Version = payloadVersion (payload)
+	return app.QueTask (ctx, que)
+}
+
+/*! \brief Queues a task of this type with the payload, que can be nil when there's nothing else to set on it
+*/
+func (this PayloadTask_t[T]) Enqueue (ctx context.Context, app *App_c, que *models.Que_t, payload *T) error {
+	if que == nil { que = &models.Que_t{} }
+	que.Type = this.Type
+	return Enqueue (ctx, app, que, payload)
+}
+
+/*! \brief Reads the payload off a task of this type
+*/
+func (this PayloadTask_t[T]) Decode (que *models.Que_t) (*T, error) {
+	if que.Type != this.Type { return nil, errors.Wrapf (models.ErrType_taskPermanent, "task %d isn't a %d", que.Type, this.Type) }
+	return DecodePayloadAs[T] (que)
+}
+
+/*! \brief Runs the handler for the schedule
+*/
+func (this *App_c) RunSchedule (ctx context.Context, sched *models.Schedule_t) error {
+	handlers.RLock()
+	h, ok := handlers.schedules[sched.Type]
+	handlers.RUnlock()
+
+	if !ok { return errors.Wrapf (models.ErrType_taskPermanent, "unknown schedule type :%d", sched.Type) }	// nothing registered for it, trying again won't help
+
+	if h.opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout (ctx, h.opts.Timeout)
+		defer cancel()
+	}
+
+	ctx = this.LogScope (ctx, "schedule", h.name, "schedule_id", sched.ID)
+	return h.fn (ctx, this, sched)
+}
@@ -0,0 +1,148 @@
+/*! \file timeout.go
+	\brief Per-route request timeouts
+	The handler writes into a buffer, so if we time out there's only ever one thing writing to the real response
+*/
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- TYPES -------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+//! Holds onto everything the handler writes until we know if it finished in time
+type timeoutWriter_t struct {
+	http.ResponseWriter			// the real writer, we only touch this once we've finished or timed out
+	mtx			sync.Mutex
+	header		http.Header
+	buf			bytes.Buffer
+	status		int
+	timedOut	bool
+}
+
+func (this *timeoutWriter_t) Header () http.Header {
+	return this.header
+}
+
+func (this *timeoutWriter_t) WriteHeader (status int) {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+	if this.timedOut || this.status != 0 { return }
+	this.status = status
+}
+
+func (this *timeoutWriter_t) Write (b []byte) (int, error) {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+	if this.timedOut { return 0, http.ErrHandlerTimeout } // too late, we already responded
+	if this.status == 0 { this.status = http.StatusOK }
+	return this.buf.Write (b)
+}
+
+func (this *timeoutWriter_t) Unwrap () http.ResponseWriter {
+	return this.ResponseWriter
+}
+
+/*! \brief Copies everything the handler wrote out to the real writer
+*/
+func (this *timeoutWriter_t) flush () {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	dst := this.ResponseWriter.Header()
+	for k, v := range this.header { dst[k] = v }
+
+	if this.status == 0 { this.status = http.StatusOK }
+	this.ResponseWriter.WriteHeader (this.status)
+	this.ResponseWriter.Write (this.buf.Bytes())
+}
+
+/*! \brief Marks us as timed out so anything else the handler writes is dropped
+*/
+func (this *timeoutWriter_t) timeout () {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+	this.timedOut = true
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- LOCAL FUNCTIONS ---------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Returns how long this route is allowed to run for, zero means it doesn't time out
+*/
+func (this *App_c) routeTimeout (r *http.Request) time.Duration {
+	timeout := this.routeOptions (r).Timeout
+	switch {
+	case timeout < 0:
+		return 0 // this route opted out, ie streaming responses
+	case timeout > 0:
+		return timeout
+	case CFG.Timeout.Request > 0:
+		return time.Second * time.Duration (CFG.Timeout.Request)
+	}
+	return time.Second * ContextTimeout
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- LOCAL MIDDLEWARE --------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Cancels the request context once the route's timeout is hit, so any db/redis calls bail, and returns a 503
+*/
+func (this *App_c) requestTimeout (next http.Handler) http.Handler {
+	return http.HandlerFunc (func(w http.ResponseWriter, r *http.Request) {
+		timeout := this.routeTimeout (r)
+		if timeout == 0 {
+			next.ServeHTTP (w, r)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout (r.Context(), timeout)
+		defer cancel()
+
+		tw := &timeoutWriter_t { ResponseWriter: w, header: make(http.Header) }
+		done := make(chan struct{})
+		panicChan := make(chan interface{}, 1)
+
+		go func() {
+			defer func() {
+				if p := recover(); p != nil { panicChan <- fmt.Sprintf("%v\n%s", p, debug.Stack()) } // hand it back so recoverPanic can deal with it
+			}()
+			next.ServeHTTP (tw, r.WithContext (ctx))
+			close (done)
+		}()
+
+		select {
+		case p := <-panicChan:
+			panic (p)
+
+		case <-done:
+			tw.flush()
+
+		case <-ctx.Done():
+			select {
+			case <-done: // it finished right as we timed out, so send what it wrote
+				tw.flush()
+				return
+			default:
+			}
+
+			tw.timeout()
+			if r.Context().Err() != nil { return } // the client went away, no one to respond to
+
+			this.Metrics.Timeout (routeTemplate (r), r.Method)
+			this.Logger(r.Context()).Error ("request timed out", "timeout", timeout, "proto", r.Proto, "uri", r.URL.RequestURI())
+			this.ErrorWithMsg (nil, w, http.StatusServiceUnavailable, ApiErrorCode_requestTimeout, "Request took longer than %s to complete", timeout)
+		}
+	})
+}
@@ -0,0 +1,289 @@
+/*! \file tls.go
+	\brief Serving https ourselves, so we don't need a proxy in front of us for it
+	The certificate is reloaded when the files change or on a SIGHUP, so renewing it doesn't need a restart
+*/
+
+package cmd
+
+import (
+	"github.com/pkg/errors"
+
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- DEFINES -----------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+const defaultCertReload = 60	// seconds between checking the certificate files for changes
+
+const (
+	ClientAuth_optional	= "optional"	// verify a client cert if they send one, this is the default with a ClientCA
+	ClientAuth_require	= "require"		// every caller needs a cert signed by our ClientCA
+)
+
+//! Used when the config doesn't list any ciphers, these only apply to tls 1.2, go picks the ones for 1.3
+var defaultCiphers = []uint16 {
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- TYPES -------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+//! Everything needed to serve https, leave Cert empty to serve plain http
+type TLSConfig_t struct {
+	Cert, Key string		// pem files
+	MinVersion string		// 1.2 or 1.3, defaults to 1.2
+	Ciphers []string		// tls 1.2 cipher suite names, ie TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+	ClientCA string			// pem file of the CAs we accept client certs from, this turns on mtls
+	ClientAuth string		// optional or require
+	Reload int				// seconds between checking the cert files for changes
+	RedirectPort string		// if set we listen here and redirect everything to https
+}
+
+//! Holds our current certificate, swapping it out when the files change
+type CertReloader_c struct {
+	certFile, keyFile string
+
+	mtx		sync.RWMutex
+	cert	*tls.Certificate
+	modTime	time.Time
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- LOCAL FUNCTIONS ---------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief The newer of the two files' modified times, so a change to either one counts
+*/
+func (this *CertReloader_c) lastModified () (time.Time, error) {
+	var out time.Time
+	for _, file := range []string { this.certFile, this.keyFile } {
+		info, err := os.Stat (file)
+		if err != nil { return out, errors.Wrap (err, file) }
+		if info.ModTime().After (out) { out = info.ModTime() }
+	}
+	return out, nil
+}
+
+func tlsVersion (version string) (uint16, error) {
+	switch version {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, errors.Errorf ("tls MinVersion '%s' should be 1.2 or 1.3", version)
+}
+
+/*! \brief Converts the cipher names from the config into their ids, only the ones go considers secure are allowed
+*/
+func tlsCiphers (names []string) ([]uint16, error) {
+	if len(names) == 0 { return defaultCiphers, nil }
+
+	known := make(map[string]uint16)
+	for _, c := range tls.CipherSuites() { known[c.Name] = c.ID }
+
+	out := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := known[strings.TrimSpace (name)]
+		if !ok { return nil, errors.Errorf ("tls cipher '%s' is unknown or insecure", name) }
+		out = append (out, id)
+	}
+	return out, nil
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PUBLIC FUNCTIONS --------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Loads the certificate, returning an error if the files aren't a valid pair
+*/
+func NewCertReloader (certFile, keyFile string) (*CertReloader_c, error) {
+	ret := &CertReloader_c { certFile: certFile, keyFile: keyFile }
+	return ret, ret.Reload()
+}
+
+/*! \brief Reads the certificate files again, we keep using the old one if the new ones don't load
+*/
+func (this *CertReloader_c) Reload () error {
+	modTime, err := this.lastModified()
+	if err != nil { return err }
+
+	cert, err := tls.LoadX509KeyPair (this.certFile, this.keyFile)
+	if err != nil { return errors.Wrapf (err, "%s : %s", this.certFile, this.keyFile) }
+
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+	this.cert = &cert
+	this.modTime = modTime
+	return nil
+}
+
+/*! \brief Reloads the certificate only if the files have changed since we last loaded them
+	Returns true if we loaded a new one
+*/
+func (this *CertReloader_c) ReloadIfChanged () (bool, error) {
+	modTime, err := this.lastModified()
+	if err != nil { return false, err }
+
+	this.mtx.RLock()
+	changed := modTime.After (this.modTime)
+	this.mtx.RUnlock()
+
+	if !changed { return false, nil }
+	return true, this.Reload()
+}
+
+/*! \brief Hands the current certificate to every new connection, this is the tls.Config GetCertificate
+*/
+func (this *CertReloader_c) GetCertificate (*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	this.mtx.RLock()
+	defer this.mtx.RUnlock()
+	return this.cert, nil
+}
+
+/*! \brief Builds the tls config for serving https, with http/2 turned on
+	This doesn't touch CFG, so it can be used with any certs, ie self-signed ones
+*/
+func NewTLSConfig (cfg TLSConfig_t, certs *CertReloader_c) (*tls.Config, error) {
+	minVersion, err := tlsVersion (cfg.MinVersion)
+	if err != nil { return nil, err }
+
+	ciphers, err := tlsCiphers (cfg.Ciphers)
+	if err != nil { return nil, err }
+
+	ret := &tls.Config {
+		MinVersion: minVersion,
+		CipherSuites: ciphers,
+		GetCertificate: certs.GetCertificate,
+		NextProtos: []string { "h2", "http/1.1" },
+	}
+
+	// mtls
+	if len(cfg.ClientCA) > 0 {
+		pem, err := os.ReadFile (cfg.ClientCA)
+		if err != nil { return nil, errors.Wrap (err, cfg.ClientCA) }
+
+		ret.ClientCAs = x509.NewCertPool()
+		if !ret.ClientCAs.AppendCertsFromPEM (pem) { return nil, errors.Errorf ("no certificates found in ClientCA %s", cfg.ClientCA) }
+
+		switch cfg.ClientAuth {
+		case "", ClientAuth_optional:
+			ret.ClientAuth = tls.VerifyClientCertIfGiven
+		case ClientAuth_require:
+			ret.ClientAuth = tls.RequireAndVerifyClientCert
+		default:
+			return nil, errors.Errorf ("tls ClientAuth '%s' should be optional or require", cfg.ClientAuth)
+		}
+	}
+
+	return ret, nil
+}
+
+/*! \brief Loads our certificate from the config and keeps it up to date, nil if we aren't serving https
+	The files are checked for changes every Reload seconds, and a SIGHUP reloads them right away
+*/
+func (this *App_c) StartTLS () (*tls.Config, error) {
+	if len(CFG.TLS.Cert) == 0 { return nil, nil }
+
+	certs, err := NewCertReloader (CFG.TLS.Cert, CFG.TLS.Key)
+	if err != nil { return nil, err }
+
+	ret, err := NewTLSConfig (CFG.TLS, certs)
+	if err != nil { return nil, err }
+	this.tlsConfig = ret // grpc uses this too
+
+	reload := CFG.TLS.Reload
+	if reload <= 0 { reload = defaultCertReload }
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify (hup, syscall.SIGHUP)
+
+	go func() {
+		ticker := time.NewTicker (time.Second * time.Duration (reload))
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				changed, err := certs.ReloadIfChanged()
+				if err != nil {
+					this.StackTrace (err)
+				} else if changed {
+					this.Log.Info ("tls certificate reloaded", "cert", CFG.TLS.Cert)
+				}
+
+			case <-hup:
+				if err := certs.Reload(); err != nil {
+					this.StackTrace (err)
+				} else {
+					this.Log.Info ("tls certificate reloaded", "cert", CFG.TLS.Cert, "signal", "SIGHUP")
+				}
+			}
+		}
+	}()
+
+	return ret, nil
+}
+
+/*! \brief Serves https if the server has a tls config, otherwise plain http
+*/
+func ListenAndServe (srv *http.Server) error {
+	if srv.TLSConfig != nil { return srv.ListenAndServeTLS ("", "") } // the cert comes from the config
+	return srv.ListenAndServe()
+}
+
+/*! \brief If we're serving https and have a redirect port, this starts a server on it sending everyone to https
+*/
+func (this *App_c) ServeRedirect () *http.Server {
+	if len(CFG.TLS.Cert) == 0 || len(CFG.TLS.RedirectPort) == 0 { return nil }
+
+	srv := &http.Server {
+		Addr: ":" + CFG.TLS.RedirectPort,
+		ReadTimeout: 5 * time.Second,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			host := r.Host
+			if h, _, err := net.SplitHostPort (host); err == nil { host = h }
+			if CFG.Port != "443" { host = net.JoinHostPort (host, CFG.Port) }
+
+			http.Redirect (w, r, "https://" + host + r.URL.RequestURI(), http.StatusPermanentRedirect)
+		}),
+	}
+
+	go func() {
+		this.Log.Info ("Starting https redirect server", "port", CFG.TLS.RedirectPort)
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			this.Log.Error ("redirect server ListenAndServe", "error", err)
+		}
+	}()
+
+	return srv
+}
+
+/*! \brief Only lets through callers that presented a client cert signed by our ClientCA, for internal routes
+*/
+func (this *App_c) RequireClientCert (next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			this.Forbidden (w, "A client certificate is required")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
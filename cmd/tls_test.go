@@ -0,0 +1,266 @@
+/*! \file tls_test.go
+	\brief Tests for serving https, using certs we make on the fly so nothing is checked in
+*/
+
+package cmd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- HELPERS -----------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+//! A cert and its key, plus where we wrote them
+type testCert_t struct {
+	cert *x509.Certificate
+	key *ecdsa.PrivateKey
+	certFile, keyFile string
+}
+
+/*! \brief Makes a cert signed by parent, or a self-signed CA when parent is nil, and writes the pem files to dir
+*/
+func newTestCert (t *testing.T, dir, name string, parent *testCert_t) *testCert_t {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey (elliptic.P256(), rand.Reader)
+	if err != nil { t.Fatal (err) }
+
+	serial, err := rand.Int (rand.Reader, big.NewInt (1 << 62))
+	if err != nil { t.Fatal (err) }
+
+	tmpl := &x509.Certificate {
+		SerialNumber: serial,
+		Subject: pkix.Name { CommonName: name },
+		NotBefore: time.Now().Add (-time.Hour),
+		NotAfter: time.Now().Add (time.Hour),
+	}
+
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		tmpl.DNSNames = []string { "localhost" }
+		tmpl.IPAddresses = []net.IP { net.ParseIP ("127.0.0.1") }
+		tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage { x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth }
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate (rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil { t.Fatal (err) }
+
+	cert, err := x509.ParseCertificate (der)
+	if err != nil { t.Fatal (err) }
+
+	keyDer, err := x509.MarshalECPrivateKey (key)
+	if err != nil { t.Fatal (err) }
+
+	ret := &testCert_t { cert: cert, key: key, certFile: filepath.Join (dir, name + ".crt"), keyFile: filepath.Join (dir, name + ".key") }
+	writeTestPem (t, ret.certFile, "CERTIFICATE", der)
+	writeTestPem (t, ret.keyFile, "EC PRIVATE KEY", keyDer)
+	return ret
+}
+
+func writeTestPem (t *testing.T, file, kind string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile (file, pem.EncodeToMemory (&pem.Block { Type: kind, Bytes: der }), 0600); err != nil { t.Fatal (err) }
+}
+
+/*! \brief What a client needs to talk to a server using our certs, pass a cert for mtls
+*/
+func testClient (ca *testCert_t, client *testCert_t) *http.Client {
+	pool := x509.NewCertPool()
+	pool.AddCert (ca.cert)
+
+	cfg := &tls.Config { RootCAs: pool, ServerName: "localhost" }	// sending a server name makes the server use GetCertificate
+	if client != nil {
+		cfg.Certificates = []tls.Certificate {{ Certificate: [][]byte { client.cert.Raw }, PrivateKey: client.key }}
+	}
+
+	return &http.Client {
+		Timeout: time.Second * 5,
+		Transport: &http.Transport { TLSClientConfig: cfg, ForceAttemptHTTP2: true },
+	}
+}
+
+/*! \brief Starts a test server using our tls config, the handler replies with the protocol it was reached over
+*/
+func testTLSServer (t *testing.T, cfg *tls.Config, handler http.Handler) *httptest.Server {
+	t.Helper()
+
+	if handler == nil {
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write ([]byte(r.Proto)) })
+	}
+
+	srv := httptest.NewUnstartedServer (handler)
+	srv.EnableHTTP2 = true
+	srv.TLS = cfg
+	srv.StartTLS()
+	t.Cleanup (srv.Close)
+	return srv
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- TESTS -------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+func TestCertReloader (t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert (t, dir, "ca", nil)
+	first := newTestCert (t, dir, "server", ca)
+
+	certs, err := NewCertReloader (first.certFile, first.keyFile)
+	if err != nil { t.Fatal (err) }
+
+	current := func () *x509.Certificate {
+		c, err := certs.GetCertificate (nil)
+		if err != nil { t.Fatal (err) }
+		leaf, err := x509.ParseCertificate (c.Certificate[0])
+		if err != nil { t.Fatal (err) }
+		return leaf
+	}
+	if !current().Equal (first.cert) { t.Fatal ("didn't load the first cert") }
+
+	changed, err := certs.ReloadIfChanged()
+	if err != nil || changed { t.Fatalf ("nothing changed, but got changed %v : %v", changed, err) }
+
+	// renew it, pushing the mod time forward since the filesystem might not tick between writes
+	second := newTestCert (t, dir, "server", ca)
+	later := time.Now().Add (time.Minute)
+	for _, f := range []string { second.certFile, second.keyFile } {
+		if err := os.Chtimes (f, later, later); err != nil { t.Fatal (err) }
+	}
+
+	changed, err = certs.ReloadIfChanged()
+	if err != nil || !changed { t.Fatalf ("expected a reload, got changed %v : %v", changed, err) }
+	if !current().Equal (second.cert) { t.Fatal ("still serving the old cert after a reload") }
+
+	// a bad renewal keeps what we had
+	if err := os.WriteFile (second.certFile, []byte("not a cert"), 0600); err != nil { t.Fatal (err) }
+	later = later.Add (time.Minute)
+	if err := os.Chtimes (second.certFile, later, later); err != nil { t.Fatal (err) }
+
+	if _, err = certs.ReloadIfChanged(); err == nil { t.Fatal ("expected an error loading a bad cert") }
+	if !current().Equal (second.cert) { t.Fatal ("a bad cert replaced the good one") }
+
+	if _, err = NewCertReloader (second.certFile, second.keyFile); err == nil { t.Fatal ("expected an error for a bad cert") }
+	if _, err = NewCertReloader (filepath.Join (dir, "missing.crt"), second.keyFile); err == nil { t.Fatal ("expected an error for a missing cert") }
+}
+
+func TestNewTLSConfig (t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert (t, dir, "ca", nil)
+	server := newTestCert (t, dir, "server", ca)
+
+	certs, err := NewCertReloader (server.certFile, server.keyFile)
+	if err != nil { t.Fatal (err) }
+
+	tests := []struct {
+		name string
+		cfg TLSConfig_t
+		auth tls.ClientAuthType
+		minVersion uint16
+		err bool
+	}{
+		{ name: "defaults", cfg: TLSConfig_t{}, auth: tls.NoClientCert, minVersion: tls.VersionTLS12 },
+		{ name: "tls 1.3", cfg: TLSConfig_t { MinVersion: "1.3" }, auth: tls.NoClientCert, minVersion: tls.VersionTLS13 },
+		{ name: "bad version", cfg: TLSConfig_t { MinVersion: "1.1" }, err: true },
+		{ name: "bad cipher", cfg: TLSConfig_t { Ciphers: []string { "TLS_RSA_WITH_RC4_128_SHA" }}, err: true },
+		{ name: "mtls default", cfg: TLSConfig_t { ClientCA: ca.certFile }, auth: tls.VerifyClientCertIfGiven, minVersion: tls.VersionTLS12 },
+		{ name: "mtls optional", cfg: TLSConfig_t { ClientCA: ca.certFile, ClientAuth: ClientAuth_optional }, auth: tls.VerifyClientCertIfGiven, minVersion: tls.VersionTLS12 },
+		{ name: "mtls require", cfg: TLSConfig_t { ClientCA: ca.certFile, ClientAuth: ClientAuth_require }, auth: tls.RequireAndVerifyClientCert, minVersion: tls.VersionTLS12 },
+		{ name: "mtls bad auth", cfg: TLSConfig_t { ClientCA: ca.certFile, ClientAuth: "sometimes" }, err: true },
+		{ name: "mtls missing ca", cfg: TLSConfig_t { ClientCA: filepath.Join (dir, "missing.crt") }, err: true },
+		{ name: "mtls ca isn't pem", cfg: TLSConfig_t { ClientCA: server.keyFile }, err: true },
+	}
+
+	for _, tt := range tests {
+		t.Run (tt.name, func (t *testing.T) {
+			cfg, err := NewTLSConfig (tt.cfg, certs)
+			if tt.err {
+				if err == nil { t.Fatal ("expected an error") }
+				return
+			}
+			if err != nil { t.Fatal (err) }
+
+			if cfg.ClientAuth != tt.auth { t.Errorf ("ClientAuth %v, expected %v", cfg.ClientAuth, tt.auth) }
+			if cfg.MinVersion != tt.minVersion { t.Errorf ("MinVersion %x, expected %x", cfg.MinVersion, tt.minVersion) }
+			if len(cfg.NextProtos) == 0 || cfg.NextProtos[0] != "h2" { t.Errorf ("h2 isn't offered first : %v", cfg.NextProtos) }
+		})
+	}
+}
+
+func TestTLSHandshake (t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert (t, dir, "ca", nil)
+	server := newTestCert (t, dir, "server", ca)
+	client := newTestCert (t, dir, "client", ca)
+
+	certs, err := NewCertReloader (server.certFile, server.keyFile)
+	if err != nil { t.Fatal (err) }
+
+	get := func (t *testing.T, srv *httptest.Server, c *http.Client) (*http.Response, error) {
+		t.Helper()
+		resp, err := c.Get (srv.URL)
+		if err == nil { t.Cleanup (func() { resp.Body.Close() }) }
+		return resp, err
+	}
+
+	t.Run ("h2", func (t *testing.T) {
+		cfg, err := NewTLSConfig (TLSConfig_t{}, certs)
+		if err != nil { t.Fatal (err) }
+		srv := testTLSServer (t, cfg, nil)
+
+		resp, err := get (t, srv, testClient (ca, nil))
+		if err != nil { t.Fatal (err) }
+		if resp.ProtoMajor != 2 { t.Fatalf ("expected http/2, got %s", resp.Proto) }
+		if resp.TLS == nil || resp.TLS.NegotiatedProtocol != "h2" { t.Fatal ("h2 wasn't negotiated") }
+	})
+
+	t.Run ("mtls require", func (t *testing.T) {
+		cfg, err := NewTLSConfig (TLSConfig_t { ClientCA: ca.certFile, ClientAuth: ClientAuth_require }, certs)
+		if err != nil { t.Fatal (err) }
+		srv := testTLSServer (t, cfg, nil)
+
+		if _, err = get (t, srv, testClient (ca, nil)); err == nil { t.Fatal ("connected without a client cert") }
+
+		resp, err := get (t, srv, testClient (ca, client))
+		if err != nil { t.Fatal (err) }
+		if resp.StatusCode != http.StatusOK { t.Fatalf ("status %d", resp.StatusCode) }
+	})
+
+	t.Run ("mtls optional", func (t *testing.T) {
+		cfg, err := NewTLSConfig (TLSConfig_t { ClientCA: ca.certFile, ClientAuth: ClientAuth_optional }, certs)
+		if err != nil { t.Fatal (err) }
+
+		app := &App_c{}
+		srv := testTLSServer (t, cfg, app.RequireClientCert (http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+		// the handshake works without a cert, but the internal routes turn them away
+		resp, err := get (t, srv, testClient (ca, nil))
+		if err != nil { t.Fatal (err) }
+		if resp.StatusCode != http.StatusForbidden { t.Fatalf ("expected a 403 without a client cert, got %d", resp.StatusCode) }
+
+		resp, err = get (t, srv, testClient (ca, client))
+		if err != nil { t.Fatal (err) }
+		if resp.StatusCode != http.StatusOK { t.Fatalf ("expected a 200 with a client cert, got %d", resp.StatusCode) }
+	})
+}
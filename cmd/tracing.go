@@ -0,0 +1,124 @@
+/*! \file tracing.go
+	\brief OpenTelemetry tracing setup, shared by the api and task services
+	Exports over OTLP, or to stdout for local development
+*/
+
+package cmd
+
+import (
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+
+	"context"
+	"net/http"
+	"strings"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- DEFINES -----------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+const (
+	TraceExporter_none		= ""
+	TraceExporter_otlp		= "otlp"
+	TraceExporter_stdout	= "stdout"
+)
+
+var tracer = otel.Tracer ("github.com/NathanRThomas/boiler_api/cmd")
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- MIDDLEWARE --------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Starts the server span for the request, picking up any trace that was passed in with the headers
+*/
+func (this *App_c) tracing (next http.Handler) http.Handler {
+	return http.HandlerFunc (func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract (r.Context(), propagation.HeaderCarrier (r.Header))
+		route := routeTemplate (r)
+
+		ctx, span := tracer.Start (ctx, r.Method + " " + route, trace.WithSpanKind (trace.SpanKindServer),
+			trace.WithAttributes (attribute.String ("http.method", r.Method), attribute.String ("http.route", route),
+				attribute.String ("http.target", r.URL.RequestURI())))
+		defer span.End()
+
+		if span.SpanContext().IsValid() { this.LogWith (ctx, "trace_id", span.SpanContext().TraceID().String()) }
+
+		next.ServeHTTP (w, r.WithContext (ctx))
+
+		if aw := findApiWriter (w); aw != nil {
+			span.SetAttributes (attribute.Int ("http.status_code", aw.Status()))
+			if aw.Status() >= http.StatusInternalServerError { span.SetStatus (codes.Error, http.StatusText (aw.Status())) }
+		}
+	})
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PUBLIC FUNCTIONS --------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Starts a span from our shared tracer, for the places that don't have their own
+*/
+func StartSpan (ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return tracer.Start (ctx, name, opts...)
+}
+
+/*! \brief Marks the span as failed if we have an error, and ends it
+*/
+func EndSpan (span trace.Span, err error) {
+	if err != nil {
+		span.RecordError (err)
+		span.SetStatus (codes.Error, err.Error())
+	}
+	span.End()
+}
+
+/*! \brief Sets up our trace provider based on the config
+	Returns the function to call on shutdown so any buffered spans get flushed
+*/
+func StartTracing (service string) (func(context.Context) error, error) {
+	// we always want to pass the trace along, even if we're not exporting anything ourselves
+	otel.SetTextMapPropagator (propagation.NewCompositeTextMapPropagator (propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exp sdktrace.SpanExporter
+	var err error
+
+	switch strings.ToLower (CFG.Tracing.Exporter) {
+	case TraceExporter_none:
+		return func(context.Context) error { return nil }, nil // tracing is off
+
+	case TraceExporter_stdout:
+		exp, err = stdouttrace.New (stdouttrace.WithPrettyPrint())
+
+	case TraceExporter_otlp:
+		opts := make([]otlptracehttp.Option, 0)
+		if len(CFG.Tracing.Endpoint) > 0 { opts = append (opts, otlptracehttp.WithEndpoint (CFG.Tracing.Endpoint)) }
+		if CFG.Tracing.Insecure { opts = append (opts, otlptracehttp.WithInsecure()) }
+		exp, err = otlptracehttp.New (context.Background(), opts...)
+
+	default:
+		return nil, errors.Errorf ("unknown trace exporter '%s', expecting %s or %s", CFG.Tracing.Exporter, TraceExporter_otlp, TraceExporter_stdout)
+	}
+
+	if err != nil { return nil, errors.WithStack (err) }
+
+	ratio := CFG.Tracing.SampleRatio
+	if ratio <= 0 { ratio = 1 } // default to everything
+
+	tp := sdktrace.NewTracerProvider (
+		sdktrace.WithBatcher (exp),
+		sdktrace.WithSampler (sdktrace.ParentBased (sdktrace.TraceIDRatioBased (ratio))),
+		sdktrace.WithResource (resource.NewSchemaless (attribute.String ("service.name", service), attribute.String ("service.version", API_ver))),
+	)
+
+	otel.SetTracerProvider (tp)
+	return tp.Shutdown, nil
+}
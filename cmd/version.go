@@ -0,0 +1,127 @@
+/*! \file version.go
+	\brief Versioned route groups, so breaking changes to our objects don't force every client to update at once
+	Versions share the same handlers, anything that changed between them is handled by a response transformer
+*/
+
+package cmd
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- TYPES -------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+//! Converts a response object into what this version of the api returns for it
+type Transform_f func (in interface{}) interface{}
+
+//! A single version of our api, ie v1, with its own subrouter
+type Version_c struct {
+	Name		string
+	Router		*mux.Router		// register the routes for this version on here
+	deprecated	time.Time
+	sunset		time.Time
+	link		string
+	transforms	map[reflect.Type]Transform_f
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- LOCAL FUNCTIONS ---------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Parses a date from the config, we take a full timestamp or just the day
+*/
+func parseVersionDate (in string) (time.Time, error) {
+	if len(in) == 0 { return time.Time{}, nil }
+	if tm, err := time.Parse (time.RFC3339, in); err == nil { return tm, nil }
+	tm, err := time.Parse ("2006-01-02", in)
+	return tm, errors.Wrapf (err, "expected RFC3339 or YYYY-MM-DD")
+}
+
+/*! \brief Runs the response object through the transformer for its type, if this version has one
+*/
+func (this *Version_c) transform (in interface{}) interface{} {
+	if this == nil || in == nil || len(this.transforms) == 0 { return in }
+	if fn, ok := this.transforms[reflect.TypeOf (in)]; ok { return fn (in) }
+	return in
+}
+
+/*! \brief Adds the deprecation headers and passes our version along for the response transformers
+*/
+func (this *Version_c) middleware (next http.Handler) http.Handler {
+	return http.HandlerFunc (func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set ("API-Version", this.Name)
+		if !this.deprecated.IsZero() { w.Header().Set ("Deprecation", fmt.Sprintf("@%d", this.deprecated.Unix())) }
+		if !this.sunset.IsZero() { w.Header().Set ("Sunset", this.sunset.UTC().Format (http.TimeFormat)) }
+		if len(this.link) > 0 { w.Header().Add ("Link", fmt.Sprintf(`<%s>; rel="deprecation"`, this.link)) }
+
+		next.ServeHTTP (w, r.WithContext (context.WithValue (r.Context(), "apiVersion", this)))
+	})
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PUBLIC FUNCTIONS --------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Registers a transformer for responses of the same type as obj, ie models.User_t{} or &models.User_t{}
+	Returns itself so these can be chained
+*/
+func (this *Version_c) Transform (obj interface{}, fn Transform_f) *Version_c {
+	if this.transforms == nil { this.transforms = make(map[reflect.Type]Transform_f) }
+	this.transforms[reflect.TypeOf (obj)] = fn
+	return this
+}
+
+/*! \brief Creates the subrouter for a version of our api, ie /v1
+	Deprecation dates come from Versions in the config
+*/
+func (this *App_c) Version (name string) *Version_c {
+	v := &Version_c { Name: name, Router: this.router.PathPrefix ("/" + name).Subrouter() }
+
+	if cfg, ok := CFG.Versions[name]; ok {
+		var err error
+		if v.deprecated, err = parseVersionDate (cfg.Deprecated); err != nil { this.StackTrace (errors.Wrapf (err, "%s Deprecated", name)) }
+		if v.sunset, err = parseVersionDate (cfg.Sunset); err != nil { this.StackTrace (errors.Wrapf (err, "%s Sunset", name)) }
+		v.link = cfg.Link
+	}
+
+	v.Router.Use (v.middleware)
+
+	if this.versions == nil { this.versions = make(map[string]*Version_c) }
+	this.versions[name] = v
+	return v
+}
+
+/*! \brief Lets clients pick their version with the Accept-Version header instead of the path
+	This wraps our whole router, so the path is re-written before the routes are matched
+	Every response says it varies on the header, so caches and our etags don't hand one version's body to another
+*/
+func (this *App_c) AcceptVersion (next http.Handler) http.Handler {
+	return http.HandlerFunc (func(w http.ResponseWriter, r *http.Request) {
+		if len(this.versions) > 0 { w.Header().Add ("Vary", "Accept-Version") }
+
+		name := strings.TrimSpace (r.Header.Get ("Accept-Version"))
+		if _, ok := this.versions[name]; ok && len(name) > 0 {
+			prefix := "/" + name
+			if r.URL.Path != prefix && !strings.HasPrefix (r.URL.Path, prefix + "/") { // the path wins if they did both
+				vr := r.WithContext (r.Context())
+				u := *r.URL
+				u.Path, u.RawPath = prefix + u.Path, ""
+				vr.URL = &u
+
+				var match mux.RouteMatch
+				if this.router.Match (vr, &match) && match.MatchErr == nil { r = vr } // otherwise it's not a versioned route, ie /status/ready
+			}
+		}
+		next.ServeHTTP (w, r)
+	})
+}
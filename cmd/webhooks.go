@@ -0,0 +1,310 @@
+/*! \file webhooks.go
+	\brief Outbound webhooks, handlers call PublishWebhook and the task service delivers them
+	Each delivery is a row in cockroach, so they survive restarts and we keep a log of them. Failed attempts back off and
+	a webhook that keeps failing gets turned off
+*/
+
+package cmd
+
+import (
+	"github.com/NathanRThomas/boiler_api/pkg/models"
+	"github.com/NathanRThomas/boiler_api/pkg/toolz"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- DEFINES -----------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+const (
+	defaultWebhookAttempts		= 8		// about 2 hours of retries with our backoff
+	defaultWebhookDisableAfter	= 20	// failed attempts in a row
+	defaultWebhookTimeout		= 10	// seconds we wait on their server
+	defaultWebhookBatch			= 20	// deliveries we pick up at once, at our timeout this fits in a single queen pass
+	webhookWorkers				= 5		// deliveries we send at the same time
+	defaultDeliveryLimit		= 50
+	maxDeliveryLimit			= 500
+
+	WebhookEvent_ping			= "webhook.ping"	// sent by POST /user/webhooks/{id}/ping
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- LOCAL FUNCTIONS ---------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+func webhookConfig () (attempts, disableAfter int, timeout time.Duration) {
+	attempts, disableAfter, timeout = CFG.Webhooks.MaxAttempts, CFG.Webhooks.DisableAfter, time.Duration(CFG.Webhooks.Timeout) * time.Second
+	if attempts <= 0 { attempts = defaultWebhookAttempts }
+	if disableAfter <= 0 { disableAfter = defaultWebhookDisableAfter }
+	if timeout <= 0 { timeout = defaultWebhookTimeout * time.Second }
+	return
+}
+
+/*! \brief Pulls the webhook id out of the url, and checks the user owns it
+*/
+func (this *App_c) userWebhook (w http.ResponseWriter, r *http.Request) (*models.User_t, *models.Webhook_t, bool) {
+	ctx := r.Context()
+
+	user, ok := ctx.Value("user").(*models.User_t)
+	if !ok { this.ServerError (errors.WithStack (models.ErrType_userMissing), ApiErrorCode_missingFromContext, w); return nil, nil, false }
+
+	id := models.UUID (mux.Vars(r)["id"])
+	if !id.Valid() { this.MissingParam (w, "Invalid webhook id"); return nil, nil, false }
+
+	hook, err := this.Webhooks.Get (ctx, id, user.ID)
+	if err != nil { this.Respond (err, w, nil); return nil, nil, false }
+	return user, hook, true
+}
+
+/*! \brief Makes sure the url is somewhere we're willing to send to, as a field error so they know what to fix
+*/
+func checkWebhookUrl (ctx context.Context, hook *models.Webhook_t) error {
+	err := toolz.CheckWebhookUrl (ctx, hook.Url.String())
+	if err == nil { return nil }
+
+	errs := &models.FieldErrors_t{}
+	errs.Add ("Url", err.Error())
+	return errs.Err()
+}
+
+/*! \brief Makes one delivery and records how it went, turning off the webhook if it's failed too many times in a row
+*/
+func (this *App_c) deliverWebhook (ctx context.Context, d *models.WebhookDelivery_t) error {
+	hook, err := this.Webhooks.ForDelivery (ctx, d)
+	if errors.Cause (err) == sql.ErrNoRows { // the webhook was deleted while this was waiting, otherwise Due keeps handing it back to us
+		d.Status, d.Error = models.WebhookStatus_failed, "webhook no longer exists"
+		return this.Webhooks.Attempted (ctx, d)
+	}
+	if err != nil { return err }
+
+	ctx = this.LogScope (ctx, "webhook_id", hook.ID, "delivery_id", d.ID, "event", d.Event)
+	attempts, disableAfter, timeout := webhookConfig()
+
+	if hook.Disabled { // it got turned off while this was waiting, nothing to send it to
+		d.Status, d.Error = models.WebhookStatus_failed, "webhook is disabled"
+		return this.Webhooks.Attempted (ctx, d)
+	}
+
+	sendCtx, cancel := context.WithTimeout (ctx, timeout)
+	defer cancel()
+
+	sendErr := AttemptWebhook (sendCtx, hook, d, attempts)
+	if err = this.Webhooks.Attempted (ctx, d); err != nil { return err }
+
+	if sendErr == nil { return this.Webhooks.Succeeded (ctx, hook.ID) }
+
+	this.Logger(ctx).Info ("webhook attempt failed", "attempts", d.Attempts, "status", d.ResponseCode, "error", sendErr)
+	disabled, err := this.Webhooks.Failed (ctx, hook.ID, disableAfter)
+	if err != nil { return err }
+	if disabled && !hook.Disabled {
+		this.Logger(ctx).Warn ("webhook disabled after repeated failures", "failures", hook.Failures + 1)
+		hook.Secret = ""	// this goes out over sse, they only ever get the secret when the webhook is created
+		this.StackTraceCtx (ctx, this.PublishEvent (ctx, hook.UserID, "webhook.disabled", hook))	// let them know if they're around
+	}
+	return nil
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PUBLIC FUNCTIONS --------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Sends the delivery to the webhook, updating its attempts, status and when the next attempt is
+	This doesn't touch the database so it can be pointed at anything, ie an httptest server
+*/
+func AttemptWebhook (ctx context.Context, hook *models.Webhook_t, d *models.WebhookDelivery_t, maxAttempts int) error {
+	body, err := json.Marshal (models.WebhookBody_t { ID: d.ID, Event: d.Event, Created: d.Created, Data: d.Payload })
+	if err != nil { return errors.WithStack (err) }
+
+	d.Attempts++
+	d.ResponseCode, err = toolz.SendWebhook (ctx, hook.Url.String(), hook.Secret.String(), d.ID.String(), d.Event, body)
+
+	switch {
+	case err == nil:
+		d.Status, d.Error = models.WebhookStatus_delivered, ""
+	case d.Attempts >= maxAttempts:
+		d.Status, d.Error = models.WebhookStatus_failed, err.Error()
+	default:
+		d.Status, d.Error = models.WebhookStatus_pending, err.Error()
+		d.NextAttempt = time.Now().Add (models.WebhookBackoff (d.Attempts))
+	}
+	return err
+}
+
+/*! \brief Sends the event to every webhook the logged in user, or their org, has for it
+*/
+func (this *App_c) PublishWebhook (ctx context.Context, event string, data interface{}) error {
+	user, ok := ctx.Value("user").(*models.User_t)
+	if !ok { return errors.WithStack (models.ErrType_userMissing) }
+
+	org, _ := ctx.Value("org").(string)
+	return this.PublishWebhookFor (ctx, user.ID, org, event, data)
+}
+
+/*! \brief Sends the event to every webhook the user, or the org, has for it. For tasks and anywhere the user isn't in the context
+	These are only queued here, the task service does the sending
+*/
+func (this *App_c) PublishWebhookFor (ctx context.Context, userID models.UUID, org, event string, data interface{}) error {
+	hooks, err := this.Webhooks.Subscribed (ctx, userID, org)
+	if err != nil { return err }
+
+	var payload []byte
+	for _, hook := range hooks {
+		if !hook.Wants (event) { continue }
+
+		if payload == nil { // only once we know someone wants it
+			if payload, err = json.Marshal (data); err != nil { return errors.Wrap (err, event) }
+		}
+
+		if err = this.Webhooks.Queue (ctx, &models.WebhookDelivery_t { WebhookID: hook.ID, Event: event, Payload: payload }); err != nil { return err }
+	}
+	return nil
+}
+
+/*! \brief Sends every delivery that's due, the task service calls this on each pass
+	A single failed delivery doesn't stop the others, it's logged and retried later
+*/
+func (this *App_c) DeliverWebhooks (ctx context.Context) error {
+	batch := CFG.Webhooks.Batch
+	if batch <= 0 { batch = defaultWebhookBatch }
+	_, _, timeout := webhookConfig()
+
+	// we hold them long enough to get through all of them, if we die they go out again after that
+	due, err := this.Webhooks.Due (ctx, batch, timeout * time.Duration(batch / webhookWorkers + 1))
+	if err != nil || len(due) == 0 { return err }
+
+	in := make(chan *models.WebhookDelivery_t)
+	wg := new(sync.WaitGroup)
+	for x := 0; x < webhookWorkers; x++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for d := range in { this.StackTraceCtx (ctx, this.deliverWebhook (ctx, d)) }
+		}()
+	}
+
+	for _, d := range due {
+		select {
+		case in <- d:
+		case <-ctx.Done(): // the rest go out once their lease is up
+		}
+	}
+	close (in)
+	wg.Wait()
+	return nil
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- ROUTES ------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief GET /user/webhooks, every webhook the user has. Secrets are only returned when they're created
+*/
+func (this *App_c) WebhookList (w http.ResponseWriter, r *http.Request) {
+	user, ok := r.Context().Value("user").(*models.User_t)
+	if !ok { this.ServerError (errors.WithStack (models.ErrType_userMissing), ApiErrorCode_missingFromContext, w); return }
+
+	hooks, err := this.Webhooks.List (r.Context(), user.ID)
+	for _, hook := range hooks { hook.Secret = "" }
+	this.Respond (err, w, hooks)
+}
+
+/*! \brief POST /user/webhooks, the response has the secret they'll need to check our signatures
+*/
+func (this *App_c) WebhookCreate (w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, ok := ctx.Value("user").(*models.User_t)
+	if !ok { this.ServerError (errors.WithStack (models.ErrType_userMissing), ApiErrorCode_missingFromContext, w); return }
+
+	hook := &models.Webhook_t{}
+	if err := this.ParseFromBody (ctx, hook); err != nil { this.BodyError (w, err); return }
+	if err := checkWebhookUrl (ctx, hook); err != nil { this.Respond (err, w, nil); return }
+
+	secret, err := toolz.WebhookSecret()
+	if err != nil { this.ServerError (err, ApiErrorCode_internal, w); return }
+
+	org, _ := ctx.Value("org").(string)
+	hook.ID, hook.UserID, hook.Org, hook.Secret, hook.Failures = "", user.ID, models.ApiString (org), models.ApiString (secret), 0
+
+	err = this.Webhooks.Save (ctx, hook)
+	if err == nil { this.Logger(ctx).Info ("webhook created", "webhook_id", hook.ID, "events", hook.Events) }
+	this.Respond (err, w, hook)
+}
+
+/*! \brief GET /user/webhooks/{id}
+*/
+func (this *App_c) WebhookGet (w http.ResponseWriter, r *http.Request) {
+	_, hook, ok := this.userWebhook (w, r)
+	if !ok { return }
+
+	hook.Secret = ""
+	this.Respond (nil, w, hook)
+}
+
+/*! \brief PUT /user/webhooks/{id}, updates the url, events and description, or turns it back on
+*/
+func (this *App_c) WebhookSave (w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	_, hook, ok := this.userWebhook (w, r)
+	if !ok { return }
+
+	update := &models.Webhook_t{}
+	if err := this.ParseFromBody (ctx, update); err != nil { this.BodyError (w, err); return }
+	if err := checkWebhookUrl (ctx, update); err != nil { this.Respond (err, w, nil); return }
+	hook.Url, hook.Events, hook.Description, hook.Disabled = update.Url, update.Events, update.Description, update.Disabled
+
+	err := this.Webhooks.Save (ctx, hook)
+	hook.Secret = ""
+	this.Respond (err, w, hook)
+}
+
+/*! \brief DELETE /user/webhooks/{id}, also removes its delivery log
+*/
+func (this *App_c) WebhookDelete (w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, hook, ok := this.userWebhook (w, r)
+	if !ok { return }
+
+	err := this.Webhooks.Delete (ctx, hook.ID, user.ID)
+	if err == nil { this.Logger(ctx).Info ("webhook deleted", "webhook_id", hook.ID) }
+	this.Respond (err, w, nil)
+}
+
+/*! \brief GET /user/webhooks/{id}/deliveries?limit=50, newest first
+*/
+func (this *App_c) WebhookDeliveries (w http.ResponseWriter, r *http.Request) {
+	user, hook, ok := this.userWebhook (w, r)
+	if !ok { return }
+
+	limit := defaultDeliveryLimit
+	if l := r.URL.Query().Get ("limit"); len(l) > 0 {
+		var err error
+		if limit, err = strconv.Atoi (l); err != nil || limit < 1 || limit > maxDeliveryLimit {
+			this.MissingParam (w, "limit must be between 1 and %d", maxDeliveryLimit)
+			return
+		}
+	}
+
+	deliveries, err := this.Webhooks.Deliveries (r.Context(), hook.ID, user.ID, limit)
+	this.Respond (err, w, deliveries)
+}
+
+/*! \brief POST /user/webhooks/{id}/ping, queues a test delivery so they can check their endpoint
+*/
+func (this *App_c) WebhookPing (w http.ResponseWriter, r *http.Request) {
+	_, hook, ok := this.userWebhook (w, r)
+	if !ok { return }
+
+	d := &models.WebhookDelivery_t { WebhookID: hook.ID, Event: WebhookEvent_ping, Payload: json.RawMessage (fmt.Sprintf(`{"WebhookID":"%s"}`, hook.ID)) }
+	this.Respond (this.Webhooks.Queue (r.Context(), d), w, d)
+}
@@ -0,0 +1,103 @@
+/*! \file webhooks_test.go
+	\brief Tests for a single webhook attempt, against a local server standing in for the receiver
+*/
+
+package cmd
+
+import (
+	"github.com/NathanRThomas/boiler_api/pkg/models"
+	"github.com/NathanRThomas/boiler_api/pkg/toolz"
+
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/*! \brief A receiver that checks our signature and answers with whatever status is set
+*/
+func testWebhookServer (t *testing.T, secret string, status *atomic.Int32) *httptest.Server {
+	t.Helper()
+
+	toolz.WebhookAllowPrivate = true	// httptest only listens on loopback
+	t.Cleanup (func() { toolz.WebhookAllowPrivate = false })
+
+	srv := httptest.NewServer (http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll (r.Body)
+		if err := toolz.VerifyWebhook (secret, r.Header.Get (toolz.WebhookHeader_signature), body, time.Minute); err != nil {
+			t.Errorf ("bad signature : %v", err)
+		}
+
+		webhook := models.WebhookBody_t{}
+		if err := json.Unmarshal (body, &webhook); err != nil || webhook.Event != "test.event" || string(webhook.Data) != `{"a":1}` {
+			t.Errorf ("unexpected body %s : %v", body, err)
+		}
+
+		w.WriteHeader (int(status.Load()))
+	}))
+	t.Cleanup (srv.Close)
+	return srv
+}
+
+func TestAttemptWebhook (t *testing.T) {
+	ctx := context.Background()
+	status := &atomic.Int32{}
+	srv := testWebhookServer (t, "whsec_test", status)
+
+	hook := &models.Webhook_t { ID: "hook", Url: models.ApiString (srv.URL), Secret: "whsec_test" }
+	newDelivery := func () *models.WebhookDelivery_t {
+		return &models.WebhookDelivery_t { ID: "delivery", WebhookID: hook.ID, Event: "test.event", Payload: json.RawMessage (`{"a":1}`), Created: time.Now() }
+	}
+
+	t.Run ("delivered", func (t *testing.T) {
+		status.Store (http.StatusNoContent)
+		d := newDelivery()
+
+		if err := AttemptWebhook (ctx, hook, d, 3); err != nil { t.Fatal (err) }
+		if d.Status != models.WebhookStatus_delivered || d.Attempts != 1 || d.ResponseCode != http.StatusNoContent || len(d.Error) > 0 {
+			t.Fatalf ("unexpected delivery %+v", d)
+		}
+	})
+
+	t.Run ("retried with backoff", func (t *testing.T) {
+		status.Store (http.StatusInternalServerError)
+		d := newDelivery()
+
+		for attempt := 1; attempt < 3; attempt++ {
+			before := time.Now()
+			if err := AttemptWebhook (ctx, hook, d, 3); err == nil { t.Fatal ("a 500 should be an error") }
+
+			if d.Status != models.WebhookStatus_pending || d.Attempts != attempt || d.ResponseCode != http.StatusInternalServerError || len(d.Error) == 0 {
+				t.Fatalf ("unexpected delivery after attempt %d : %+v", attempt, d)
+			}
+
+			backoff := models.WebhookBackoff (attempt)
+			if d.NextAttempt.Before (before.Add (backoff)) || d.NextAttempt.After (time.Now().Add (backoff)) {
+				t.Fatalf ("attempt %d next attempt is %s, expected %s from now", attempt, time.Until (d.NextAttempt), backoff)
+			}
+		}
+	})
+
+	t.Run ("last attempt failed", func (t *testing.T) {
+		status.Store (http.StatusBadGateway)
+		d := newDelivery()
+		d.Attempts = 2
+
+		if err := AttemptWebhook (ctx, hook, d, 3); err == nil { t.Fatal ("a 502 should be an error") }
+		if d.Status != models.WebhookStatus_failed || d.Attempts != 3 || d.ResponseCode != http.StatusBadGateway || len(d.Error) == 0 {
+			t.Fatalf ("expected it to be marked failed : %+v", d)
+		}
+	})
+
+	t.Run ("unreachable", func (t *testing.T) {
+		d := newDelivery()
+		gone := &models.Webhook_t { Url: "http://127.0.0.1:1/hook", Secret: "whsec_test" }	// nothing listens on port 1
+
+		if err := AttemptWebhook (ctx, gone, d, 3); err == nil { t.Fatal ("expected a connection error") }
+		if d.Status != models.WebhookStatus_pending || d.ResponseCode != 0 { t.Fatalf ("unexpected delivery %+v", d) }
+	})
+}
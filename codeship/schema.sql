@@ -19,6 +19,7 @@ CREATE TABLE users (
     username    TEXT NOT NULL,
     attrs 		JSONB NOT NULL DEFAULT '{}',
 	created   	TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	updated   	TIMESTAMPTZ NOT NULL DEFAULT NOW(),
 	mask       	INT NOT NULL DEFAULT 0 CHECK (mask >= 0),
 	INDEX idx_users_email (email),
     INDEX idx_users_password (password)
@@ -35,6 +36,72 @@ CREATE TABLE schedules (
     INDEX idx_schedules_next (next_date)
 );
 
+-- feature flags, the whole flag lives in attrs
+CREATE TABLE flags (
+    key         TEXT PRIMARY KEY,
+    attrs       JSONB NOT NULL DEFAULT '{}',
+    created   	TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated   	TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- outbound webhooks our users subscribe to, the url and events live in attrs
+CREATE TABLE webhooks (
+    id          UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id     UUID NOT NULL,
+    org         TEXT NOT NULL DEFAULT '',
+    secret      TEXT NOT NULL,
+    attrs       JSONB NOT NULL DEFAULT '{}',
+    disabled    BOOL NOT NULL DEFAULT false,
+    failures    INT NOT NULL DEFAULT 0,
+    created   	TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated   	TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    INDEX idx_webhooks_user (user_id),
+    INDEX idx_webhooks_org (org)
+);
+
+-- every event sent to a webhook, this is also the delivery log
+CREATE TABLE webhook_deliveries (
+    id          UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    webhook_id  UUID NOT NULL,
+    event       TEXT NOT NULL,
+    payload     JSONB NOT NULL DEFAULT '{}',
+    status      INT NOT NULL DEFAULT 0,
+    attempts    INT NOT NULL DEFAULT 0,
+    next_attempt TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    response_code INT NOT NULL DEFAULT 0,
+    error       TEXT NOT NULL DEFAULT '',
+    created   	TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated   	TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    INDEX idx_webhook_deliveries_due (status, next_attempt),
+    INDEX idx_webhook_deliveries_webhook (webhook_id, created DESC)
+);
+
+-- callbacks from mailgun and twilio about the messages we send, and texts sent to us
+CREATE TABLE provider_events (
+    id          UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    provider    TEXT NOT NULL,
+    event       TEXT NOT NULL,
+    provider_id TEXT NOT NULL,
+    recipient   TEXT NOT NULL DEFAULT '',
+    attrs       JSONB NOT NULL DEFAULT '{}',
+    data        JSONB NOT NULL DEFAULT '{}',
+    processed   BOOL NOT NULL DEFAULT false,
+    lease_until TIMESTAMPTZ NOT NULL DEFAULT NOW(),   -- claimed by whoever's handling it until then, so instances don't handle the same ones
+    created   	TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE INDEX idx_provider_events_unique (provider, provider_id, event),
+    INDEX idx_provider_events_processed (processed, lease_until, created),
+    INDEX idx_provider_events_recipient (recipient)
+);
+
+-- addresses we don't send to anymore, bounces, complaints and texts that said STOP
+CREATE TABLE suppressions (
+    channel     TEXT NOT NULL,
+    address     TEXT NOT NULL,
+    reason      TEXT NOT NULL DEFAULT '',
+    created   	TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (channel, address)
+);
+
 
 -- INSERTS ------------------------------------------------------------------------------------------------------------
 
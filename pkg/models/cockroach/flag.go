@@ -0,0 +1,71 @@
+/*! \file flag.go
+	\brief Cockroach specific to the flags table
+	The whole flag is stored in attrs, the table only needs the key to find it
+*/
+
+package cockroach
+
+import (
+	"github.com/NathanRThomas/boiler_api/pkg/models"
+
+	"github.com/pkg/errors"
+
+	"context"
+	"encoding/json"
+)
+
+type Flag_c struct {
+	toolz_c
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- FLAGS -------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Returns every flag, there aren't many of these so they all get cached together
+*/
+func (this *Flag_c) List (ctx context.Context) ([]*models.Flag_t, error) {
+	rows, err := this.query (ctx, "flag_list", `SELECT attrs, created, updated FROM flags ORDER BY key`)
+	if err != nil { return nil, err }
+	defer rows.Close()
+
+	out := make([]*models.Flag_t, 0)
+	for rows.Next() {
+		flag := &models.Flag_t{}
+		var jAttr []byte
+		if err = rows.Scan (&jAttr, &flag.Created, &flag.Updated); err != nil { return nil, errors.WithStack (err) }
+		if err = this.UM (jAttr, flag); err != nil { return nil, err }
+		out = append (out, flag)
+	}
+	return out, this.RowsChk (rows)
+}
+
+/*! \brief Gets a single flag by its key, sql.ErrNoRows if there isn't one
+*/
+func (this *Flag_c) Get (ctx context.Context, key string) (*models.Flag_t, error) {
+	flag := &models.Flag_t{}
+	var jAttr []byte
+
+	err := this.queryRow (ctx, "flag_get", `SELECT attrs, created, updated FROM flags WHERE key = $1`, key).Scan(&jAttr, &flag.Created, &flag.Updated)
+	if err != nil { return nil, errors.Wrap (err, key) }
+
+	return flag, this.UM (jAttr, flag)
+}
+
+/*! \brief Creates or replaces the flag
+*/
+func (this *Flag_c) Save (ctx context.Context, flag *models.Flag_t) error {
+	jAttr, err := json.Marshal (flag)
+	if err != nil { return errors.WithStack (err) }
+
+	err = this.queryRow (ctx, "flag_save", `INSERT INTO flags (key, attrs) VALUES ($1, $2)
+							ON CONFLICT (key) DO UPDATE SET attrs = excluded.attrs, updated = NOW() RETURNING created, updated`,
+							flag.Key, jAttr).Scan(&flag.Created, &flag.Updated)
+	return errors.Wrap (err, flag.Key.String())
+}
+
+/*! \brief Removes the flag, it's off for everyone after this
+*/
+func (this *Flag_c) Delete (ctx context.Context, key string) error {
+	return errors.Wrap (this.exec (ctx, "flag_delete", `DELETE FROM flags WHERE key = $1`, key), key)
+}
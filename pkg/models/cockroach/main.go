@@ -7,6 +7,10 @@ package cockroach
 import (
 	
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 
 	"database/sql"
 	"context"
@@ -17,6 +21,45 @@ import (
 // if errors.Cause (err) != sql.ErrNoRows { //not an error we can ignore
 var db *sql.DB // global sql database handle
 
+//! Gets called after every query with how long it took, this is how we hook in our metrics
+type Observer_f func (query string, dur time.Duration, err error)
+var observer Observer_f
+
+var tracer = otel.Tracer ("github.com/NathanRThomas/boiler_api/pkg/models/cockroach")
+
+//! Wraps the sql row so we can time the query and close out its span once the scan finishes
+type row_t struct {
+	row *sql.Row
+	query string
+	start time.Time
+	span trace.Span
+}
+
+func (this *row_t) Scan (dest ...interface{}) error {
+	err := this.row.Scan (dest...)
+	observe (this.query, this.start, this.span, err)
+	return err
+}
+
+/*! \brief Starts the span for a single query
+*/
+func startSpan (ctx context.Context, name, query string) (context.Context, trace.Span) {
+	return tracer.Start (ctx, "cockroach " + name, trace.WithSpanKind (trace.SpanKindClient), 
+		trace.WithAttributes (attribute.String ("db.system", "cockroachdb"), attribute.String ("db.statement", query)))
+}
+
+/*! \brief Finishes up a query, records the timing and ends the span
+*/
+func observe (query string, start time.Time, span trace.Span, err error) {
+	if observer != nil { observer (query, time.Since (start), err) }
+
+	if err != nil && err != sql.ErrNoRows {
+		span.RecordError (err)
+		span.SetStatus (codes.Error, err.Error())
+	}
+	span.End()
+}
+
   //-------------------------------------------------------------------------------------------------------------------------//
  //----- DATABASE FUNCTIONS ------------------------------------------------------------------------------------------------//
 //-------------------------------------------------------------------------------------------------------------------------//
@@ -26,6 +69,25 @@ func SetDB (inDB *sql.DB) error {
 	return TestDB() // make sure we can ping this
 }
 
+/*! \brief Sets the function that gets called after every query
+*/
+func SetObserver (fn Observer_f) {
+	observer = fn
+}
+
+/*! \brief Checks we can reach the database, the context sets how long we'll wait
+*/
+func Ping (ctx context.Context) error {
+	return errors.WithStack (db.PingContext (ctx))
+}
+
+/*! \brief Connection pool stats for the database handle
+*/
+func Stats () sql.DBStats {
+	if db == nil { return sql.DBStats{} }
+	return db.Stats()
+}
+
 func TestDB () error {
 	var ctx context.Context
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 3)
@@ -44,13 +106,43 @@ func (this *toolz_c) RowsChk (rows *sql.Rows) error {
 	return errors.WithStack (rows.Err())
 }
 
-func (this *toolz_c) Exec (query string, args ...interface{}) error {
-	_, err := db.Exec (query, args...)
+func (this *toolz_c) Exec (ctx context.Context, query string, args ...interface{}) error {
+	return this.exec (ctx, "exec", query, args...)
+}
+
+/*! \brief Named version of the exec so we can tell our queries apart in the metrics and traces
+*/
+func (this *toolz_c) exec (ctx context.Context, name, query string, args ...interface{}) error {
+	start := time.Now()
+	ctx, span := startSpan (ctx, name, query)
+
+	_, err := db.ExecContext (ctx, query, args...)
+	observe (name, start, span, err)
 	return errors.WithStack (err)
 }
 
-func (this *toolz_c) GenUUID () (out string) {
-	db.QueryRow(`SELECT gen_random_uuid()`).Scan(&out)
+/*! \brief Named version of the query row, the timing is recorded once the row is scanned
+*/
+func (this *toolz_c) queryRow (ctx context.Context, name, query string, args ...interface{}) *row_t {
+	start := time.Now()
+	ctx, span := startSpan (ctx, name, query)
+	return &row_t { row: db.QueryRowContext (ctx, query, args...), query: name, start: start, span: span }
+}
+
+/*! \brief Named version of the query, the timing only covers running it, not reading the rows
+	Make sure to close the rows, RowsChk does it for you
+*/
+func (this *toolz_c) query (ctx context.Context, name, query string, args ...interface{}) (*sql.Rows, error) {
+	start := time.Now()
+	ctx, span := startSpan (ctx, name, query)
+
+	rows, err := db.QueryContext (ctx, query, args...)
+	observe (name, start, span, err)
+	return rows, errors.WithStack (err)
+}
+
+func (this *toolz_c) GenUUID (ctx context.Context) (out string) {
+	this.queryRow(ctx, "gen_uuid", `SELECT gen_random_uuid()`).Scan(&out)
 	return
 }
 
@@ -0,0 +1,109 @@
+/*! \file provider.go
+	\brief Cockroach specific to the provider_events and suppressions tables
+*/
+
+package cockroach
+
+import (
+	"github.com/NathanRThomas/boiler_api/pkg/models"
+
+	"github.com/pkg/errors"
+
+	"context"
+	"database/sql"
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+type Provider_c struct {
+	toolz_c
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- EVENTS ------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Records the event, returns false if we've already got it. Providers retry so we see the same ones more than once
+*/
+func (this *Provider_c) SaveEvent (ctx context.Context, e *models.ProviderEvent_t) (bool, error) {
+	jAttr, err := json.Marshal (e.Attr)
+	if err != nil { return false, errors.WithStack (err) }
+
+	data := []byte(e.Data)
+	if len(data) == 0 { data = []byte("{}") }
+
+	err = this.queryRow (ctx, "provider_event_insert", `INSERT INTO provider_events (provider, event, provider_id, recipient, attrs, data)
+							VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (provider, provider_id, event) DO NOTHING RETURNING id, created`,
+							e.Provider, e.Event, e.ProviderID, e.Recipient, jAttr, data).Scan(&e.ID, &e.Created)
+
+	switch errors.Cause (err) {
+	case nil:
+		return true, nil
+	case sql.ErrNoRows:	// it was already there
+		return false, nil
+	default:
+		return false, errors.Wrapf (err, "%s : %s : %s", e.Provider, e.Event, e.ProviderID)
+	}
+}
+
+/*! \brief Claims the oldest events we haven't handled yet, nobody else gets them until the lease is up
+	Ones we don't mark processed before then go out again, so a failure is retried later
+*/
+func (this *Provider_c) Unprocessed (ctx context.Context, limit int, lease time.Duration) ([]*models.ProviderEvent_t, error) {
+	rows, err := this.query (ctx, "provider_events_unprocessed", `UPDATE provider_events SET lease_until = NOW() + $2::INTERVAL
+							WHERE id IN (SELECT id FROM provider_events WHERE processed = false AND lease_until <= NOW() ORDER BY created LIMIT $1)
+							RETURNING id, provider, event, provider_id, recipient, attrs, created`, limit, lease.String())
+	if err != nil { return nil, err }
+	defer rows.Close()
+
+	out := make([]*models.ProviderEvent_t, 0)
+	for rows.Next() {
+		e := &models.ProviderEvent_t{}
+		var jAttr []byte
+		if err = rows.Scan (&e.ID, &e.Provider, &e.Event, &e.ProviderID, &e.Recipient, &jAttr, &e.Created); err != nil { return nil, errors.WithStack (err) }
+		if err = this.UM (jAttr, &e.Attr); err != nil { return nil, err }
+		out = append (out, e)
+	}
+	if err = this.RowsChk (rows); err != nil { return nil, err }
+
+	sort.Slice (out, func (i, j int) bool { return out[i].Created.Before (out[j].Created) })	// returning doesn't keep the order, and a STOP then START has to stay that way
+	return out, nil
+}
+
+func (this *Provider_c) Processed (ctx context.Context, id models.UUID) error {
+	return errors.Wrap (this.exec (ctx, "provider_event_processed", `UPDATE provider_events SET processed = true WHERE id = $1`, id), id.String())
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- SUPPRESSIONS ------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief We won't send to this address anymore, the latest reason wins
+*/
+func (this *Provider_c) Suppress (ctx context.Context, s *models.Suppression_t) error {
+	s.Address = models.SuppressionAddress (s.Channel, s.Address)
+	err := this.queryRow (ctx, "suppression_upsert", `INSERT INTO suppressions (channel, address, reason) VALUES ($1, $2, $3)
+							ON CONFLICT (channel, address) DO UPDATE SET reason = excluded.reason RETURNING created`,
+							s.Channel, s.Address, s.Reason).Scan(&s.Created)
+	return errors.Wrapf (err, "%s : %s", s.Channel, s.Address)
+}
+
+/*! \brief We can send to them again, ie they texted START
+*/
+func (this *Provider_c) Unsuppress (ctx context.Context, channel, address string) error {
+	address = models.SuppressionAddress (channel, address)
+	return errors.Wrapf (this.exec (ctx, "suppression_delete", `DELETE FROM suppressions WHERE channel = $1 AND address = $2`, channel, address),
+							"%s : %s", channel, address)
+}
+
+/*! \brief True if we shouldn't send to the address
+*/
+func (this *Provider_c) Suppressed (ctx context.Context, channel, address string) (bool, error) {
+	address = models.SuppressionAddress (channel, address)
+
+	var found bool
+	err := this.queryRow (ctx, "suppression_check", `SELECT EXISTS (SELECT 1 FROM suppressions WHERE channel = $1 AND address = $2)`,
+							channel, address).Scan(&found)
+	return found, errors.Wrapf (err, "%s : %s", channel, address)
+}
@@ -13,6 +13,7 @@ import (
 
 	"fmt"
 	"time"
+	"context"
 )
 
 type Task_c struct {
@@ -29,11 +30,11 @@ type Task_c struct {
 /*! \brief Grabs the single next schedule that should be executed
 	Will return nil for the schedule and the error if there's nothing to do
 */
-func (this *Task_c) NextSchedule () (*models.Schedule_t, error) {
+func (this *Task_c) NextSchedule (ctx context.Context) (*models.Schedule_t, error) {
 	next := &models.Schedule_t{}
 	var jAttr []byte
 
-	err := db.QueryRow (`SELECT id, schedule_type, attrs, interval FROM schedules WHERE next_date < $1 ORDER BY next_date LIMIT 1`, time.Now()).
+	err := this.queryRow (ctx, "schedule_next", `SELECT id, schedule_type, attrs, interval FROM schedules WHERE next_date < $1 ORDER BY next_date LIMIT 1`, time.Now()).
 		Scan(&next.ID, &next.Type, &jAttr, &next.Interval)
 	
 	if err != nil { return nil, errors.WithStack (err) }
@@ -51,7 +52,7 @@ func (this *Task_c) NextSchedule () (*models.Schedule_t, error) {
 		interval = next.Interval.String() // just pull this out
 	}
 
-	lErr := this.Exec (fmt.Sprintf(`UPDATE schedules SET next_date = next_date + INTERVAL '%s' WHERE id = $1`, interval), next.ID)
+	lErr := this.exec (ctx, "schedule_update", fmt.Sprintf(`UPDATE schedules SET next_date = next_date + INTERVAL '%s' WHERE id = $1`, interval), next.ID)
 	if lErr != nil { return nil, lErr } // the update failed, so bail hard here
 
 	return next, err // return our "non-fatal" error from above, do this so the update to the future always works
@@ -11,6 +11,7 @@ import (
 	"github.com/pkg/errors"
 
 	//"fmt"
+	"context"
 	"encoding/json"
 	"database/sql"
 )
@@ -29,27 +30,27 @@ type User_c struct {
 
 /*! \brief Verifies that this email is new or returns the exsting info about that user
 */
-func (this *User_c) FromEmail (email models.ApiString, userID models.UUID) (*models.User_t, error) {
+func (this *User_c) FromEmail (ctx context.Context, email models.ApiString, userID models.UUID) (*models.User_t, error) {
 	if !email.Email() { return nil, errors.WithStack (models.ErrType_noIdentifiers) }
 	if !userID.Valid() { userID.Set("00000000-0000-0000-0000-000000000000") }	// otherwise we get an error about it not being a uuid in the query
 
 	user := &models.User_t {}
 
-    err := db.QueryRow(`SELECT id FROM users WHERE lower(email) = lower($1) AND mask & $3 = 0 AND id <> $2`, 
+    err := this.queryRow(ctx, "user_from_email", `SELECT id FROM users WHERE lower(email) = lower($1) AND mask & $3 = 0 AND id <> $2`, 
 					email.String(), userID, models.UserMask_deleted).Scan(&user.ID)
 	if err != nil { return nil, errors.Wrapf (err, "userID: %s :: email: %s", userID, email) }
 
-	err = this.Get (user)
+	err = this.Get (ctx, user)
     return user, err
 }
 
 /*! \brief Creates a new user or updates an existing
 */
-func (this *User_c) Save (user *models.User_t) error {
+func (this *User_c) Save (ctx context.Context, user *models.User_t) error {
 	if !user.Email.Email() { return errors.Wrap (models.ErrType_returnToUser, "Email appears invalid") }
 
 	// verify it's a unique email
-	existing, err := this.FromEmail (user.Email, user.ID)
+	existing, err := this.FromEmail (ctx, user.Email, user.ID)
 	if existing != nil { return errors.Wrap (models.ErrType_returnToUser, "Email already in use by someone else") }
 
 	switch errors.Cause (err) {
@@ -63,17 +64,17 @@ func (this *User_c) Save (user *models.User_t) error {
 	if err != nil { return errors.WithStack (err) }
 
 	if user.ID.Valid() { // we're updating
-		err = this.Exec (`UPDATE users SET email = $1, attrs = $2 WHERE id = $3`, user.Email, jAttr, user.ID)
+		err = this.exec (ctx, "user_update", `UPDATE users SET email = $1, attrs = $2, updated = NOW() WHERE id = $3`, user.Email, jAttr, user.ID)
 		if err != nil { return err }
 
 		if user.Password.Valid() { // they don't have to set a password for updates
 			user.SetToken()
-			err = this.Exec(`UPDATE users SET password = $1, token = $2 WHERE id = $3`, user.Password.Hash(), user.Token, user.ID)
+			err = this.exec(ctx, "user_update_password", `UPDATE users SET password = $1, token = $2, updated = NOW() WHERE id = $3`, user.Password.Hash(), user.Token, user.ID)
 			if err != nil { return err }
 		}
 	} else { // we're inserting
 		user.SetToken()
-		err = db.QueryRow (`INSERT INTO users (email, password, token, attrs, mask)
+		err = this.queryRow (ctx, "user_insert", `INSERT INTO users (email, password, token, attrs, mask)
 							VALUES ($1, $2, $3, $4, $5) RETURNING id`, user.Email, 
 							user.Password.Hash(), user.Token, jAttr, user.Mask).Scan(&user.ID)
 
@@ -84,12 +85,12 @@ func (this *User_c) Save (user *models.User_t) error {
 
 /*! \brief Gets our user from the database
 */
-func (this *User_c) Get (user *models.User_t) error {
+func (this *User_c) Get (ctx context.Context, user *models.User_t) error {
 	if !user.ID.Valid() { return errors.WithStack (models.ErrType_invalidUUID) }  //this isn't good, can't find a user with the id this way
 
 	var jAttr []byte
-	err := db.QueryRow(`SELECT mask, token, attrs, created FROM users WHERE id = $1`, 
-			user.ID).Scan(&user.Mask, &jAttr, &user.Created)
+	err := this.queryRow(ctx, "user_get", `SELECT mask, token, attrs, created, updated FROM users WHERE id = $1`, 
+			user.ID).Scan(&user.Mask, &user.Token, &jAttr, &user.Created, &user.Updated)
 
 	if err != nil { return errors.Wrap (err, user.ID.String()) }
 	
@@ -98,28 +99,28 @@ func (this *User_c) Get (user *models.User_t) error {
 
 /*! \brief Pulls the user based on the combo of their id and token
  */
- func (this *User_c) TokenLogin (user *models.User_t) error {
+ func (this *User_c) TokenLogin (ctx context.Context, user *models.User_t) error {
     //make sure we have good data
 	if !user.ID.Valid() || !user.Token.Valid() { return errors.WithStack (models.ErrType_noIdentifiers) }
 	
 	var id models.UUID
 
-	err := db.QueryRow(`SELECT id FROM users WHERE id = $1 AND token = $2 AND mask & $3 = 0`,
+	err := this.queryRow(ctx, "user_token_login", `SELECT id FROM users WHERE id = $1 AND token = $2 AND mask & $3 = 0`,
 						user.ID, user.Token, models.UserMask_deleted).Scan(&id)
 	if err != nil { return errors.WithStack (err) }
 
 	if id != user.ID { return errors.WithStack (sql.ErrNoRows) } // this didn't work
-	return this.Get (user) // finish our get
+	return this.Get (ctx, user) // finish our get
 }
 
 /*! \brief Default logging in
 */
-func (this *User_c) Login (user *models.User_t) error {
+func (this *User_c) Login (ctx context.Context, user *models.User_t) error {
 	if user.Email.Email() && user.Password.Valid() {
-		err := db.QueryRow(`SELECT id FROM users WHERE password = $2 AND lower(email) = lower($1) AND mask & $3 = 0`,
+		err := this.queryRow(ctx, "user_login", `SELECT id FROM users WHERE password = $2 AND lower(email) = lower($1) AND mask & $3 = 0`,
 							user.Email, user.Password.Hash(), models.UserMask_deleted).Scan(&user.ID)
 		if err != nil { return errors.WithStack (err) }
 	}
 
-	return this.Get (user)
+	return this.Get (ctx, user)
 }
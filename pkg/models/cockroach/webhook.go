@@ -0,0 +1,203 @@
+/*! \file webhook.go
+	\brief Cockroach specific to the webhooks and webhook_deliveries tables
+	The url, events and description are in attrs, the columns are what we need to find and disable them
+*/
+
+package cockroach
+
+import (
+	"github.com/NathanRThomas/boiler_api/pkg/models"
+
+	"github.com/pkg/errors"
+
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+type Webhook_c struct {
+	toolz_c
+}
+
+//! What the webhook's attrs column holds
+type webhookAttr_t struct {
+	Url models.ApiString
+	Events []string
+	Description models.ApiString `json:",omitempty"`
+}
+
+const webhookCols = `id, user_id, org, secret, attrs, disabled, failures, created, updated`
+const deliveryCols = `id, webhook_id, event, payload, status, attempts, next_attempt, response_code, error, created, updated`
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PRIVATE FUNCTIONS -------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+//! Works for both the single row and the list
+type scanner_i interface {
+	Scan (dest ...interface{}) error
+}
+
+func (this *Webhook_c) scanWebhook (row scanner_i) (*models.Webhook_t, error) {
+	hook := &models.Webhook_t{}
+	attr := webhookAttr_t{}
+	var jAttr []byte
+
+	err := row.Scan (&hook.ID, &hook.UserID, &hook.Org, &hook.Secret, &jAttr, &hook.Disabled, &hook.Failures, &hook.Created, &hook.Updated)
+	if err != nil { return nil, errors.WithStack (err) }
+	if err = this.UM (jAttr, &attr); err != nil { return nil, err }
+
+	hook.Url, hook.Events, hook.Description = attr.Url, attr.Events, attr.Description
+	return hook, nil
+}
+
+func (this *Webhook_c) scanDelivery (row scanner_i) (*models.WebhookDelivery_t, error) {
+	d := &models.WebhookDelivery_t{}
+	err := row.Scan (&d.ID, &d.WebhookID, &d.Event, &d.Payload, &d.Status, &d.Attempts, &d.NextAttempt, &d.ResponseCode, &d.Error, &d.Created, &d.Updated)
+	return d, errors.WithStack (err)
+}
+
+func (this *Webhook_c) listWebhooks (rows *sql.Rows) ([]*models.Webhook_t, error) {
+	defer rows.Close()
+
+	out := make([]*models.Webhook_t, 0)
+	for rows.Next() {
+		hook, err := this.scanWebhook (rows)
+		if err != nil { return nil, err }
+		out = append (out, hook)
+	}
+	return out, this.RowsChk (rows)
+}
+
+func (this *Webhook_c) listDeliveries (rows *sql.Rows) ([]*models.WebhookDelivery_t, error) {
+	defer rows.Close()
+
+	out := make([]*models.WebhookDelivery_t, 0)
+	for rows.Next() {
+		d, err := this.scanDelivery (rows)
+		if err != nil { return nil, err }
+		out = append (out, d)
+	}
+	return out, this.RowsChk (rows)
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- WEBHOOKS ----------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Every webhook the user owns
+*/
+func (this *Webhook_c) List (ctx context.Context, userID models.UUID) ([]*models.Webhook_t, error) {
+	rows, err := this.query (ctx, "webhook_list", `SELECT ` + webhookCols + ` FROM webhooks WHERE user_id = $1 ORDER BY created`, userID)
+	if err != nil { return nil, err }
+	return this.listWebhooks (rows)
+}
+
+/*! \brief Gets a single webhook, the user has to own it. sql.ErrNoRows if they don't
+*/
+func (this *Webhook_c) Get (ctx context.Context, id, userID models.UUID) (*models.Webhook_t, error) {
+	hook, err := this.scanWebhook (this.queryRow (ctx, "webhook_get", `SELECT ` + webhookCols + ` FROM webhooks WHERE id = $1 AND user_id = $2`, id, userID))
+	return hook, errors.Wrapf (err, "webhook: %s :: user: %s", id, userID)
+}
+
+/*! \brief Every webhook that's on for the user, or for their org
+*/
+func (this *Webhook_c) Subscribed (ctx context.Context, userID models.UUID, org string) ([]*models.Webhook_t, error) {
+	rows, err := this.query (ctx, "webhook_subscribed", `SELECT ` + webhookCols + ` FROM webhooks
+							WHERE disabled = false AND (user_id = $1 OR (org <> '' AND org = $2))`, userID, org)
+	if err != nil { return nil, err }
+	return this.listWebhooks (rows)
+}
+
+/*! \brief Creates a new webhook or updates an existing one
+	Turning one back on clears its failures so it gets a fresh start
+*/
+func (this *Webhook_c) Save (ctx context.Context, hook *models.Webhook_t) error {
+	jAttr, err := json.Marshal (webhookAttr_t { Url: hook.Url, Events: hook.Events, Description: hook.Description })
+	if err != nil { return errors.WithStack (err) }
+
+	if hook.ID.Valid() { // we're updating
+		err = this.queryRow (ctx, "webhook_update", `UPDATE webhooks SET attrs = $1, disabled = $2,
+								failures = CASE WHEN $2 THEN failures ELSE 0 END, updated = NOW()
+								WHERE id = $3 AND user_id = $4 RETURNING org, secret, failures, created, updated`,
+								jAttr, hook.Disabled, hook.ID, hook.UserID).Scan(&hook.Org, &hook.Secret, &hook.Failures, &hook.Created, &hook.Updated)
+		return errors.Wrapf (err, "webhook: %s", hook.ID)
+	}
+
+	err = this.queryRow (ctx, "webhook_insert", `INSERT INTO webhooks (user_id, org, secret, attrs, disabled) VALUES ($1, $2, $3, $4, $5)
+							RETURNING id, created, updated`, hook.UserID, hook.Org, hook.Secret, jAttr, hook.Disabled).Scan(&hook.ID, &hook.Created, &hook.Updated)
+	return errors.Wrapf (err, "user: %s", hook.UserID)
+}
+
+/*! \brief Removes the webhook and its delivery log
+	It's one statement so both go or neither does, we never leave deliveries behind for a webhook that's gone
+*/
+func (this *Webhook_c) Delete (ctx context.Context, id, userID models.UUID) error {
+	return errors.Wrapf (this.exec (ctx, "webhook_delete", `WITH hook AS (DELETE FROM webhooks WHERE id = $1 AND user_id = $2 RETURNING id)
+							DELETE FROM webhook_deliveries WHERE webhook_id IN (SELECT id FROM hook)`, id, userID), "webhook: %s", id)
+}
+
+/*! \brief Records a failed attempt, and turns the webhook off once it's failed too many times in a row
+	Returns true if that just happened
+*/
+func (this *Webhook_c) Failed (ctx context.Context, id models.UUID, disableAfter int) (disabled bool, err error) {
+	err = this.queryRow (ctx, "webhook_failed", `UPDATE webhooks SET failures = failures + 1, disabled = disabled OR failures + 1 >= $2, updated = NOW()
+							WHERE id = $1 RETURNING disabled`, id, disableAfter).Scan(&disabled)
+	return disabled, errors.Wrapf (err, "webhook: %s", id)
+}
+
+/*! \brief Clears out the failures after a good delivery
+*/
+func (this *Webhook_c) Succeeded (ctx context.Context, id models.UUID) error {
+	return errors.Wrapf (this.exec (ctx, "webhook_succeeded", `UPDATE webhooks SET failures = 0 WHERE id = $1 AND failures > 0`, id), "webhook: %s", id)
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- DELIVERIES --------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Adds a delivery for its first attempt
+*/
+func (this *Webhook_c) Queue (ctx context.Context, d *models.WebhookDelivery_t) error {
+	err := this.queryRow (ctx, "webhook_delivery_insert", `INSERT INTO webhook_deliveries (webhook_id, event, payload) VALUES ($1, $2, $3)
+							RETURNING id, status, next_attempt, created, updated`, d.WebhookID, d.Event, []byte(d.Payload)).
+							Scan(&d.ID, &d.Status, &d.NextAttempt, &d.Created, &d.Updated)
+	return errors.Wrapf (err, "webhook: %s :: event: %s", d.WebhookID, d.Event)
+}
+
+/*! \brief Newest deliveries first for the webhook, the user has to own it
+*/
+func (this *Webhook_c) Deliveries (ctx context.Context, id, userID models.UUID, limit int) ([]*models.WebhookDelivery_t, error) {
+	rows, err := this.query (ctx, "webhook_deliveries", `SELECT d.id, d.webhook_id, d.event, d.payload, d.status, d.attempts, d.next_attempt,
+							d.response_code, d.error, d.created, d.updated FROM webhook_deliveries d
+							JOIN webhooks w ON w.id = d.webhook_id WHERE d.webhook_id = $1 AND w.user_id = $2
+							ORDER BY d.created DESC LIMIT $3`, id, userID, limit)
+	if err != nil { return nil, err }
+	return this.listDeliveries (rows)
+}
+
+/*! \brief Claims the deliveries that are due, they're pushed out by the lease so no one else picks them up while we're working on them
+*/
+func (this *Webhook_c) Due (ctx context.Context, limit int, lease time.Duration) ([]*models.WebhookDelivery_t, error) {
+	rows, err := this.query (ctx, "webhook_deliveries_due", `UPDATE webhook_deliveries SET next_attempt = NOW() + $3::INTERVAL
+							WHERE id IN (SELECT id FROM webhook_deliveries WHERE status = $1 AND next_attempt <= NOW() ORDER BY next_attempt LIMIT $2)
+							RETURNING ` + deliveryCols, models.WebhookStatus_pending, limit, lease.String())
+	if err != nil { return nil, err }
+	return this.listDeliveries (rows)
+}
+
+/*! \brief Gets the webhook a delivery is going to, regardless of who owns it
+*/
+func (this *Webhook_c) ForDelivery (ctx context.Context, d *models.WebhookDelivery_t) (*models.Webhook_t, error) {
+	hook, err := this.scanWebhook (this.queryRow (ctx, "webhook_for_delivery", `SELECT ` + webhookCols + ` FROM webhooks WHERE id = $1`, d.WebhookID))
+	return hook, errors.Wrapf (err, "webhook: %s :: delivery: %s", d.WebhookID, d.ID)
+}
+
+/*! \brief Saves how the last attempt went, and when the next one is if there is one
+*/
+func (this *Webhook_c) Attempted (ctx context.Context, d *models.WebhookDelivery_t) error {
+	return errors.Wrapf (this.exec (ctx, "webhook_delivery_attempted", `UPDATE webhook_deliveries SET status = $1, attempts = $2, next_attempt = $3,
+							response_code = $4, error = $5, updated = NOW() WHERE id = $6`,
+							d.Status, d.Attempts, d.NextAttempt, d.ResponseCode, d.Error, d.ID), "delivery: %s", d.ID)
+}
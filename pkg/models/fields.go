@@ -0,0 +1,49 @@
+/*! \file fields.go
+	\brief Errors tied to specific fields of an object, so we can tell the user exactly what was wrong
+*/
+
+package models 
+
+import (
+	"strings"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- DATA STRUCTS ------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+//! A single problem with one of the fields passed in, Field is the path to it, ie Attr.First
+type FieldError_t struct {
+	Field, Msg string
+}
+
+//! All the problems we found with an object, this is an error so it can be passed back like any other
+type FieldErrors_t struct {
+	Fields []FieldError_t
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- FUNCTIONS ---------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+func (this *FieldErrors_t) Error () string {
+	out := make([]string, 0, len(this.Fields))
+	for _, f := range this.Fields {
+		out = append (out, f.Field + ": " + f.Msg)
+	}
+	return strings.Join (out, "; ")
+}
+
+/*! \brief Adds a new field error to our list
+*/
+func (this *FieldErrors_t) Add (field, msg string) {
+	this.Fields = append (this.Fields, FieldError_t { Field: field, Msg: msg })
+}
+
+/*! \brief Returns ourselves as an error if we have any fields, otherwise nil
+	Do it this way so we don't end up with a nil pointer inside a non-nil error interface
+*/
+func (this *FieldErrors_t) Err () error {
+	if this == nil || len(this.Fields) == 0 { return nil }
+	return this
+}
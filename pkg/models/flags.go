@@ -0,0 +1,117 @@
+/*! \file flags.go
+	\brief Feature flags, so code can ship dark and get rolled out a bit at a time
+	A flag is on for anyone it targets directly, and for a percentage of everyone else. Variant flags also pick which version they get
+*/
+
+package models
+
+import (
+	"hash/fnv"
+	"strings"
+	"time"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- CONSTS ------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+const flagBuckets = 10000	// percentages are checked to the hundredth
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- DATA STRUCTS ------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+//! One version of a variant flag, Weight is its share of the users that have the flag on
+type FlagVariant_t struct {
+	Name ApiString `validate:"required,max=100"`
+	Weight int `validate:"min=0"`
+}
+
+type Flag_t struct {
+	Key ApiString `validate:"required,max=100"`
+	Description ApiString `json:",omitempty" validate:"max=1000"`
+	Enabled bool	// the kill switch, when this is off the flag is off for everyone
+	Users []string `json:",omitempty"`		// user ids that always get it
+	Orgs []string `json:",omitempty"`		// orgs that always get it
+	Domains []string `json:",omitempty"`	// email domains that always get it, ie example.com
+	Percent float64 `validate:"min=0,max=100"`	// of everyone else
+	Variants []FlagVariant_t `json:",omitempty"`	// leave empty for an on/off flag
+	Created, Updated time.Time
+}
+
+//! Who we're checking a flag for, any of these can be empty
+type FlagTarget_t struct {
+	UserID, Org, Email string
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PRIVATE FUNCTIONS -------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Hashes the id into one of our buckets, the flag key is part of it so each flag rolls out to a different set of users
+*/
+func flagBucket (key, salt, id string) int {
+	h := fnv.New32a()
+	h.Write ([]byte(key + ":" + salt + ":" + id))
+	return int(h.Sum32() % flagBuckets)
+}
+
+func flagContains (list []string, val string) bool {
+	if len(val) == 0 { return false }
+	for _, l := range list {
+		if strings.EqualFold (strings.TrimSpace (l), val) { return true }
+	}
+	return false
+}
+
+/*! \brief The id we bucket on, users first so they get the same answer wherever they are, then their org
+*/
+func (this *FlagTarget_t) bucketID () string {
+	if len(this.UserID) > 0 { return this.UserID }
+	return this.Org
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- FUNCTIONS ---------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Returns the domain part of the email, lowercased
+*/
+func (this *FlagTarget_t) Domain () string {
+	_, domain, found := strings.Cut (this.Email, "@")
+	if !found { return "" }
+	return strings.ToLower (strings.TrimSpace (domain))
+}
+
+/*! \brief True if the flag is targeted at them directly, or they fall into the rollout percentage
+	Targets without a user or org can only get it through the percentage when it's 100
+*/
+func (this *Flag_t) On (target FlagTarget_t) bool {
+	if !this.Enabled { return false }
+
+	if flagContains (this.Users, target.UserID) || flagContains (this.Orgs, target.Org) || flagContains (this.Domains, target.Domain()) { return true }
+
+	if this.Percent >= 100 { return true }
+	id := target.bucketID()
+	if len(id) == 0 { return false }
+	return float64(flagBucket (this.Key.String(), "on", id)) < this.Percent * flagBuckets / 100
+}
+
+/*! \brief Returns the variant they get, empty if the flag is off for them
+	On/off flags return "on", and variants are picked by their weights, the same user always gets the same one
+*/
+func (this *Flag_t) Variant (target FlagTarget_t) string {
+	if !this.On (target) { return "" }
+	if len(this.Variants) == 0 { return "on" }
+
+	total := 0
+	for _, v := range this.Variants { total += v.Weight }
+	if total <= 0 { return this.Variants[0].Name.String() }
+
+	pick := flagBucket (this.Key.String(), "variant", target.bucketID()) % total
+	for _, v := range this.Variants {
+		if pick < v.Weight { return v.Name.String() }
+		pick -= v.Weight
+	}
+	return this.Variants[len(this.Variants)-1].Name.String()
+}
@@ -46,6 +46,12 @@ var (
 	ErrType_permission				= errors.New("You don't have permission to do this")
 	
 	ErrType_tookLongTime			= errors.New("request took a long time to complete")
+	ErrType_queFull					= errors.New("task que is full")
+	ErrType_queClosed				= errors.New("task que is closed")
+	ErrType_taskPermanent			= errors.New("task can't succeed, retrying won't help")
+	ErrType_payloadTooLarge			= errors.New("task payload is too large")
+	ErrType_payloadVersion			= errors.New("task payload is a newer version than we know")
+	ErrType_bodyTooLarge			= errors.New("request body is too large")
 
 	ErrType_nonFatal				= errors.New("non fatal error occured")
 	ErrType_returnToUser 			= errors.New("Error Occured")
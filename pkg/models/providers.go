@@ -0,0 +1,68 @@
+/*! \file providers.go
+	\brief What our providers tell us about the messages we send, bounces, complaints, opt outs and replies
+	Events are saved as they come in and handled by a task, anything we shouldn't send to again is suppressed
+*/
+
+package models
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- CONSTS ------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+const (
+	Provider_mailgun		= "mailgun"
+	Provider_twilio			= "twilio"
+
+	Channel_email			= "email"
+	Channel_sms				= "sms"
+)
+
+//----- EVENTS -----//
+// mailgun events come through as they name them, ie failed, complained, unsubscribed. These are the twilio ones we add
+const (
+	ProviderEvent_inbound	= "inbound"	// a text message sent to us
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- DATA STRUCTS ------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+type ProviderEvent_t struct {
+	ID UUID `json:",omitempty"`
+	Provider, Event string
+	ProviderID string	// their id for it, so we only record each one once
+	Recipient string	// the email or phone number it's about, for inbound texts who it's from
+	Attr struct {
+		Severity, Reason, Message string `json:",omitempty"`
+		Code int `json:",omitempty"`
+		Body string `json:",omitempty"`		// inbound texts
+		OptOut string `json:",omitempty"`	// STOP or START for inbound texts that are one
+	}
+	Data json.RawMessage `json:",omitempty"`	// everything they sent us
+	Processed bool
+	Created time.Time
+}
+
+//! An address we don't send to anymore
+type Suppression_t struct {
+	Channel, Address, Reason string
+	Created time.Time
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- FUNCTIONS ---------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Emails are matched without case, phone numbers as they are
+*/
+func SuppressionAddress (channel, address string) string {
+	address = strings.TrimSpace (address)
+	if channel == Channel_email { return strings.ToLower (address) }
+	return address
+}
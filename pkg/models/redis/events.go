@@ -0,0 +1,135 @@
+/*! \file events.go
+  \brief Real-time events for users
+  Every event goes into a short stream per user so clients can catch up, and is published so every api instance hears about it
+*/
+
+package redis
+
+import (
+	"github.com/mediocregopher/radix/v3"
+	"github.com/pkg/errors"
+
+	"fmt"
+	"context"
+	"encoding/json"
+	"strings"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- CONSTS ------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+const eventsPrefix = "events:"
+
+const (
+	defaultEventReplay		= 100	// events we keep per user for reconnects
+	defaultEventReplayTTL	= 3600	// seconds the stream sticks around after the last event
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- STRUCTS -----------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+//! A single event for a user, the ID is the redis stream id so it can be passed back as the Last-Event-ID
+type Event_t struct {
+	ID, UserID, Type string
+	Data json.RawMessage
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PRIVATE FUNCTIONS -------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+func eventsKey (userID string) string {
+	return eventsPrefix + userID
+}
+
+/*! \brief Converts a stream entry back into our event
+*/
+func eventFromEntry (userID string, entry radix.StreamEntry) Event_t {
+	return Event_t { ID: entry.ID.String(), UserID: userID, Type: entry.Fields["type"], Data: json.RawMessage (entry.Fields["data"]) }
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- EVENTS ------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Saves the event for replays and publishes it to whichever instance the user is connected to
+	replay and ttl are how many events we keep for the user, and for how long, zero uses our defaults
+*/
+func (this *DB_c) PublishEvent (ctx context.Context, userID, eventType string, data interface{}, replay, ttl int) (string, error) {
+	if this.DB == nil { return "", errors.WithStack (ErrNoServiceAvailable) }
+	if replay <= 0 { replay = defaultEventReplay }
+	if ttl <= 0 { ttl = defaultEventReplayTTL }
+
+	jData, err := json.Marshal (data)
+	if err != nil { return "", errors.WithStack (err) }
+
+	key := eventsKey (userID)
+	id := ""
+	err = this.record ("XADD", this.do (ctx, "XADD", radix.Cmd (&id, "XADD", key, "MAXLEN", "~", fmt.Sprintf("%d", replay), "*", "type", eventType, "data", string(jData))))
+	if err != nil { return "", errors.Wrap (err, userID) }
+
+	this.expire (ctx, key, ttl) // the stream goes away once they've been quiet for a while
+
+	jEvent, err := json.Marshal (Event_t { ID: id, UserID: userID, Type: eventType, Data: jData })
+	if err != nil { return id, errors.WithStack (err) }
+
+	err = this.record ("PUBLISH", this.do (ctx, "PUBLISH", radix.Cmd (nil, "PUBLISH", key, string(jEvent))))
+	return id, errors.Wrap (err, userID)
+}
+
+/*! \brief Returns the events after lastID that are still in the user's stream, oldest first
+*/
+func (this *DB_c) EventsSince (ctx context.Context, userID, lastID string) ([]Event_t, error) {
+	if this.DB == nil { return nil, errors.WithStack (ErrNoServiceAvailable) }
+
+	entries := make([]radix.StreamEntry, 0)
+	err := this.record ("XRANGE", this.do (ctx, "XRANGE", radix.Cmd (&entries, "XRANGE", eventsKey (userID), "(" + lastID, "+", "COUNT", fmt.Sprintf("%d", defaultEventReplay))))
+	if err != nil { return nil, errors.Wrapf (err, "%s : %s", userID, lastID) }
+
+	out := make([]Event_t, 0, len(entries))
+	for _, e := range entries { out = append (out, eventFromEntry (userID, e)) }
+	return out, nil
+}
+
+/*! \brief Listens for every user's events on their own connection, sending them to out
+	Returns the function to call to stop listening
+*/
+func (this *DB_c) SubscribeEvents (out chan<- Event_t) (func() error, error) {
+	if len(this.Addr) == 0 { return nil, errors.WithStack (ErrNoServiceAvailable) }
+
+	ps, err := radix.PersistentPubSubWithOpts ("tcp", this.Addr) // this reconnects on its own if redis goes away
+	if err != nil { return nil, errors.WithStack (this.locErr (err)) }
+
+	msgs := make(chan radix.PubSubMessage, 100)
+	if err = ps.PSubscribe (msgs, eventsPrefix + "*"); err != nil {
+		ps.Close()
+		return nil, errors.WithStack (err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case msg := <-msgs:
+				event := Event_t{}
+				if err := json.Unmarshal (msg.Message, &event); err != nil { continue } // not one of ours
+				if len(event.UserID) == 0 { event.UserID = strings.TrimPrefix (msg.Channel, eventsPrefix) }
+
+				select {
+				case out <- event:
+				case <-done:	// whoever was reading out may already be gone
+					return
+				}
+			}
+		}
+	}()
+
+	return func() error {
+		close (done)
+		return ps.Close()
+	}, nil
+}
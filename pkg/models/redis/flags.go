@@ -0,0 +1,62 @@
+/*! \file flags.go
+  \brief Lets every instance know when a feature flag changes, so they can drop their cached copy
+*/
+
+package redis
+
+import (
+	"github.com/mediocregopher/radix/v3"
+	"github.com/pkg/errors"
+
+	"context"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- CONSTS ------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+const flagsChannel = "flags:changed"
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- FLAGS -------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Tells every instance the flags changed
+*/
+func (this *DB_c) PublishFlagsChanged (ctx context.Context, key string) error {
+	if this.DB == nil { return errors.WithStack (ErrNoServiceAvailable) }
+	return errors.Wrap (this.record ("PUBLISH", this.do (ctx, "PUBLISH", radix.Cmd (nil, "PUBLISH", flagsChannel, key))), key)
+}
+
+/*! \brief Calls fn with the key of any flag that changes, on its own connection
+	Returns the function to call to stop listening
+*/
+func (this *DB_c) SubscribeFlagsChanged (fn func (key string)) (func() error, error) {
+	if len(this.Addr) == 0 { return nil, errors.WithStack (ErrNoServiceAvailable) }
+
+	ps, err := radix.PersistentPubSubWithOpts ("tcp", this.Addr) // this reconnects on its own if redis goes away
+	if err != nil { return nil, errors.WithStack (this.locErr (err)) }
+
+	msgs := make(chan radix.PubSubMessage, 10)
+	if err = ps.Subscribe (msgs, flagsChannel); err != nil {
+		ps.Close()
+		return nil, errors.WithStack (err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case msg := <-msgs:
+				fn (string(msg.Message))
+			}
+		}
+	}()
+
+	return func() error {
+		close (done)
+		return ps.Close()
+	}, nil
+}
@@ -0,0 +1,70 @@
+/*! \file idempotency.go
+  \brief Stores the responses for requests sent with an Idempotency-Key, so retries get the same answer
+*/
+
+package redis
+
+import (
+	"github.com/pkg/errors"
+
+	"context"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- CONSTS ------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+const idempotentPrefix = "idem:"
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- STRUCTS -----------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+//! What we store for a single key, Done is false while the first request is still running
+type Idempotent_t struct {
+	Fingerprint string
+	Done bool
+	Status int
+	Header map[string][]string `json:",omitempty"`
+	Body []byte `json:",omitempty"`
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- IDEMPOTENCY -------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Tries to claim the key for this request
+	Returns nil if we got it and the request should run, otherwise the record from the request that already has it
+*/
+func (this *DB_c) IdempotentStart (ctx context.Context, key, fingerprint string, timeout int) (*Idempotent_t, error) {
+	for i := 0; i < 2; i++ { // it can expire between the set and the get, so give it one more shot
+		ok, err := this.setnx (ctx, idempotentPrefix + key, timeout, &Idempotent_t { Fingerprint: fingerprint })
+		if err != nil { return nil, err }
+		if ok { return nil, nil } // it's ours
+
+		existing := &Idempotent_t{}
+		err = this.get (ctx, idempotentPrefix + key, existing)
+		switch errors.Cause (err) {
+		case nil:
+			return existing, nil
+		case ErrKeyNotFound:
+			continue
+		default:
+			return nil, err
+		}
+	}
+	return nil, errors.WithStack (ErrKeyNotFound)
+}
+
+/*! \brief Saves the final response so any retries get it replayed
+*/
+func (this *DB_c) IdempotentFinish (ctx context.Context, key string, rec *Idempotent_t, timeout int) bool {
+	rec.Done = true
+	return this.set (ctx, idempotentPrefix + key, timeout, rec)
+}
+
+/*! \brief Lets the key be used again, for when the request failed in a way the retry might fix
+*/
+func (this *DB_c) IdempotentRelease (ctx context.Context, key string) bool {
+	return this.del (ctx, idempotentPrefix + key)
+}
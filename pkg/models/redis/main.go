@@ -8,8 +8,13 @@ import (
 
 	"github.com/mediocregopher/radix/v3"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 
 	"fmt"
+	"context"
 	"log"
 	"encoding/json"
 	"strings"
@@ -27,6 +32,8 @@ var ErrPingFailed = errors.New("Ping did not Pong")
 const MaxPoolSize = 10     //max number of cache threads waiting in the pool
 const defaultCacheTime = 60 	//time in seconds for our default cache to expire
 
+var tracer = otel.Tracer ("github.com/NathanRThomas/boiler_api/pkg/models/redis")
+
   //-------------------------------------------------------------------------------------------------------------------------//
  //----- STRUCTS -----------------------------------------------------------------------------------------------------------//
 //-------------------------------------------------------------------------------------------------------------------------//
@@ -35,11 +42,35 @@ type redisQue_t struct {
 	Key, Val string
 }
 
+//! How busy our pool of connections is
+type PoolStats_t struct {
+	Available, Size int
+}
+
 type DB_c struct {
 	DB 			*radix.Pool
+	Addr		string	// ip:port, pub/sub needs its own connection outside of the pool
+	Observer	func (command, result string)	// called after every command, this is how we hook in our metrics
     pushes 		[]redisQue_t	//list of items that didn't get queued
 }
 
+/*! \brief Reports the result of the command to our observer, if we have one
+	Passes the error back out so it can wrap the call
+*/
+func (this *DB_c) record (command string, err error) error {
+	if this.Observer != nil {
+		switch {
+		case err == nil:
+			this.Observer (command, "ok")
+		case errors.Cause(err) == ErrKeyNotFound:
+			this.Observer (command, "miss")
+		default:
+			this.Observer (command, "error")
+		}
+	}
+	return err
+}
+
 /*! \brief We "expect" there to be a connection refused when we have our redis server down, otherwise we want to handle errors from redis
 */
 func (this *DB_c) locErr (err error) error {
@@ -52,15 +83,34 @@ func (this *DB_c) locErr (err error) error {
 	return err
 }
 
-func (this *DB_c) getHandleNil (command, key string, val interface{}) error {
+/*! \brief Runs a single command against redis, wrapped in its own span
+	Checks the context first so we don't bother redis if the request was already cancelled
+*/
+func (this *DB_c) do (ctx context.Context, command string, action radix.Action) error {
+	_, span := tracer.Start (ctx, "redis " + command, trace.WithSpanKind (trace.SpanKindClient), 
+		trace.WithAttributes (attribute.String ("db.system", "redis"), attribute.String ("db.operation", command)))
+	defer span.End()
+
+	err := ctx.Err()
+	if err == nil { err = this.locErr (this.DB.Do (action)) }
+
+	if err != nil {
+		span.RecordError (err)
+		span.SetStatus (codes.Error, err.Error())
+	}
+	return err
+}
+
+func (this *DB_c) getHandleNil (ctx context.Context, command, key string, val interface{}) error {
 	if this.DB == nil { return errors.WithStack (ErrNoServiceAvailable) }
 	loc := ""
 	mn := radix.MaybeNil{Rcv: &loc}
-	if err := this.DB.Do(radix.Cmd(&mn, command, key)); err == nil {
-		if mn.Nil || len(loc) == 0 { return errors.WithStack (ErrKeyNotFound) }
+	if err := this.do(ctx, command, radix.Cmd(&mn, command, key)); err == nil {
+		if mn.Nil || len(loc) == 0 { return this.record (command, errors.WithStack (ErrKeyNotFound)) }
+		if this.Observer != nil { this.Observer (command, "hit") }
 		return errors.Wrapf(json.Unmarshal([]byte(loc), val), " %s : %s ", key, loc)	//wrap this with whatever the string we failed to extract was
 	} else {
-		return errors.WithStack(this.locErr(err))	// see if this is worth recording
+		return this.record (command, errors.WithStack(err))	// see if this is worth recording
 	}
 }
 
@@ -77,9 +127,9 @@ func (this *DB_c) js (in interface{}) string {
  //----- SPECIFIC FUNCTIONS ------------------------------------------------------------------------------------------------//
 //-------------------------------------------------------------------------------------------------------------------------//
 
-func (this *DB_c) lpush (key string, val interface{}) (err error) {
+func (this *DB_c) lpush (ctx context.Context, key string, val interface{}) (err error) {
 	if this.DB != nil {
-		err = errors.WithStack(this.locErr(this.DB.Do(radix.FlatCmd(nil, "LPUSH", key, this.js(val))))) // either it was good or we can't handle the error
+		err = this.record ("LPUSH", errors.WithStack(this.do(ctx, "LPUSH", radix.FlatCmd(nil, "LPUSH", key, this.js(val))))) // either it was good or we can't handle the error
 		if err == nil { return }	//it worked
 	} else {
 		err = errors.WithStack (ErrServiceDown)
@@ -90,63 +140,76 @@ func (this *DB_c) lpush (key string, val interface{}) (err error) {
 	return 
 }
 
-func (this *DB_c) rpop (key string, val interface{}) error {
-	return this.getHandleNil ("RPOP", key, val)
+func (this *DB_c) rpop (ctx context.Context, key string, val interface{}) error {
+	return this.getHandleNil (ctx, "RPOP", key, val)
 }
 
-func (this *DB_c) get (key string, val interface{}) error {
-	return this.getHandleNil ("GET", key, val)
+func (this *DB_c) get (ctx context.Context, key string, val interface{}) error {
+	return this.getHandleNil (ctx, "GET", key, val)
 }
 
-func (this *DB_c) set (key string, timeout int, val interface{}) bool {
+func (this *DB_c) set (ctx context.Context, key string, timeout int, val interface{}) bool {
 	if this.DB == nil { return false }
-	return this.locErr(this.DB.Do(radix.FlatCmd(nil, "SETEX", key, fmt.Sprintf("%d", timeout), this.js(val)))) == nil
+	return this.record ("SETEX", this.do(ctx, "SETEX", radix.FlatCmd(nil, "SETEX", key, fmt.Sprintf("%d", timeout), this.js(val)))) == nil
+}
+
+/*! \brief Sets the key only if it doesn't already exist, returns true if we set it
+*/
+func (this *DB_c) setnx (ctx context.Context, key string, timeout int, val interface{}) (bool, error) {
+	if this.DB == nil { return false, errors.WithStack (ErrNoServiceAvailable) }
+	out := ""
+	mn := radix.MaybeNil{Rcv: &out}
+	if err := this.record ("SETNX", this.do(ctx, "SETNX", radix.FlatCmd(&mn, "SET", key, this.js(val), "NX", "EX", fmt.Sprintf("%d", timeout)))); err != nil {
+		return false, errors.WithStack (err)
+	}
+	return !mn.Nil && out == "OK", nil
 }
 
-func (this *DB_c) del (key string) bool {
+func (this *DB_c) del (ctx context.Context, key string) bool {
 	if this.DB == nil { return false }
-	return this.locErr(this.DB.Do(radix.FlatCmd(nil, "DEL", key))) == nil
+	return this.record ("DEL", this.do(ctx, "DEL", radix.FlatCmd(nil, "DEL", key))) == nil
 }
 
-func (this *DB_c) llen (key string) (size int) {
+func (this *DB_c) llen (ctx context.Context, key string) (size int) {
 	if this.DB == nil { return }
-	this.locErr(this.DB.Do(radix.Cmd(&size, "LLEN", key)))
+	this.record ("LLEN", this.do(ctx, "LLEN", radix.Cmd(&size, "LLEN", key)))
 	return
 }
 
-func (this *DB_c) sadd (key string, val interface{}) bool {
+func (this *DB_c) sadd (ctx context.Context, key string, val interface{}) bool {
 	if this.DB == nil { return false }
-	return this.locErr(this.DB.Do(radix.FlatCmd(nil, "SADD", key, this.js(val)))) == nil
+	return this.record ("SADD", this.do(ctx, "SADD", radix.FlatCmd(nil, "SADD", key, this.js(val)))) == nil
 }
 
-func (this *DB_c) spop (key string, val interface{}) error {
-	return this.getHandleNil ("SPOP", key, val)
+func (this *DB_c) spop (ctx context.Context, key string, val interface{}) error {
+	return this.getHandleNil (ctx, "SPOP", key, val)
 }
 
-func (this *DB_c) zadd (key string, score int64, val string) bool {
+func (this *DB_c) zadd (ctx context.Context, key string, score int64, val string) bool {
 	if this.DB == nil { return false }
-	return this.locErr(this.DB.Do(radix.Cmd(nil, "ZADD", key, fmt.Sprintf("%d", score), val))) == nil
+	return this.record ("ZADD", this.do(ctx, "ZADD", radix.Cmd(nil, "ZADD", key, fmt.Sprintf("%d", score), val))) == nil
 }
 
-func (this *DB_c) zrange (key string, score int64) []string {
+func (this *DB_c) zrange (ctx context.Context, key string, score int64) []string {
 	ret := make([]string, 0)
-	this.locErr(this.DB.Do(radix.Cmd(&ret, "ZRANGE", key, "0", fmt.Sprintf("%d", score))))
+	if this.DB == nil { return ret }
+	this.record ("ZRANGE", this.do(ctx, "ZRANGE", radix.Cmd(&ret, "ZRANGE", key, "0", fmt.Sprintf("%d", score))))
 	return ret
 }
 
-func (this *DB_c) zrem (key, member string) bool {
+func (this *DB_c) zrem (ctx context.Context, key, member string) bool {
 	if this.DB == nil { return false }
-	return this.locErr(this.DB.Do(radix.FlatCmd(nil, "ZREM", key, member))) == nil
+	return this.record ("ZREM", this.do(ctx, "ZREM", radix.FlatCmd(nil, "ZREM", key, member))) == nil
 }
 
-func (this *DB_c) expire (key string, timeout int) bool {
+func (this *DB_c) expire (ctx context.Context, key string, timeout int) bool {
 	if this.DB == nil { return false }
-	return this.locErr(this.DB.Do(radix.FlatCmd(nil, "EXPIRE", key, fmt.Sprintf("%d", timeout)))) == nil
+	return this.record ("EXPIRE", this.do(ctx, "EXPIRE", radix.FlatCmd(nil, "EXPIRE", key, fmt.Sprintf("%d", timeout)))) == nil
 }
 
-func (this *DB_c) incr (key string) (out int) {
+func (this *DB_c) incr (ctx context.Context, key string) (out int) {
 	if this.DB == nil { return }
-	this.locErr(this.DB.Do(radix.Cmd(&out, "INCR", key)))
+	this.record ("INCR", this.do(ctx, "INCR", radix.Cmd(&out, "INCR", key)))
 	return
 }
 
@@ -154,11 +217,11 @@ func (this *DB_c) incr (key string) (out int) {
  //----- TESTING -----------------------------------------------------------------------------------------------------------//
 //-------------------------------------------------------------------------------------------------------------------------//
 
-func (this *DB_c) Ping () error {
+func (this *DB_c) Ping (ctx context.Context) error {
 	if this.DB == nil { return nil } // this is bad
 
 	out := ""
-	if err := this.locErr (this.DB.Do (radix.Cmd(&out, "PING"))); err == nil {
+	if err := this.do (ctx, "PING", radix.Cmd(&out, "PING")); err == nil {
 		if out == "PONG" { return nil }
 		return errors.WithStack (ErrPingFailed)
 	} else {
@@ -166,6 +229,13 @@ func (this *DB_c) Ping () error {
 	}
 }
 
+/*! \brief How many connections in the pool are sitting idle, out of how many we keep
+*/
+func (this *DB_c) Stats () PoolStats_t {
+	if this == nil || this.DB == nil { return PoolStats_t{} }
+	return PoolStats_t { Available: this.DB.NumAvailConns(), Size: MaxPoolSize }
+}
+
 /*	
 	if goodCnt == len(toolz.AppConfig.Redis.IPs) {	//we're all good, add in our "pending" channels
 		for len(this.pushes) > 0 {	// we recovered from an error, que the remaining items
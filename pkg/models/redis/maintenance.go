@@ -0,0 +1,66 @@
+/*! \file maintenance.go
+  \brief The cluster-wide maintenance flag, every api instance checks this
+*/
+
+package redis
+
+import (
+	"github.com/mediocregopher/radix/v3"
+	"github.com/pkg/errors"
+
+	"context"
+	"time"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- CONSTS ------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+const maintenanceKey = "maintenance"
+
+const (
+	Maintenance_off			= ""
+	Maintenance_readOnly	= "read-only"	// only GET requests go through
+	Maintenance_full		= "full"		// nothing goes through
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- STRUCTS -----------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+type Maintenance_t struct {
+	Mode string `validate:"required,enum=read-only|full"`
+	Message string `json:",omitempty" validate:"max=500"`	// what we tell the users, we have a default
+	RetryAfter int `json:",omitempty" validate:"max=86400"`	// seconds, goes in the Retry-After header
+	Since time.Time
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- MAINTENANCE -------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Returns the current maintenance setting, the Mode is Maintenance_off if we're not in maintenance
+*/
+func (this *DB_c) GetMaintenance (ctx context.Context) (*Maintenance_t, error) {
+	ret := &Maintenance_t {}
+	err := this.get (ctx, maintenanceKey, ret)
+	if errors.Cause (err) == ErrKeyNotFound { return ret, nil }
+	return ret, err
+}
+
+/*! \brief Turns on maintenance mode for every instance, it stays on until it's cleared
+*/
+func (this *DB_c) SetMaintenance (ctx context.Context, m *Maintenance_t) error {
+	if this.DB == nil { return errors.WithStack (ErrNoServiceAvailable) }
+	if m.Mode != Maintenance_readOnly && m.Mode != Maintenance_full { return errors.Errorf ("unknown maintenance mode '%s'", m.Mode) }
+	if m.Since.IsZero() { m.Since = time.Now().UTC() }
+
+	return errors.WithStack (this.record ("SET", this.do (ctx, "SET", radix.FlatCmd (nil, "SET", maintenanceKey, this.js (m)))))
+}
+
+/*! \brief Takes us out of maintenance mode
+*/
+func (this *DB_c) ClearMaintenance (ctx context.Context) error {
+	if this.DB == nil { return errors.WithStack (ErrNoServiceAvailable) }
+	return errors.WithStack (this.record ("DEL", this.do (ctx, "DEL", radix.FlatCmd (nil, "DEL", maintenanceKey))))
+}
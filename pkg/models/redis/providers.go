@@ -0,0 +1,32 @@
+/*! \file providers.go
+  \brief Remembers the tokens on signed provider webhooks, so a captured request can't be replayed to another instance
+*/
+
+package redis
+
+import (
+	"context"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- CONSTS ------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+const providerTokenPrefix = "provider:token:"
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PROVIDERS ---------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Claims the token for this request, false if any instance has already seen it
+	Keep the timeout at least as long as the signature tolerance, after that the signature check turns them away
+*/
+func (this *DB_c) ProviderTokenClaim (ctx context.Context, provider, token string, timeout int) (bool, error) {
+	return this.setnx (ctx, providerTokenPrefix + provider + ":" + token, timeout, true)
+}
+
+/*! \brief Lets the token be used again, for when we failed to handle it and the provider's retry should go through
+*/
+func (this *DB_c) ProviderTokenRelease (ctx context.Context, provider, token string) bool {
+	return this.del (ctx, providerTokenPrefix + provider + ":" + token)
+}
@@ -0,0 +1,175 @@
+/*! \file que.go
+  \brief Reliable task que shared by every instance, so queued work survives a crash or a deploy
+  Ids wait in a list and the tasks themselves are in a hash. Popping one leases it until a deadline, if it isn't acked by then
+  Recover puts it back in the list for someone else. Retries wait in a sorted set until they're due, Recover moves those over too
+*/
+
+package redis
+
+import (
+	"github.com/mediocregopher/radix/v3"
+	"github.com/pkg/errors"
+
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- CONSTS ------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+const (
+	queKey			= "tasks:que"		// ids waiting for a worker, pushed on the left and popped from the right
+	queDataKey		= "tasks:data"		// id -> task
+	queLeaseKey		= "tasks:leases"	// ids being worked on, scored by when their lease runs out
+	queDelayKey		= "tasks:delayed"	// ids waiting to be retried, scored by when they're due
+)
+
+var (
+	// KEYS que, data ARGV id, task
+	quePushScript = radix.NewEvalScript (2, `
+		redis.call('HSET', KEYS[2], ARGV[1], ARGV[2])
+		return redis.call('LPUSH', KEYS[1], ARGV[1])`)
+
+	// KEYS que, data, leases ARGV lease deadline
+	quePopScript = radix.NewEvalScript (3, `
+		local id = redis.call('RPOP', KEYS[1])
+		if not id then return false end
+		redis.call('ZADD', KEYS[3], ARGV[1], id)
+		local task = redis.call('HGET', KEYS[2], id)
+		if not task then
+			redis.call('ZREM', KEYS[3], id)
+			task = ''
+		end
+		return { id, task }`)
+
+	// KEYS data, leases ARGV id
+	queAckScript = radix.NewEvalScript (2, `
+		redis.call('ZREM', KEYS[2], ARGV[1])
+		return redis.call('HDEL', KEYS[1], ARGV[1])`)
+
+	// KEYS data, leases, delayed ARGV id, task, due
+	queRetryScript = radix.NewEvalScript (3, `
+		redis.call('ZREM', KEYS[2], ARGV[1])
+		redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+		return redis.call('ZADD', KEYS[3], ARGV[3], ARGV[1])`)
+
+	// KEYS que, leases, delayed ARGV now, limit
+	// orphans go to the front of the line since they've already waited, retries that are due to the back
+	queRecoverScript = radix.NewEvalScript (3, `
+		local ids = redis.call('ZRANGEBYSCORE', KEYS[2], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+		for _, id in ipairs(ids) do
+			redis.call('ZREM', KEYS[2], id)
+			redis.call('RPUSH', KEYS[1], id)
+		end
+		local due = redis.call('ZRANGEBYSCORE', KEYS[3], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+		for _, id in ipairs(due) do
+			redis.call('ZREM', KEYS[3], id)
+			redis.call('LPUSH', KEYS[1], id)
+		end
+		return #ids`)
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PRIVATE FUNCTIONS -------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+func leaseDeadline (visibility time.Duration) string {
+	return strconv.FormatInt (time.Now().Add (visibility).UnixMilli(), 10)
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- QUE ---------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Adds the task to the que, the id has to be unique
+*/
+func (this *DB_c) QuePush (ctx context.Context, id string, task interface{}) error {
+	if this.DB == nil { return errors.WithStack (ErrNoServiceAvailable) }
+
+	jTask, err := json.Marshal (task)
+	if err != nil { return errors.WithStack (err) }
+
+	return this.record ("QUEPUSH", errors.Wrap (this.do (ctx, "QUEPUSH", quePushScript.Cmd (nil, queKey, queDataKey, id, string(jTask))), id))
+}
+
+/*! \brief Takes the next task and leases it for the visibility, ErrKeyNotFound when there's nothing waiting
+	Returns the id it was pushed with, to ack it once it's done, and the task as it was pushed
+*/
+func (this *DB_c) QuePop (ctx context.Context, visibility time.Duration) (string, []byte, error) {
+	if this.DB == nil { return "", nil, errors.WithStack (ErrNoServiceAvailable) }
+
+	for {
+		var out []string
+		mn := radix.MaybeNil { Rcv: &out }
+		if err := this.do (ctx, "QUEPOP", quePopScript.Cmd (&mn, queKey, queDataKey, queLeaseKey, leaseDeadline (visibility))); err != nil {
+			return "", nil, this.record ("QUEPOP", errors.WithStack (err))
+		}
+		if mn.Nil || len(out) < 2 { return "", nil, this.record ("QUEPOP", errors.WithStack (ErrKeyNotFound)) }
+		if len(out[1]) == 0 { continue }	// it was acked while it was waiting, nothing to do for this one
+
+		this.record ("QUEPOP", nil)
+		return out[0], []byte(out[1]), nil
+	}
+}
+
+/*! \brief Pushes the lease out, for tasks that run longer than the visibility they were popped with
+*/
+func (this *DB_c) QueExtend (ctx context.Context, id string, visibility time.Duration) error {
+	if this.DB == nil { return errors.WithStack (ErrNoServiceAvailable) }
+	return this.record ("ZADD", errors.Wrap (this.do (ctx, "ZADD", radix.Cmd (nil, "ZADD", queLeaseKey, "XX", leaseDeadline (visibility), id)), id))
+}
+
+/*! \brief We're done with the task, it's removed for good
+*/
+func (this *DB_c) QueAck (ctx context.Context, id string) error {
+	if this.DB == nil { return errors.WithStack (ErrNoServiceAvailable) }
+	return this.record ("QUEACK", errors.Wrap (this.do (ctx, "QUEACK", queAckScript.Cmd (nil, queDataKey, queLeaseKey, id)), id))
+}
+
+/*! \brief Releases our lease and has the task wait for the delay before it's back in the que
+	The task is saved again, so whatever changed on it, ie the attempts, comes with it
+*/
+func (this *DB_c) QueRetry (ctx context.Context, id string, task interface{}, delay time.Duration) error {
+	if this.DB == nil { return errors.WithStack (ErrNoServiceAvailable) }
+
+	jTask, err := json.Marshal (task)
+	if err != nil { return errors.WithStack (err) }
+
+	return this.record ("QUERETRY", errors.Wrap (this.do (ctx, "QUERETRY", queRetryScript.Cmd (nil, queDataKey, queLeaseKey, queDelayKey, id, string(jTask), leaseDeadline (delay))), id))
+}
+
+/*! \brief Puts tasks whose lease ran out back in the que, their worker died or got stuck. Returns how many it found
+	Also moves over any retries that are due
+*/
+func (this *DB_c) QueRecover (ctx context.Context, limit int) (int, error) {
+	if this.DB == nil { return 0, errors.WithStack (ErrNoServiceAvailable) }
+
+	var cnt int
+	err := this.do (ctx, "QUERECOVER", queRecoverScript.Cmd (&cnt, queKey, queLeaseKey, queDelayKey, strconv.FormatInt (time.Now().UnixMilli(), 10), strconv.Itoa (limit)))
+	return cnt, this.record ("QUERECOVER", errors.WithStack (err))
+}
+
+/*! \brief Tasks waiting for a worker
+*/
+func (this *DB_c) QueLen (ctx context.Context) int {
+	return this.llen (ctx, queKey)
+}
+
+/*! \brief Tasks being worked on right now
+*/
+func (this *DB_c) QueLeased (ctx context.Context) (out int) {
+	if this.DB == nil { return }
+	this.record ("ZCARD", this.do (ctx, "ZCARD", radix.Cmd (&out, "ZCARD", queLeaseKey)))
+	return
+}
+
+/*! \brief Tasks waiting to be retried
+*/
+func (this *DB_c) QueDelayed (ctx context.Context) (out int) {
+	if this.DB == nil { return }
+	this.record ("ZCARD", this.do (ctx, "ZCARD", radix.Cmd (&out, "ZCARD", queDelayKey)))
+	return
+}
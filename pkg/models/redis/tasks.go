@@ -0,0 +1,160 @@
+/*! \file tasks.go
+  \brief Tasks we couldn't handle or gave up on, kept in redis so someone can look at them and replay them
+*/
+
+package redis
+
+import (
+	"github.com/mediocregopher/radix/v3"
+	"github.com/pkg/errors"
+
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- CONSTS ------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+const (
+	deadLetterDataKey	= "tasks:dead:data"		// id -> dead letter
+	deadLetterOrderKey	= "tasks:dead:order"	// ids scored by when they died, in milliseconds
+	DeadLetterMax		= 10000	// newest ones we keep, so a bad deploy can't fill redis
+)
+
+var (
+	// KEYS data order ARGV id time letter max. the oldest past max are dropped
+	deadLetterPushScript = radix.NewEvalScript (2, `
+		redis.call('HSET', KEYS[1], ARGV[1], ARGV[3])
+		redis.call('ZADD', KEYS[2], ARGV[2], ARGV[1])
+		local over = redis.call('ZCARD', KEYS[2]) - tonumber(ARGV[4])
+		if over > 0 then
+			local old = redis.call('ZRANGE', KEYS[2], 0, over - 1)
+			redis.call('ZREMRANGEBYRANK', KEYS[2], 0, over - 1)
+			redis.call('HDEL', KEYS[1], unpack(old))
+		end
+		return 1`)
+
+	// KEYS data order ARGV start stop, newest first
+	deadLetterRangeScript = radix.NewEvalScript (2, `
+		local out = {}
+		for _, id in ipairs(redis.call('ZREVRANGE', KEYS[2], ARGV[1], ARGV[2])) do
+			local v = redis.call('HGET', KEYS[1], id)
+			if v then table.insert(out, v) end
+		end
+		return out`)
+
+	// KEYS data order ARGV id
+	deadLetterTakeScript = radix.NewEvalScript (2, `
+		local v = redis.call('HGET', KEYS[1], ARGV[1])
+		if not v then return false end
+		redis.call('HDEL', KEYS[1], ARGV[1])
+		redis.call('ZREM', KEYS[2], ARGV[1])
+		return v`)
+
+	// KEYS data order
+	deadLetterPurgeScript = radix.NewEvalScript (2, `
+		local cnt = redis.call('HLEN', KEYS[1])
+		redis.call('DEL', KEYS[1], KEYS[2])
+		return cnt`)
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- STRUCTS -----------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+type DeadLetter_t struct {
+	ID string
+	Task json.RawMessage	// the models.Que_t as it was when we gave up on it
+	Error string	// from the last attempt
+	Stack []string `json:",omitempty"`
+	Time time.Time
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PRIVATE FUNCTIONS -------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+func deadLetterID () string {
+	b := make([]byte, 8)
+	rand.Read (b)
+	return hex.EncodeToString (b)
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- DEAD LETTERS ------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Saves the dead letter by its id, dropping the oldest once we're past DeadLetterMax
+	The ID and time are set here, unless it's one we're putting back, which keeps its place
+*/
+func (this *DB_c) PushDeadLetter (ctx context.Context, dl *DeadLetter_t) error {
+	if this.DB == nil { return errors.WithStack (ErrNoServiceAvailable) }
+	if len(dl.ID) == 0 { dl.ID = deadLetterID() }
+	if dl.Time.IsZero() { dl.Time = time.Now() }
+
+	jDL, err := json.Marshal (dl)
+	if err != nil { return errors.WithStack (err) }
+
+	err = this.do (ctx, "DEADPUSH", deadLetterPushScript.Cmd (nil, deadLetterDataKey, deadLetterOrderKey,
+					dl.ID, strconv.FormatInt (dl.Time.UnixMilli(), 10), string(jDL), strconv.Itoa (DeadLetterMax)))
+	return this.record ("DEADPUSH", errors.Wrap (err, dl.ID))
+}
+
+/*! \brief Returns a page of dead letters, newest first
+*/
+func (this *DB_c) DeadLetters (ctx context.Context, offset, limit int) ([]*DeadLetter_t, error) {
+	if this.DB == nil { return nil, errors.WithStack (ErrNoServiceAvailable) }
+
+	var raw []string
+	err := this.do (ctx, "DEADRANGE", deadLetterRangeScript.Cmd (&raw, deadLetterDataKey, deadLetterOrderKey, strconv.Itoa (offset), strconv.Itoa (offset + limit - 1)))
+	if err = this.record ("DEADRANGE", err); err != nil { return nil, errors.WithStack (err) }
+
+	out := make([]*DeadLetter_t, 0, len(raw))
+	for _, r := range raw {
+		dl := &DeadLetter_t{}
+		if err := json.Unmarshal ([]byte(r), dl); err != nil { return nil, errors.Wrap (err, r) }
+		out = append (out, dl)
+	}
+	return out, nil
+}
+
+/*! \brief Removes the dead letter and returns it, ErrKeyNotFound if it isn't there
+	Only one caller can take it, so two admins replaying the same one won't run it twice
+*/
+func (this *DB_c) TakeDeadLetter (ctx context.Context, id string) (*DeadLetter_t, error) {
+	if this.DB == nil { return nil, errors.WithStack (ErrNoServiceAvailable) }
+
+	raw := ""
+	mn := radix.MaybeNil { Rcv: &raw }
+	if err := this.do (ctx, "DEADTAKE", deadLetterTakeScript.Cmd (&mn, deadLetterDataKey, deadLetterOrderKey, id)); err != nil {
+		return nil, this.record ("DEADTAKE", errors.WithStack (err))
+	}
+	if mn.Nil || len(raw) == 0 { return nil, this.record ("DEADTAKE", errors.Wrap (ErrKeyNotFound, id)) }
+	this.record ("DEADTAKE", nil)
+
+	dl := &DeadLetter_t{}
+	return dl, errors.Wrap (json.Unmarshal ([]byte(raw), dl), raw)
+}
+
+/*! \brief Removes every dead letter, returns how many there were
+*/
+func (this *DB_c) PurgeDeadLetters (ctx context.Context) (int, error) {
+	if this.DB == nil { return 0, errors.WithStack (ErrNoServiceAvailable) }
+
+	var cnt int
+	err := this.do (ctx, "DEADPURGE", deadLetterPurgeScript.Cmd (&cnt, deadLetterDataKey, deadLetterOrderKey))
+	return cnt, this.record ("DEADPURGE", errors.WithStack (err))
+}
+
+/*! \brief How many dead letters we're holding
+*/
+func (this *DB_c) DeadLetterCount (ctx context.Context) (size int) {
+	if this.DB == nil { return }
+	this.record ("HLEN", this.do (ctx, "HLEN", radix.Cmd (&size, "HLEN", deadLetterDataKey)))
+	return
+}
@@ -5,7 +5,8 @@
 package models 
 
 import (
-	
+	"encoding/json"
+	"time"
 )
 
   //-------------------------------------------------------------------------------------------------------------------------//
@@ -18,7 +19,9 @@ const MaxQueSize 			= 999999 	// max number of items in any of the queues
 type QueTask int
 const (
 	QueTask_nothing 			QueTask = iota 
-	
+	QueTask_providerEvents		// follow up on what mailgun and twilio have told us
+
+	QueTask_app					QueTask = 1000	// types registered outside of the boilerplate start here
 )
 
 //----- SCHEDULES -----//
@@ -26,7 +29,8 @@ const (
 type ScheduleType int64
 const (
 	ScheduleType_none 				ScheduleType = iota
-	
+
+	ScheduleType_app				ScheduleType = 1000	// types registered outside of the boilerplate start here
 )
 
   //-------------------------------------------------------------------------------------------------------------------------//
@@ -34,9 +38,30 @@ const (
 //-------------------------------------------------------------------------------------------------------------------------//
 
 type Que_t struct {
+	ID string `json:",omitempty"`	// set when it's queued, unique for every task
 	Type QueTask
-	Expires int64
+	Expires int64	// unix time after which it's not worth running, zero never expires
+	Attempts int `json:",omitempty"`	// times it's been run so far
     UserID UUID `json:",omitempty"`
+	Trace map[string]string `json:",omitempty"`	// trace context from whoever queued this, so we can link back to them
+	Payload json.RawMessage `json:",omitempty"`	// whatever the handler needs, decoded with cmd.DecodePayload
+	Version int `json:",omitempty"`	// schema version of the payload, from PayloadVersion_i when it's queued with cmd.Enqueue
+}
+
+//! Payloads that have changed shape over time say which version they are, zero if they don't
+type PayloadVersion_i interface {
+	PayloadVersion () int
+}
+
+//! Payloads that can read their older versions, tasks queued before a deploy are decoded with this
+type PayloadUpgrade_i interface {
+	UpgradePayload (version int, raw json.RawMessage) error
+}
+
+/*! \brief True once it's past the time it was worth running
+*/
+func (this *Que_t) Expired () bool {
+	return this.Expires > 0 && time.Now().Unix() >= this.Expires
 }
 
 type Schedule_t struct {
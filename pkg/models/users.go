@@ -26,7 +26,7 @@ type User_t struct {
 	ID UUID
 	Email, Password, Token ApiString
 	Mask UserMask `json:",omitempty"`
-	Created time.Time
+	Created, Updated time.Time
 	Attr struct {
 		First, Last ApiString `json:",omitempty"`
 	}
@@ -0,0 +1,222 @@
+/*! \file validate.go
+	\brief Struct tag validation for our request objects, ie `validate:"required,email"`
+	The ApiString rules use the same validators we've always used, so they also clean up the value, ie formatting a phone number
+*/
+
+package models
+
+import (
+	"github.com/pkg/errors"
+
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- TYPES -------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+//! Checks a single field, param is whatever came after the = in the tag. Returns an empty string if it's valid, otherwise what's wrong with it
+type Validator_f func (field reflect.Value, param string) string
+
+var apiStringType = reflect.TypeOf (ApiString(""))
+
+var validators = struct {
+	sync.RWMutex
+	fns map[string]Validator_f
+} { fns: make(map[string]Validator_f) }
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- LOCAL FUNCTIONS ---------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Returns the field as an ApiString we can run our validators on, nil if it isn't one
+*/
+func asApiString (v reflect.Value) *ApiString {
+	if v.Type() != apiStringType || !v.CanAddr() { return nil }
+	return v.Addr().Interface().(*ApiString)
+}
+
+/*! \brief Wraps one of our ApiString validators
+*/
+func apiStringRule (check func (*ApiString) bool, msg func (*ApiString) string) Validator_f {
+	return func (v reflect.Value, param string) string {
+		if str := asApiString (v); str != nil {
+			if !check (str) { return msg (str) }
+			return ""
+		}
+		if v.Kind() == reflect.String { // plain strings get checked on a copy
+			str := ApiString (v.String())
+			if !check (&str) { return msg (&str) }
+			return ""
+		}
+		return "can't be validated this way"
+	}
+}
+
+/*! \brief Length for strings and lists, the value itself for numbers
+*/
+func validateSize (v reflect.Value, param string, min bool) string {
+	limit, err := strconv.ParseFloat (param, 64)
+	if err != nil { return fmt.Sprintf("has an invalid limit '%s'", param) }
+
+	var size float64
+	unit := ""
+	switch v.Kind() {
+	case reflect.String:
+		size, unit = float64(len([]rune(strings.TrimSpace (v.String())))), " characters"
+	case reflect.Slice, reflect.Array, reflect.Map:
+		size, unit = float64(v.Len()), " items"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		size = float64(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		size = float64(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		size = v.Float()
+	default:
+		return "can't be validated this way"
+	}
+
+	if min && size < limit { return fmt.Sprintf("must be at least %s%s", param, unit) }
+	if !min && size > limit { return fmt.Sprintf("must be at most %s%s", param, unit) }
+	return ""
+}
+
+/*! \brief Checks if the value is empty, ApiStrings that are only spaces count as empty
+*/
+func emptyValue (v reflect.Value) bool {
+	if str := asApiString (v); str != nil { return !str.Valid() }
+	return v.IsZero()
+}
+
+func init () {
+	RegisterValidator ("required", func (v reflect.Value, param string) string {
+		if emptyValue (v) { return "is required" }
+		return ""
+	})
+	RegisterValidator ("email", apiStringRule ((*ApiString).Email, func (*ApiString) string { return "must be a valid email address" }))
+	RegisterValidator ("phone", apiStringRule ((*ApiString).Phone, func (*ApiString) string { return "must be a valid phone number" }))
+	RegisterValidator ("password", apiStringRule ((*ApiString).Password, (*ApiString).PassRequires))
+	RegisterValidator ("url", apiStringRule ((*ApiString).Url, func (*ApiString) string { return "must be a valid url" }))
+	RegisterValidator ("min", func (v reflect.Value, param string) string { return validateSize (v, param, true) })
+	RegisterValidator ("max", func (v reflect.Value, param string) string { return validateSize (v, param, false) })
+	RegisterValidator ("enum", func (v reflect.Value, param string) string {
+		opts := strings.Split (param, "|")
+		val := fmt.Sprintf("%v", v.Interface())
+		for _, o := range opts {
+			if strings.EqualFold (strings.TrimSpace (val), o) { return "" }
+		}
+		return "must be one of " + strings.Join (opts, ", ")
+	})
+}
+
+/*! \brief Returns the name the client knows this field by, the same one json uses, and false if json skips it entirely
+	Anything that reports on or reads fields by name should use this, so it lines up with the request body
+*/
+func JsonFieldName (f reflect.StructField) (string, bool) {
+	if len(f.PkgPath) > 0 && !f.Anonymous { return "", false } // unexported
+	tag := f.Tag.Get ("json")
+	if tag == "-" { return "", false }
+
+	name := strings.Split (tag, ",")[0]
+	if len(name) == 0 { name = f.Name }
+	return name, true
+}
+
+/*! \brief Runs the rules from the tag against a single field
+*/
+func validateField (v reflect.Value, tag, field string, errs *FieldErrors_t) {
+	rules := strings.Split (tag, ",")
+
+	// optional fields that weren't set don't need to pass anything else
+	if emptyValue (v) {
+		for _, rule := range rules {
+			if strings.TrimSpace (rule) == "required" { errs.Add (field, "is required") }
+		}
+		return
+	}
+
+	validators.RLock()
+	defer validators.RUnlock()
+
+	for _, rule := range rules {
+		name, param, _ := strings.Cut (strings.TrimSpace (rule), "=")
+		if len(name) == 0 { continue }
+
+		fn, ok := validators.fns[name]
+		if !ok {
+			errs.Add (field, fmt.Sprintf("has an unknown validation rule '%s'", name))
+			continue
+		}
+		if msg := fn (v, param); len(msg) > 0 {
+			errs.Add (field, msg)
+			return // one problem per field is plenty
+		}
+	}
+}
+
+/*! \brief Walks the struct checking every field with a validate tag, nested structs use dotted names, ie Attr.First
+*/
+func validateStruct (v reflect.Value, prefix string, errs *FieldErrors_t) {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() { return }
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct { return }
+
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, ok := JsonFieldName (f)
+		if !ok { continue }
+
+		fv := v.Field(i)
+		field := prefix + name
+		if f.Anonymous && len(f.Tag.Get ("json")) == 0 { field = strings.TrimSuffix (prefix, ".") } // embedded, so these are at our level
+
+		if tag := f.Tag.Get ("validate"); len(tag) > 0 && tag != "-" {
+			validateField (fv, tag, field, errs)
+		}
+
+		// now go down into anything that could have its own tags
+		inner := fv
+		for inner.Kind() == reflect.Ptr && !inner.IsNil() { inner = inner.Elem() }
+
+		switch inner.Kind() {
+		case reflect.Struct:
+			if f.Anonymous && len(f.Tag.Get ("json")) == 0 {
+				validateStruct (inner, prefix, errs)
+			} else {
+				validateStruct (inner, field + ".", errs)
+			}
+		case reflect.Slice, reflect.Array:
+			for j := 0; j < inner.Len(); j++ {
+				validateStruct (inner.Index(j), fmt.Sprintf("%s[%d].", field, j), errs)
+			}
+		}
+	}
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- FUNCTIONS ---------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Adds a rule that can be used in validate tags, or replaces one of ours
+*/
+func RegisterValidator (name string, fn Validator_f) {
+	validators.Lock()
+	defer validators.Unlock()
+	validators.fns[name] = fn
+}
+
+/*! \brief Checks every field with a validate tag, returning all the problems at once as a *FieldErrors_t
+	Pass in a pointer so the ApiString validators can clean up the values they check
+*/
+func Validate (in interface{}) error {
+	errs := &FieldErrors_t{}
+	validateStruct (reflect.ValueOf (in), "", errs)
+	return errors.WithStack (errs.Err())
+}
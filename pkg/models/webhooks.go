@@ -0,0 +1,100 @@
+/*! \file webhooks.go
+	\brief Outbound webhooks, so our users can hear about things happening in their account
+	A subscription is a url owned by a user (and optionally their org) with the events it wants, each event sent to it is a delivery
+*/
+
+package models
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- CONSTS ------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+//----- EVENTS -----//
+const (
+	WebhookEvent_all			= "*"	// subscribes to everything, the events themselves are whatever names the app publishes
+)
+
+//----- DELIVERIES -----//
+type WebhookStatus int
+const (
+	WebhookStatus_pending		WebhookStatus = iota	// waiting on its next attempt
+	WebhookStatus_delivered
+	WebhookStatus_failed		// we gave up on it
+)
+
+const (
+	webhookBackoff		= time.Second * 30	// first retry, this doubles each time
+	webhookMaxBackoff	= time.Hour * 6
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- DATA STRUCTS ------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+type Webhook_t struct {
+	ID UUID `json:",omitempty"`
+	UserID UUID `json:",omitempty"`
+	Org ApiString `json:",omitempty"`
+	Url ApiString `validate:"required,url,max=2000"`
+	Events []string `validate:"required,min=1,max=50"`	// the events it wants, or "*" for all of them
+	Description ApiString `json:",omitempty" validate:"max=1000"`
+	Secret ApiString `json:",omitempty"`	// signs every delivery, we only return it when the webhook is created
+	Disabled bool		// set by us after too many failures in a row, set it back to false to turn it on again
+	Failures int		// failed attempts in a row
+	Created, Updated time.Time
+}
+
+type WebhookDelivery_t struct {
+	ID UUID
+	WebhookID UUID
+	Event string
+	Payload json.RawMessage `json:",omitempty"`
+	Status WebhookStatus
+	Attempts int
+	NextAttempt time.Time
+	ResponseCode int `json:",omitempty"`	// from the last attempt
+	Error string `json:",omitempty"`
+	Created, Updated time.Time
+}
+
+//! What we actually post to the webhook url
+type WebhookBody_t struct {
+	ID UUID		// same for every attempt, so they can ignore the ones they've already seen
+	Event string
+	Created time.Time
+	Data json.RawMessage
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- FUNCTIONS ---------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief True if this webhook is on and subscribed to the event
+*/
+func (this *Webhook_t) Wants (event string) bool {
+	if this.Disabled { return false }
+	for _, e := range this.Events {
+		e = strings.TrimSpace (e)
+		if e == WebhookEvent_all || strings.EqualFold (e, event) { return true }
+	}
+	return false
+}
+
+/*! \brief How long we wait before the next attempt, after this many failed ones
+	Doubles each time starting at 30 seconds, and tops out at 6 hours
+*/
+func WebhookBackoff (attempts int) time.Duration {
+	if attempts < 1 { attempts = 1 }
+	wait := webhookBackoff
+	for x := 1; x < attempts; x++ {
+		wait *= 2
+		if wait >= webhookMaxBackoff { return webhookMaxBackoff }
+	}
+	return wait
+}
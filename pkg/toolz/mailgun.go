@@ -14,6 +14,11 @@ import (
 	"strings"
 	"context"
     "time"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"math"
+	"strconv"
     
 )
 
@@ -22,6 +27,7 @@ import (
 //-------------------------------------------------------------------------------------------------------------------------//
 
 const mailgun_default_from  = "Admin<info@example.com>"
+const MailgunHealthUrl		= "https://api.mailgun.net/v3"	// anything other than a server error means they're up
 
   //-------------------------------------------------------------------------------------------------------------------------//
  //----- STRUCTS -----------------------------------------------------------------------------------------------------------//
@@ -29,10 +35,35 @@ const mailgun_default_from  = "Admin<info@example.com>"
 
 type MailgunConfig_t struct {
 	Domain, Key string
+	WebhookKey string	// the http webhook signing key from their dashboard, for checking their callbacks
+}
+
+//! The signature block on every webhook they send us
+type MailgunSignature_t struct {
+	Timestamp string `json:"timestamp"`
+	Token string `json:"token"`
+	Signature string `json:"signature"`
+}
+
+//! A webhook from them, we only pull out what we use. EventData is also kept raw so we have the whole thing
+type MailgunWebhook_t struct {
+	Signature MailgunSignature_t `json:"signature"`
+	EventData struct {
+		ID string `json:"id"`
+		Event string `json:"event"`		// delivered, failed, complained, unsubscribed, etc
+		Severity string `json:"severity"`	// permanent or temporary, for failed
+		Reason string `json:"reason"`
+		Recipient string `json:"recipient"`
+		Timestamp float64 `json:"timestamp"`
+		DeliveryStatus struct {
+			Code int `json:"code"`
+			Message string `json:"message"`
+		} `json:"delivery-status"`
+	} `json:"event-data"`
 }
 
 type Mailgun_c struct {
-    
+	Suppressed Suppressed_f	// recipients this says are suppressed are dropped, nil sends to everyone
 }
 
   //-------------------------------------------------------------------------------------------------------------------------//
@@ -45,12 +76,17 @@ type Mailgun_c struct {
 //-------------------------------------------------------------------------------------------------------------------------//
 
 /*! \brief Sends a single plain text email to a user
+	Suppressed recipients are skipped, ErrType_suppressed if there's nobody left
  */
 func (this *Mailgun_c) Send (ctx context.Context, from, subject, body, html, campaign string, to ...string) error {
 	config, ok := ctx.Value ("mailgunConfig").(*MailgunConfig_t) // get our config
 	if !ok { return errors.New ("mailgun config missing from context") }
 
+	to, err := unsuppressed (ctx, this.Suppressed, to)
+	if err != nil { return errors.Wrap (err, subject) }
+
 	gun := mailgun.NewMailgun (config.Domain, config.Key)
+	gun.SetClient (httpClient)	// so we get our spans
 
     if len(from) < 1 { from = mailgun_default_from }
     
@@ -67,10 +103,31 @@ func (this *Mailgun_c) Send (ctx context.Context, from, subject, body, html, cam
 	gunCtx, cancel := context.WithTimeout (ctx, time.Second * 20) // give 20 seconds for this task
 	defer cancel()
     
-	_, _, err := gun.Send(gunCtx, email)   //send the message
+	_, _, err = gun.Send(gunCtx, email)   //send the message
 	return errors.Wrap (err, subject)
 }
 
+/*! \brief Checks the signature on a webhook they sent us, the hmac-sha256 of the timestamp and token using our webhook key
+	Tolerance is how old the timestamp can be, zero skips that check. Callers should also make sure they haven't seen the token before
+*/
+func (this *Mailgun_c) VerifyWebhook (key string, sig MailgunSignature_t, tolerance time.Duration) error {
+	if len(key) == 0 { return errors.New ("mailgun webhook key isn't set") }
+
+	ts, err := strconv.ParseInt (sig.Timestamp, 10, 64)
+	if err != nil { return errors.Wrapf (err, "invalid timestamp : %s", sig.Timestamp) }
+	if tolerance > 0 && math.Abs (float64(time.Now().Unix() - ts)) > tolerance.Seconds() {
+		return errors.Errorf ("signature timestamp is outside the tolerance : %d", ts)
+	}
+
+	expected, err := hex.DecodeString (sig.Signature)
+	if err != nil { return errors.Wrap (err, "invalid signature") }
+
+	mac := hmac.New (sha256.New, []byte(key))
+	mac.Write ([]byte(sig.Timestamp + sig.Token))
+	if !hmac.Equal (expected, mac.Sum (nil)) { return errors.New ("signature doesn't match") }
+	return nil
+}
+
 /*! \brief Does a validate call against the mailgun server
  */
 func (this *Mailgun_c) ValidateEmail (email *string) bool {
@@ -0,0 +1,75 @@
+/*! \file main.go
+ *  \brief Shared bits for talking to our third party services
+ */
+
+package toolz
+
+import (
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"github.com/pkg/errors"
+
+	"context"
+	"io"
+	"net/http"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- CONSTS ------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+//! All our outbound calls go through this so each one gets its own span, and the trace is passed along in the headers
+var httpClient = &http.Client {
+	Transport: otelhttp.NewTransport (http.DefaultTransport, 
+		otelhttp.WithSpanNameFormatter (func (_ string, r *http.Request) string { return r.Method + " " + r.URL.Host })),
+}
+
+//! Returned instead of sending when everyone it was going to has been suppressed, callers can treat it as done
+var ErrType_suppressed = errors.New ("recipient is suppressed")
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- TYPES -------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+//! Checked before every email and text, true if we shouldn't send to the address. ie App_c.Suppressed for the channel
+type Suppressed_f func (ctx context.Context, address string) (bool, error)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PRIVATE FUNCTIONS -------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Drops the suppressed addresses, ErrType_suppressed if that's all of them
+	A failed check is an error rather than a send, we'd rather retry than text someone who said STOP
+*/
+func unsuppressed (ctx context.Context, check Suppressed_f, addresses []string) ([]string, error) {
+	if check == nil { return addresses, nil }
+
+	out := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		suppressed, err := check (ctx, address)
+		if err != nil { return nil, err }
+		if !suppressed { out = append (out, address) }
+	}
+
+	if len(out) == 0 { return nil, errors.Wrapf (ErrType_suppressed, "%v", addresses) }
+	return out, nil
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PUBLIC FUNCTIONS --------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Checks that we can reach one of our providers, for health checks
+	Anything short of a server error counts, we're not sending them any credentials
+*/
+func Reachable (ctx context.Context, url string) error {
+	req, err := http.NewRequestWithContext (ctx, http.MethodGet, url, nil)
+	if err != nil { return errors.WithStack (err) }
+
+	resp, err := httpClient.Do (req)
+	if err != nil { return errors.Wrap (err, url) }
+	defer resp.Body.Close()
+	io.Copy (io.Discard, resp.Body)
+
+	if resp.StatusCode >= http.StatusInternalServerError { return errors.Errorf ("%s returned %d", url, resp.StatusCode) }
+	return nil
+}
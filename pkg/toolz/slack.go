@@ -21,6 +21,7 @@ import (
 //-------------------------------------------------------------------------------------------------------------------------//
 
 const slack_base_url    = "https://slack.com/api/"
+const SlackHealthUrl	= slack_base_url + "api.test"	// doesn't need a token, just tells us slack is up
 
   //-------------------------------------------------------------------------------------------------------------------------//
  //----- STRUCTS -----------------------------------------------------------------------------------------------------------//
@@ -63,7 +64,7 @@ func (this *Slack_c) send (ctx context.Context, url, requestType string, body sl
     req.Header.Set("Content-Length", strconv.Itoa(len(jsonBody)))
     req.Header.Set("Authorization", "Bearer " + config.Token)
     
-    resp, err := http.DefaultClient.Do(req)
+    resp, err := httpClient.Do(req)
 	if err != nil { return errors.Wrap (err, "slack client Failed") }
     defer resp.Body.Close()
 
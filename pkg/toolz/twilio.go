@@ -17,6 +17,11 @@ import (
 	"regexp"
 	"context"
 	"encoding/json"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"sort"
+	"strings"
 )
 
   //-------------------------------------------------------------------------------------------------------------------------//
@@ -25,6 +30,14 @@ import (
 
 const twilioMsgUrl = "2010-04-01/Accounts/%s/Messages.json"
 
+const TwilioHeader_signature = "X-Twilio-Signature"
+
+//! Keywords twilio treats as opting out of, or back into, messages from our number
+var (
+	TwilioStopWords		= []string{ "STOP", "STOPALL", "UNSUBSCRIBE", "CANCEL", "END", "QUIT", "REVOKE", "OPTOUT" }
+	TwilioStartWords	= []string{ "START", "YES", "UNSTOP" }
+)
+
 var (
 	ErrType_twilioInvalidNumber			= errors.New("Twilio to phone number is invalid")
 	ErrType_twilioRateLimitExceeded		= errors.New("Twilio message que limit reached")
@@ -36,6 +49,7 @@ var (
 
 type TwilioConfig_t struct {
 	SID, Token string
+	CallbackUrl string	// the public url they reach our task service at, ie https://tasks.example.com. It's part of their signature
 }
 
 type twilioResponse_t struct {
@@ -47,7 +61,7 @@ type twilioResponse_t struct {
 }
 
 type Twilio_c struct {
-
+	Suppressed Suppressed_f	// we won't text numbers this says are suppressed, nil texts everyone
 }
 
   //-------------------------------------------------------------------------------------------------------------------------//
@@ -58,9 +72,11 @@ type Twilio_c struct {
  //----- PUBLIC FUNCTIONS --------------------------------------------------------------------------------------------------//
 //-------------------------------------------------------------------------------------------------------------------------//
 
-/*! \brief Sends an sms/mms message to the target number
+/*! \brief Sends an sms/mms message to the target number, ErrType_suppressed if they've asked us to stop
 */
 func (this *Twilio_c) SMS (ctx context.Context, config *TwilioConfig_t, to, from, outMsg, outMediaUrl string) error {
+	if _, err := unsuppressed (ctx, this.Suppressed, []string { to }); err != nil { return err }
+
 	// setup our url param variables
 	vals := url.Values{}
 	vals.Set("To", to)
@@ -84,7 +100,7 @@ func (this *Twilio_c) SMS (ctx context.Context, config *TwilioConfig_t, to, from
 	req.SetBasicAuth (config.SID, config.Token)
 	req.Header.Set ("Content-Type", "application/x-www-form-urlencoded")
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := httpClient.Do(req)
 	if err != nil { return errors.WithStack (err) }
 
 	defer resp.Body.Close()
@@ -114,6 +130,51 @@ func (this *Twilio_c) SMS (ctx context.Context, config *TwilioConfig_t, to, from
 	return nil 	//we're good
 }
 
+/*! \brief Checks the X-Twilio-Signature on a callback they sent us
+	It's the base64 hmac-sha1 of the full url they called, followed by each post param name and value sorted by name, using our auth token
+*/
+func (this *Twilio_c) VerifySignature (token, fullUrl string, params url.Values, signature string) error {
+	if len(token) == 0 { return errors.New ("twilio token isn't set") }
+
+	expected, err := base64.StdEncoding.DecodeString (signature)
+	if err != nil || len(signature) == 0 { return errors.Errorf ("invalid signature : %s", signature) }
+
+	keys := make([]string, 0, len(params))
+	for k := range params { keys = append (keys, k) }
+	sort.Strings (keys)
+
+	var sb strings.Builder
+	sb.WriteString (fullUrl)
+	for _, k := range keys {
+		vals := append ([]string{}, params[k]...)
+		sort.Strings (vals)
+		for _, v := range vals {
+			sb.WriteString (k)
+			sb.WriteString (v)
+		}
+	}
+
+	mac := hmac.New (sha1.New, []byte(token))
+	mac.Write ([]byte(sb.String()))
+	if !hmac.Equal (expected, mac.Sum (nil)) { return errors.New ("signature doesn't match") }
+	return nil
+}
+
+/*! \brief Returns the opt out keyword, STOP or START, if the inbound message is one. Empty otherwise
+	Twilio sends this in OptOutType when advanced opt-out is on, otherwise we check the body ourselves
+*/
+func (this *Twilio_c) OptOut (optOutType, body string) string {
+	switch strings.ToUpper (optOutType) {
+	case "STOP", "START":
+		return strings.ToUpper (optOutType)
+	}
+
+	word := strings.ToUpper (strings.TrimSpace (body))
+	for _, w := range TwilioStopWords { if word == w { return "STOP" } }
+	for _, w := range TwilioStartWords { if word == w { return "START" } }
+	return ""
+}
+
 /*! \brief Validates a phone number and returns the twilio approved format for it
 */
 func (this *Twilio_c) ValidatePhoneNumber (original string) (out string, err error) {
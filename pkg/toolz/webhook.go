@@ -0,0 +1,194 @@
+/*! \file webhook.go
+ *  \brief Sends our outbound webhooks, signed so the receiver knows they came from us
+ *  The signature header is t=<unix time>,v1=<hex hmac-sha256 of "<unix time>.<body>"> using the webhook's secret
+ *  Users pick the urls, so they only go over https to public addresses. That's checked when the url is saved and again
+ *  when we connect, so a dns record changed after it was saved can't point us at our own network
+ */
+
+package toolz
+
+import (
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"github.com/pkg/errors"
+
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- CONSTS ------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+const (
+	WebhookHeader_signature	= "X-Webhook-Signature"
+	WebhookHeader_id		= "X-Webhook-ID"
+	WebhookHeader_event		= "X-Webhook-Event"
+
+	webhookUserAgent		= "boiler-webhooks/1.0"
+	webhookResponseLimit	= 1 << 10	// we only keep the start of their response for the error
+)
+
+//! Lets webhooks go over http and to private addresses, ie a receiver running on localhost. Only for local development and tests
+var WebhookAllowPrivate bool
+
+//! Shared address space, carrier nat and some cloud metadata services live here, it isn't covered by IsPrivate
+var webhookSharedNet = &net.IPNet { IP: net.IPv4 (100, 64, 0, 0), Mask: net.CIDRMask (10, 32) }
+
+//! Webhooks get their own client, every connection it makes is checked against where we're willing to send them
+var webhookClient = &http.Client {
+	Transport: otelhttp.NewTransport (&http.Transport {
+		Proxy: nil,	// a proxy would do the connecting, and we couldn't check where to
+		DialContext: (&net.Dialer { Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: webhookDialControl }).DialContext,
+		ForceAttemptHTTP2: true,
+		MaxIdleConns: 100,
+		IdleConnTimeout: 90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}, otelhttp.WithSpanNameFormatter (func (_ string, r *http.Request) string { return r.Method + " " + r.URL.Host })),
+	CheckRedirect: func (*http.Request, []*http.Request) error { return http.ErrUseLastResponse },	// a redirect is a failed attempt, not somewhere else to send it
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PRIVATE FUNCTIONS -------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+func webhookMAC (secret string, ts int64, body []byte) []byte {
+	mac := hmac.New (sha256.New, []byte(secret))
+	mac.Write ([]byte(strconv.FormatInt (ts, 10)))
+	mac.Write ([]byte("."))
+	mac.Write (body)
+	return mac.Sum (nil)
+}
+
+/*! \brief False for anything that isn't a public address, loopback, private, link-local, multicast and the like
+*/
+func webhookAddrAllowed (ip net.IP) bool {
+	if WebhookAllowPrivate { return true }
+	if ip == nil { return false }
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || webhookSharedNet.Contains (ip))
+}
+
+/*! \brief Only https, unless we're allowing private ones for development
+*/
+func webhookScheme (u *url.URL) error {
+	if u.Scheme == "https" || (WebhookAllowPrivate && u.Scheme == "http") { return nil }
+	return errors.Errorf ("must be an https url")
+}
+
+/*! \brief The net.Dialer Control for the webhook client, this runs after dns so it sees the address we're actually connecting to
+*/
+func webhookDialControl (network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort (address)
+	if err != nil { return errors.Wrap (err, address) }
+
+	if !webhookAddrAllowed (net.ParseIP (host)) { return errors.Errorf ("webhooks can't be sent to %s, it isn't a public address", host) }
+	return nil
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PUBLIC FUNCTIONS --------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Checks a webhook url when it's saved, it has to be https and every address it resolves to has to be public
+	The error is meant for the user, so they know what to fix
+*/
+func CheckWebhookUrl (ctx context.Context, raw string) error {
+	u, err := url.Parse (raw)
+	if err != nil || len(u.Hostname()) == 0 { return errors.Errorf ("must be a valid url") }
+	if err = webhookScheme (u); err != nil { return err }
+
+	ips := []net.IP { net.ParseIP (u.Hostname()) }
+	if ips[0] == nil { // it's a name
+		addrs, err := net.DefaultResolver.LookupIPAddr (ctx, u.Hostname())
+		if err != nil { return errors.Errorf ("couldn't look up %s", u.Hostname()) }
+
+		ips = ips[:0]
+		for _, a := range addrs { ips = append (ips, a.IP) }
+	}
+
+	for _, ip := range ips {
+		if !webhookAddrAllowed (ip) { return errors.Errorf ("must be a public address, %s resolves to %s", u.Hostname(), ip) }
+	}
+	return nil
+}
+
+/*! \brief Random secret for a new webhook
+*/
+func WebhookSecret () (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read (b); err != nil { return "", errors.WithStack (err) }
+	return "whsec_" + hex.EncodeToString (b), nil
+}
+
+/*! \brief Returns the value for our signature header
+*/
+func SignWebhook (secret string, ts time.Time, body []byte) string {
+	return fmt.Sprintf("t=%d,v1=%s", ts.Unix(), hex.EncodeToString (webhookMAC (secret, ts.Unix(), body)))
+}
+
+/*! \brief Checks a signature header against the body, what a receiver does with our webhooks
+	Tolerance is how old the timestamp can be, so old deliveries can't be replayed. Zero skips that check
+*/
+func VerifyWebhook (secret, header string, body []byte, tolerance time.Duration) error {
+	var ts int64 = -1
+	var sig []byte
+
+	for _, part := range strings.Split (header, ",") {
+		key, val, _ := strings.Cut (strings.TrimSpace (part), "=")
+		switch key {
+		case "t":
+			ts, _ = strconv.ParseInt (val, 10, 64)
+		case "v1":
+			sig, _ = hex.DecodeString (val)
+		}
+	}
+	if ts < 0 || len(sig) == 0 { return errors.Errorf ("invalid signature header : %s", header) }
+
+	if tolerance > 0 && math.Abs (float64(time.Now().Unix() - ts)) > tolerance.Seconds() {
+		return errors.Errorf ("signature timestamp is outside the tolerance : %d", ts)
+	}
+
+	if !hmac.Equal (sig, webhookMAC (secret, ts, body)) { return errors.New ("signature doesn't match") }
+	return nil
+}
+
+/*! \brief Posts the body to the url, signed with the secret
+	Returns the status code they sent back, anything outside of the 200s is an error. Redirects aren't followed
+*/
+func SendWebhook (ctx context.Context, url, secret, id, event string, body []byte) (int, error) {
+	req, err := http.NewRequestWithContext (ctx, http.MethodPost, url, bytes.NewReader (body))
+	if err != nil { return 0, errors.WithStack (err) }
+	if err = webhookScheme (req.URL); err != nil { return 0, errors.Wrap (err, url) }
+
+	req.Header.Set ("Content-Type", "application/json")
+	req.Header.Set ("User-Agent", webhookUserAgent)
+	req.Header.Set (WebhookHeader_id, id)
+	req.Header.Set (WebhookHeader_event, event)
+	req.Header.Set (WebhookHeader_signature, SignWebhook (secret, time.Now(), body))
+
+	resp, err := webhookClient.Do (req)
+	if err != nil { return 0, errors.Wrap (err, url) }
+	defer resp.Body.Close()
+
+	msg, _ := io.ReadAll (io.LimitReader (resp.Body, webhookResponseLimit))
+	io.Copy (io.Discard, resp.Body)	// so the connection can be reused
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return resp.StatusCode, errors.Errorf ("%s returned %d : %s", url, resp.StatusCode, strings.TrimSpace (string(msg)))
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,102 @@
+/*! \file webhook_test.go
+	\brief Tests for signing our webhooks, and for where we're willing to send them
+*/
+
+package toolz
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignWebhook (t *testing.T) {
+	secret, err := WebhookSecret()
+	if err != nil { t.Fatal (err) }
+	if !strings.HasPrefix (secret, "whsec_") { t.Fatalf ("unexpected secret : %s", secret) }
+
+	body := []byte(`{"ID":"1","Event":"user.updated"}`)
+	now := time.Now()
+	header := SignWebhook (secret, now, body)
+
+	if err = VerifyWebhook (secret, header, body, time.Minute); err != nil { t.Fatalf ("round trip failed : %v", err) }
+	if err = VerifyWebhook (secret + "x", header, body, time.Minute); err == nil { t.Fatal ("verified with the wrong secret") }
+	if err = VerifyWebhook (secret, header, []byte(`{"ID":"2"}`), time.Minute); err == nil { t.Fatal ("verified a different body") }
+
+	for _, bad := range []string { "", "t=1", "v1=abcd", "t=x,v1=zz" } {
+		if err = VerifyWebhook (secret, bad, body, 0); err == nil { t.Errorf ("verified a bad header : %q", bad) }
+	}
+}
+
+func TestVerifyWebhookTolerance (t *testing.T) {
+	body := []byte(`{}`)
+	old := SignWebhook ("secret", time.Now().Add (-time.Hour), body)
+
+	if err := VerifyWebhook ("secret", old, body, time.Minute * 5); err == nil { t.Fatal ("an hour old signature passed a 5 minute tolerance") }
+	if err := VerifyWebhook ("secret", old, body, time.Hour * 2); err != nil { t.Fatalf ("inside the tolerance : %v", err) }
+	if err := VerifyWebhook ("secret", old, body, 0); err != nil { t.Fatalf ("zero should skip the tolerance : %v", err) }
+
+	future := SignWebhook ("secret", time.Now().Add (time.Hour), body)	// a skewed clock is just as bad the other way
+	if err := VerifyWebhook ("secret", future, body, time.Minute * 5); err == nil { t.Fatal ("an hour ahead passed a 5 minute tolerance") }
+}
+
+func TestCheckWebhookUrl (t *testing.T) {
+	ctx := context.Background()
+
+	for _, u := range []string {
+		"http://93.184.215.14/hook",	// not https
+		"ftp://93.184.215.14/hook",
+		"https:///hook",
+		"https://127.0.0.1/hook",
+		"https://10.1.2.3/hook",
+		"https://172.16.0.1/hook",
+		"https://192.168.1.1/hook",
+		"https://169.254.169.254/latest/meta-data",	// cloud metadata
+		"https://100.100.100.200/hook",
+		"https://0.0.0.0/hook",
+		"https://[::1]/hook",
+		"https://[fd00::1]/hook",
+		"https://[fe80::1]/hook",
+		"https://[::ffff:127.0.0.1]/hook",
+		"https://localhost/hook",
+	}{
+		if err := CheckWebhookUrl (ctx, u); err == nil { t.Errorf ("allowed %s", u) }
+	}
+
+	if err := CheckWebhookUrl (ctx, "https://93.184.215.14/hook"); err != nil { t.Errorf ("public address wasn't allowed : %v", err) }
+}
+
+func TestSendWebhookPrivate (t *testing.T) {
+	hit := false
+	srv := httptest.NewServer (http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { hit = true }))
+	defer srv.Close()
+
+	// our check at connect time is what stops this, the url itself never went through CheckWebhookUrl
+	if _, err := SendWebhook (context.Background(), srv.URL, "secret", "1", "test", []byte(`{}`)); err == nil { t.Fatal ("sent to a private address") }
+	if hit { t.Fatal ("the request reached the server") }
+
+	if err := webhookDialControl ("tcp", net.JoinHostPort ("8.8.8.8", "443"), nil); err != nil { t.Fatalf ("public address was blocked : %v", err) }
+	if err := webhookDialControl ("tcp", net.JoinHostPort ("169.254.169.254", "80"), nil); err == nil { t.Fatal ("metadata address wasn't blocked") }
+}
+
+func TestSendWebhook (t *testing.T) {
+	WebhookAllowPrivate = true
+	defer func() { WebhookAllowPrivate = false }()
+
+	body := []byte(`{"ID":"1"}`)
+	srv := httptest.NewServer (http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get (WebhookHeader_id) != "1" || r.Header.Get (WebhookHeader_event) != "test" { w.WriteHeader (http.StatusBadRequest) }
+		if r.URL.Path == "/redirect" { http.Redirect (w, r, "/", http.StatusFound) }
+	}))
+	defer srv.Close()
+
+	code, err := SendWebhook (context.Background(), srv.URL, "secret", "1", "test", body)
+	if err != nil || code != http.StatusOK { t.Fatalf ("%d : %v", code, err) }
+
+	code, err = SendWebhook (context.Background(), srv.URL + "/redirect", "secret", "1", "test", body)
+	if err == nil || code != http.StatusFound { t.Fatalf ("the redirect should be a failed attempt, got %d : %v", code, err) }
+}